@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrBlobNotFound is returned for a key the store does not hold
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobMeta describes a stored blob
+type BlobMeta struct {
+	ContentType string    `json:"content_type"`
+	Filename    string    `json:"filename"` // as the client named it
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+}
+
+// Blob is an open stored blob
+type Blob struct {
+	io.ReadSeekCloser
+	BlobMeta
+}
+
+// BlobStore stores uploaded files. The upload handler only talks to this
+// interface, so files can live on local disk, in object storage, or in
+// memory in tests.
+type BlobStore interface {
+	// Put stores everything read from r under key and returns the number
+	// of bytes stored. Size and ModTime in meta are filled in by the
+	// store. Nothing is stored if reading r fails.
+	Put(ctx context.Context, key string, r io.Reader, meta BlobMeta) (int64, error)
+	// Get opens the blob under key. The caller closes it.
+	Get(ctx context.Context, key string) (*Blob, error)
+	// Delete removes the blob under key
+	Delete(ctx context.Context, key string) error
+}
+
+// DiskStore is a BlobStore in a directory on local disk. Each blob is a
+// file named by its key, next to a key.meta.json file holding its
+// metadata.
+type DiskStore struct {
+	dir string
+}
+
+// NewDiskStore returns a store in dir. The directory is created on the
+// first Put.
+func NewDiskStore(dir string) *DiskStore {
+	return &DiskStore{dir: dir}
+}
+
+const metaSuffix = ".meta.json"
+
+// path returns where key is stored, or false if key could escape the
+// directory or clash with a metadata file
+func (s *DiskStore) path(key string) (string, bool) {
+	if key == "" || strings.HasPrefix(key, ".") || strings.ContainsAny(key, `/\`) ||
+		strings.HasSuffix(key, metaSuffix) || !filepath.IsLocal(key) {
+		return "", false
+	}
+	return filepath.Join(s.dir, key), true
+}
+
+func (s *DiskStore) Put(ctx context.Context, key string, r io.Reader, meta BlobMeta) (int64, error) {
+	path, ok := s.path(key)
+	if !ok {
+		return 0, errors.New("invalid blob key " + key)
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return 0, err
+	}
+
+	// Write to a temporary file and rename it into place, so a reader
+	// never sees half a blob
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return n, err
+	}
+
+	meta.Size = n
+	meta.ModTime = time.Now().UTC()
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return n, err
+	}
+	if err := os.WriteFile(path+metaSuffix, data, 0o644); err != nil {
+		return n, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(path + metaSuffix)
+		return n, err
+	}
+	return n, nil
+}
+
+func (s *DiskStore) Get(ctx context.Context, key string) (*Blob, error) {
+	path, ok := s.path(key)
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	data, err := os.ReadFile(path + metaSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta BlobMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Blob{ReadSeekCloser: f, BlobMeta: meta}, nil
+}
+
+func (s *DiskStore) Delete(ctx context.Context, key string) error {
+	path, ok := s.path(key)
+	if !ok {
+		return ErrBlobNotFound
+	}
+	err := os.Remove(path)
+	os.Remove(path + metaSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrBlobNotFound
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// echoFormats are the response formats /echo can produce, in order of
+// preference when the client accepts several equally
+var echoFormats = []string{"text/plain", "application/json", "application/octet-stream"}
+
+// echoMemorySize is how much of a body /echo keeps in memory. The rest
+// is spilled to a temporary file until the body has been read in full.
+const echoMemorySize = 32 << 10
+
+// echoResponse is the application/json reply: the body with what the
+// server saw of the request, minus any credentials. Text bodies come
+// back as body; anything that is not valid UTF-8 comes back
+// base64-encoded as body_base64.
+type echoResponse struct {
+	Size        int64       `json:"size"`
+	ContentType string      `json:"content_type,omitempty"`
+	Chunked     bool        `json:"chunked"`
+	Headers     http.Header `json:"headers"`
+	Body        string      `json:"body,omitempty"`
+	BodyBase64  []byte      `json:"body_base64,omitempty"`
+}
+
+// echoHiddenHeaders carry credentials and are never echoed back, so a
+// page that can read the reply cannot read them.
+var echoHiddenHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// echoEvent is published to /events for every body echoed
+type echoEvent struct {
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	Format      string `json:"format"`
+}
+
+// echoHandler demonstrates reading a request body. Bodies larger than
+// maxBytes get a 413, whether or not they declare a Content-Length.
+// The Accept header picks the reply: "You sent: ..." as text/plain (the
+// default), the body with its metadata as application/json, or the
+// bytes unchanged as application/octet-stream. Each echo is announced on
+// events as an "echo" event.
+func echoHandler(maxBytes int64, events *Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		format, ok := negotiate(r.Header.Get("Accept"), echoFormats)
+		if !ok {
+			http.Error(w, "Acceptable formats: "+strings.Join(echoFormats, ", "), http.StatusNotAcceptable)
+			return
+		}
+
+		// A declared length over the limit is refused without reading
+		if r.ContentLength > maxBytes {
+			bodyTooLarge(w, maxBytes)
+			return
+		}
+		body := http.MaxBytesReader(w, r.Body, maxBytes)
+		defer body.Close()
+
+		var size int64
+		var echoed bool
+		if format == "application/json" {
+			size, echoed = echoJSON(w, r, body, maxBytes)
+		} else {
+			size, echoed = echoStream(w, r, body, format, maxBytes)
+		}
+		if echoed {
+			events.PublishJSON("echo", echoEvent{Size: size, ContentType: r.Header.Get("Content-Type"), Format: format})
+		}
+	}
+}
+
+// echoStream reads the whole body before it answers, so a body over the
+// limit always gets a 413, however it was sent. Past echoMemorySize the
+// body is spilled to a temporary file, so memory use does not grow with
+// it. It returns the size of the body and whether it was echoed.
+func echoStream(w http.ResponseWriter, r *http.Request, body io.Reader, format string, maxBytes int64) (int64, bool) {
+	head := make([]byte, echoMemorySize)
+	n, err := io.ReadFull(body, head)
+	size := int64(n)
+	var spill *os.File
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		// All of it fit in memory
+	case err != nil:
+		readError(w, err, maxBytes)
+		return 0, false
+	default:
+		spill, err = os.CreateTemp("", "echo-*")
+		if err != nil {
+			http.Error(w, "Error buffering body", http.StatusInternalServerError)
+			return 0, false
+		}
+		defer func() {
+			spill.Close()
+			os.Remove(spill.Name())
+		}()
+		rest, err := io.Copy(spill, body)
+		if err != nil {
+			readError(w, err, maxBytes)
+			return 0, false
+		}
+		if _, err := spill.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "Error buffering body", http.StatusInternalServerError)
+			return 0, false
+		}
+		size += rest
+	}
+
+	if format == "application/octet-stream" {
+		ct := r.Header.Get("Content-Type")
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ct)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "You sent: ")
+	}
+	w.Write(head[:n])
+	if spill != nil {
+		io.Copy(w, spill)
+	}
+	return size, true
+}
+
+// echoJSON reads the whole body, since its size is part of the reply
+func echoJSON(w http.ResponseWriter, r *http.Request, body io.Reader, maxBytes int64) (int64, bool) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		readError(w, err, maxBytes)
+		return 0, false
+	}
+
+	resp := echoResponse{
+		Size:        int64(len(data)),
+		ContentType: r.Header.Get("Content-Type"),
+		Chunked:     slices.Contains(r.TransferEncoding, "chunked"),
+		Headers:     r.Header.Clone(),
+	}
+	for _, name := range echoHiddenHeaders {
+		resp.Headers.Del(name)
+	}
+	if utf8.Valid(data) {
+		resp.Body = string(data)
+	} else {
+		resp.BodyBase64 = data
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+	return resp.Size, true
+}
+
+// readError reports a failure to read the request body
+func readError(w http.ResponseWriter, err error, maxBytes int64) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		bodyTooLarge(w, maxBytes)
+		return
+	}
+	http.Error(w, "Error reading body", http.StatusBadRequest)
+}
+
+func bodyTooLarge(w http.ResponseWriter, maxBytes int64) {
+	http.Error(w, fmt.Sprintf("Request body must not exceed %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+}
+
+// negotiate picks the offer that best matches an Accept header, taking
+// q-values and wildcards into account. An empty header accepts anything.
+// Among offers the client likes equally, the earlier one wins. ok is
+// false when the client accepts none of them.
+func negotiate(accept string, offers []string) (best string, ok bool) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+
+	bestQ := 0.0
+	for _, offer := range offers {
+		// The most specific range that matches the offer sets its quality
+		q, specificity := 0.0, -1
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(part)
+			if err != nil {
+				continue
+			}
+			s := matchSpecificity(mediaType, offer)
+			if s <= specificity {
+				continue
+			}
+			specificity, q = s, 1.0
+			if v, ok := params["q"]; ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// matchSpecificity says how closely a media range from Accept matches
+// mediaType: 2 for an exact match, 1 for type/*, 0 for */* and -1 for
+// no match at all
+func matchSpecificity(mediaRange, mediaType string) int {
+	if mediaRange == mediaType {
+		return 2
+	}
+	if mediaRange == "*/*" {
+		return 0
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+	if mediaRange == typ+"/*" {
+		return 1
+	}
+	return -1
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// chunkedRequest builds a POST /echo whose length is unknown up front,
+// as it is when a client sends Transfer-Encoding: chunked
+func chunkedRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/echo", io.NopCloser(strings.NewReader(body)))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	return req
+}
+
+func TestEchoNegotiation(t *testing.T) {
+	tests := []struct {
+		name     string
+		accept   string
+		wantType string
+		wantBody string
+	}{
+		{"no accept", "", "text/plain; charset=utf-8", "You sent: hello"},
+		{"anything", "*/*", "text/plain; charset=utf-8", "You sent: hello"},
+		{"text", "text/*", "text/plain; charset=utf-8", "You sent: hello"},
+		{"raw", "application/octet-stream", "application/x-greeting", "hello"},
+		{"raw preferred by q", "text/plain;q=0.5, application/octet-stream", "application/x-greeting", "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader("hello"))
+			req.Header.Set("Accept", tt.accept)
+			req.Header.Set("Content-Type", "application/x-greeting")
+			w := httptest.NewRecorder()
+
+			echoHandler(1024, nil)(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Expected Content-Type %s, got %s", tt.wantType, got)
+			}
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("Expected %q, got %q", tt.wantBody, got)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader("hello"))
+	req.Header.Set("Accept", "image/png, text/plain;q=0")
+	w := httptest.NewRecorder()
+	echoHandler(1024, nil)(w, req)
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected status 406, got %d", w.Code)
+	}
+}
+
+func TestEchoJSON(t *testing.T) {
+	req := chunkedRequest("hello")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	w := httptest.NewRecorder()
+
+	echoHandler(1024, nil)(w, req)
+
+	var resp echoResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if resp.Size != 5 || resp.Body != "hello" || resp.ContentType != "text/plain" || !resp.Chunked {
+		t.Errorf("Unexpected metadata: %+v", resp)
+	}
+	if resp.Headers.Get("Accept") != "application/json" {
+		t.Errorf("Expected the request headers, got %v", resp.Headers)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("Expected credentials to be left out, got %v", resp.Headers)
+	}
+
+	// Binary bodies survive the trip as base64
+	binary := []byte{0xff, 0x00, 0xfe}
+	req = httptest.NewRequest(http.MethodPost, "/echo", bytes.NewReader(binary))
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	echoHandler(1024, nil)(w, req)
+	resp = echoResponse{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if !bytes.Equal(resp.BodyBase64, binary) || resp.Body != "" {
+		t.Errorf("Expected a base64 body, got %+v", resp)
+	}
+}
+
+func TestEchoBodyLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		req    *http.Request
+	}{
+		{"declared length", "", httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader("too long"))},
+		{"chunked text", "", chunkedRequest("too long")},
+		{"chunked json", "application/json", chunkedRequest("too long")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+
+			echoHandler(4, nil)(w, tt.req)
+
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("Expected status 413, got %d", w.Code)
+			}
+		})
+	}
+
+	// Exactly at the limit is fine
+	w := httptest.NewRecorder()
+	echoHandler(4, nil)(w, chunkedRequest("four"))
+	if w.Code != http.StatusOK || w.Body.String() != "You sent: four" {
+		t.Errorf("Expected the body at the limit to be echoed, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// TestEchoLargeBodies sends chunked bodies bigger than the part /echo
+// keeps in memory, through a real connection
+func TestEchoLargeBodies(t *testing.T) {
+	const limit = 4 * echoMemorySize
+	srv := httptest.NewServer(echoHandler(limit, nil))
+	defer srv.Close()
+
+	post := func(body []byte) (*http.Response, error) {
+		// A reader with no Len makes the client send the body chunked
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL,
+			io.MultiReader(bytes.NewReader(body)))
+		req.Header.Set("Accept", "application/octet-stream")
+		return srv.Client().Do(req)
+	}
+
+	body := bytes.Repeat([]byte("0123456789"), limit/10)
+	resp, err := post(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(got, body) {
+		t.Errorf("Expected %d bytes back, got %d (%v)", len(body), len(got), err)
+	}
+
+	// Over the limit, well past what is kept in memory, still gets a 413
+	resp, err = post(append(body, bytes.Repeat([]byte("x"), echoMemorySize)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d", resp.StatusCode)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/plain", "application/json"}
+	tests := []struct {
+		accept string
+		want   string
+		wantOK bool
+	}{
+		{"", "text/plain", true},
+		{"application/json", "application/json", true},
+		{"application/*", "application/json", true},
+		{"text/plain;q=0.2, application/json;q=0.8", "application/json", true},
+		{"*/*;q=0.1, text/plain;q=0", "application/json", true},
+		{"text/html", "", false},
+		{"not a type, application/json", "application/json", true},
+	}
+
+	for _, tt := range tests {
+		got, ok := negotiate(tt.accept, offers)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("negotiate(%q) = %q, %v; want %q, %v", tt.accept, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is one server-sent event. Type is the event: field that
+// EventSource listeners register for; an empty Type is a plain
+// "message".
+type Event struct {
+	ID   uint64
+	Type string
+	Data string
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind by
+// before it is dropped. A dropped client reconnects with Last-Event-ID
+// and catches up from the replay buffer.
+const subscriberBuffer = 16
+
+// Broker fans published events out to every /events stream and keeps
+// the most recent ones so that a client that reconnects can resume where
+// it left off. It is safe for concurrent use. A nil *Broker discards
+// everything published to it.
+type Broker struct {
+	mu     sync.Mutex
+	nextID uint64
+	replay []Event // ring buffer of the last len(replay) events
+	count  int     // events in replay, up to len(replay)
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+// NewBroker returns a broker that keeps the last replay events
+func NewBroker(replay int) *Broker {
+	return &Broker{nextID: 1, replay: make([]Event, replay), subs: make(map[chan Event]struct{})}
+}
+
+// Publish assigns the next ID to an event and sends it to every
+// subscriber
+func (b *Broker) Publish(typ, data string) Event {
+	if b == nil {
+		return Event{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := Event{ID: b.nextID, Type: typ, Data: data}
+	b.nextID++
+	if len(b.replay) > 0 {
+		b.replay[e.ID%uint64(len(b.replay))] = e
+		b.count = min(b.count+1, len(b.replay))
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// Too slow: drop it rather than hold up everyone else
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return e
+}
+
+// PublishJSON publishes v encoded as JSON
+func (b *Broker) PublishJSON(typ string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	b.Publish(typ, string(data))
+}
+
+// Subscribe returns the buffered events after lastID, followed on ch by
+// every event published from now on. A lastID of 0 skips the replay. ch
+// is closed when the subscriber falls too far behind or the broker
+// closes; cancel must be called once the subscriber is done.
+func (b *Broker) Subscribe(lastID uint64) (missed []Event, ch <-chan Event, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := make(chan Event, subscriberBuffer)
+	if b.closed {
+		close(c)
+		return nil, c, func() {}
+	}
+	b.subs[c] = struct{}{}
+
+	if lastID > 0 {
+		// Oldest first; anything older than the buffer is lost
+		for id := b.nextID - uint64(b.count); id < b.nextID; id++ {
+			if id > lastID {
+				missed = append(missed, b.replay[id%uint64(len(b.replay))])
+			}
+		}
+	}
+
+	cancel = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[c]; ok {
+			delete(b.subs, c)
+			close(c)
+		}
+	}
+	return missed, c, cancel
+}
+
+// Close ends every stream and refuses new subscribers. The server calls
+// it on shutdown, since open streams would otherwise hold up the drain
+// until its deadline.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// subscribers returns how many streams are open
+func (b *Broker) subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// eventsHandler streams the broker's events as text/event-stream. A
+// client that sends Last-Event-ID first gets the buffered events it
+// missed. A comment line goes out every keepAlive so that proxies do not
+// close an idle stream. The stream ends when the client goes away, which
+// cancels the request context.
+func eventsHandler(b *Broker, keepAlive time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The server's WriteTimeout would cut every stream off, so lift it
+		// for this response
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+
+		var lastID uint64
+		if v := r.Header.Get("Last-Event-ID"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+			lastID = id
+		}
+
+		missed, events, cancel := b.Subscribe(lastID)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // tell nginx not to buffer the stream
+		w.WriteHeader(http.StatusOK)
+
+		// Ask EventSource to wait a little before reconnecting
+		fmt.Fprint(w, "retry: 2000\n\n")
+		for _, e := range missed {
+			writeEvent(w, e)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				writeEvent(w, e)
+			case <-ticker.C:
+				io.WriteString(w, ": keep-alive\n\n")
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes e in the text/event-stream format. Every line of the
+// data gets its own data: field; the client joins them back with
+// newlines.
+func writeEvent(w io.Writer, e Event) {
+	fmt.Fprintf(w, "id: %d\n", e.ID)
+	if e.Type != "" {
+		// A line break in the type would start a new field
+		fmt.Fprintf(w, "event: %s\n", strings.NewReplacer("\r", "", "\n", "").Replace(e.Type))
+	}
+	data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(e.Data)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	io.WriteString(w, "\n")
+}
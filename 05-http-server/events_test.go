@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBrokerReplay(t *testing.T) {
+	b := NewBroker(3)
+	for i := 1; i <= 5; i++ {
+		if e := b.Publish("tick", fmt.Sprint(i)); e.ID != uint64(i) {
+			t.Fatalf("Expected ID %d, got %d", i, e.ID)
+		}
+	}
+
+	tests := []struct {
+		lastID uint64
+		want   string
+	}{
+		{0, "[]"},      // a fresh client gets no history
+		{1, "[3 4 5]"}, // 2 has fallen out of the buffer
+		{3, "[4 5]"},
+		{5, "[]"},
+		{9, "[]"}, // an ID from before a restart
+	}
+	for _, tt := range tests {
+		missed, _, cancel := b.Subscribe(tt.lastID)
+		cancel()
+
+		var ids []uint64
+		for _, e := range missed {
+			ids = append(ids, e.ID)
+		}
+		if got := fmt.Sprint(ids); got != tt.want {
+			t.Errorf("Subscribe(%d): expected %s, got %s", tt.lastID, tt.want, got)
+		}
+	}
+
+	// A nil broker swallows events, so handlers can run without one
+	var none *Broker
+	none.Publish("tick", "ignored")
+}
+
+func TestBrokerDropsSlowSubscribers(t *testing.T) {
+	b := NewBroker(0)
+	_, events, cancel := b.Subscribe(0)
+	defer cancel()
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		b.Publish("tick", "")
+	}
+	for range events {
+		// drain what was buffered; the range ends when the broker closes it
+	}
+	if n := b.subscribers(); n != 0 {
+		t.Errorf("Expected the slow subscriber to be dropped, %d left", n)
+	}
+}
+
+// sseStream is an open /events connection
+type sseStream struct {
+	r      *bufio.Reader
+	cancel context.CancelFunc
+}
+
+// openEvents connects to /events on url, sending lastID when it is not
+// empty
+func openEvents(t *testing.T, url, lastID string) *sseStream {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+"/events", nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %q", ct)
+	}
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+	})
+	return &sseStream{r: bufio.NewReader(resp.Body), cancel: cancel}
+}
+
+// next reads up to the next blank line and returns the block without
+// it, skipping the retry: preamble
+func (s *sseStream) next(t *testing.T) string {
+	t.Helper()
+	for {
+		var block []string
+		for {
+			line, err := s.r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Reading the stream: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				break
+			}
+			block = append(block, line)
+		}
+		if len(block) > 0 && !strings.HasPrefix(block[0], "retry:") {
+			return strings.Join(block, "\n")
+		}
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.EventsKeepAlive = time.Hour
+	s := NewServer(cfg)
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close) // after the streams' own cleanups
+
+	stream := openEvents(t, srv.URL, "")
+	waitFor(t, func() bool { return s.events.subscribers() == 1 })
+
+	// Other handlers publish to the stream
+	resp, err := http.Post(srv.URL+"/echo", "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	want := "id: 1\nevent: echo\n" + `data: {"size":2,"content_type":"text/plain","format":"text/plain"}`
+	if got := stream.next(t); got != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, got)
+	}
+
+	// Multi-line data is split across data: fields
+	s.events.Publish("", "one\ntwo")
+	if got := stream.next(t); got != "id: 2\ndata: one\ndata: two" {
+		t.Errorf("Expected a two-line message, got\n%s", got)
+	}
+
+	// A client that reconnects gets what it missed
+	s.events.Publish("note", "three")
+	resumed := openEvents(t, srv.URL, "1")
+	if got := resumed.next(t); !strings.HasPrefix(got, "id: 2\n") {
+		t.Errorf("Expected the replay to start at 2, got\n%s", got)
+	}
+	if got := resumed.next(t); got != "id: 3\nevent: note\ndata: three" {
+		t.Errorf("Expected event 3, got\n%s", got)
+	}
+
+	// Closing the connection cancels the request context, which ends the
+	// handler and its subscription
+	stream.cancel()
+	resumed.cancel()
+	waitFor(t, func() bool { return s.events.subscribers() == 0 })
+}
+
+func TestEventsKeepAlive(t *testing.T) {
+	b := NewBroker(10)
+	srv := httptest.NewServer(http.HandlerFunc(eventsHandler(b, 10*time.Millisecond)))
+	t.Cleanup(srv.Close)
+
+	stream := openEvents(t, srv.URL, "")
+	if got := stream.next(t); got != ": keep-alive" {
+		t.Errorf("Expected a keep-alive comment, got %q", got)
+	}
+}
+
+func TestEventsBadLastEventID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	w := httptest.NewRecorder()
+
+	eventsHandler(NewBroker(10), time.Hour)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
+
+func TestShutdownEndsEventStreams(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ShutdownTimeout = 5 * time.Second
+	s := NewServer(cfg)
+	addr, stop, done := startServer(t, s)
+
+	stream := openEvents(t, addr, "")
+	waitFor(t, func() bool { return s.events.subscribers() == 1 })
+
+	start := time.Now()
+	stop()
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the stream not to hold up shutdown, took %v", elapsed)
+	}
+	if _, err := io.ReadAll(stream.r); err != nil {
+		t.Errorf("Expected the stream to end cleanly, got %v", err)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a second
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -1,94 +1,108 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"strconv"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	// Register handlers
-	http.HandleFunc("/", homeHandler)
-	http.HandleFunc("/hello", helloHandler)
-	http.HandleFunc("/echo", echoHandler)
-	http.HandleFunc("/json", jsonHandler)
-	http.HandleFunc("/users/", userHandler) // Trailing slash for path matching
-
-	// Static file server
-	fs := http.FileServer(http.Dir("./static"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
-
-	port := ":8080"
-	fmt.Printf("Server starting on http://localhost%s\n", port)
-	fmt.Println("Try:")
-	fmt.Println("  GET  http://localhost:8080/")
-	fmt.Println("  GET  http://localhost:8080/hello?name=Alice")
-	fmt.Println("  POST http://localhost:8080/echo")
-	fmt.Println("  GET  http://localhost:8080/json")
-	fmt.Println("  GET  http://localhost:8080/users/123")
+	// go run . gencert writes a development CA and certificate for -tls-cert
+	if len(os.Args) > 1 && os.Args[1] == "gencert" {
+		if err := runGencert(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	if err := http.ListenAndServe(port, nil); err != nil {
+	cfg, err := LoadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
 		log.Fatal(err)
 	}
-}
 
-// homeHandler handles requests to the root path
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
-		return
+	// SIGINT (Ctrl+C) or SIGTERM starts a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := NewServer(cfg)
+	scheme := "http"
+	if cfg.TLS() {
+		scheme = "https"
+		// SIGHUP loads a renewed certificate without a restart
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := srv.ReloadCerts(); err != nil {
+					log.Printf("reloading certificate: %v", err)
+				} else {
+					log.Printf("reloaded certificate from %s", cfg.TLSCert)
+				}
+			}
+		}()
 	}
 
-	w.Header().Set("Content-Type", "text/html")
-	html := `
-		<html>
-		<head><title>Go HTTP Server</title></head>
-		<body>
-			<h1>Welcome to Go HTTP Server Tutorial</h1>
-			<ul>
-				<li><a href="/hello?name=World">Hello endpoint</a></li>
-				<li><a href="/json">JSON endpoint</a></li>
-				<li><a href="/users/123">User endpoint</a></li>
-			</ul>
-		</body>
-		</html>
-	`
-	fmt.Fprint(w, html)
-}
+	_, port, _ := net.SplitHostPort(cfg.Addr)
+	base := scheme + "://localhost:" + port
 
-// helloHandler demonstrates query parameters
-func helloHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse query parameters
-	name := r.URL.Query().Get("name")
-	if name == "" {
-		name = "Guest"
+	fmt.Printf("Server starting on %s\n", cfg.Addr)
+	if cfg.RedirectAddr != "" {
+		fmt.Printf("Redirecting HTTP on %s to HTTPS\n", cfg.RedirectAddr)
 	}
+	fmt.Println("Try:")
+	fmt.Println("  GET  " + base + "/")
+	fmt.Println("  GET  " + base + "/hello?name=Alice")
+	fmt.Println("  POST " + base + "/echo")
+	fmt.Println("  GET  " + base + "/json")
+	fmt.Println("  GET  " + base + "/users/1")
 
-	fmt.Fprintf(w, "Hello, %s!", name)
+	if err := srv.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Server stopped")
 }
 
-// echoHandler demonstrates reading request body
-func echoHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// homeHandler renders the home page, listing every route on mux
+func homeHandler(pages *Renderer, mux *routeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
 
-	// Read request body
-	body := make([]byte, r.ContentLength)
-	_, err := r.Body.Read(body)
-	if err != nil && err.Error() != "EOF" {
-		http.Error(w, "Error reading body", http.StatusBadRequest)
-		return
+		pages.Render(w, http.StatusOK, "home", struct{ Routes []route }{mux.Routes()})
 	}
-	defer r.Body.Close()
+}
 
-	// Echo back
-	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, "You sent: %s", string(body))
+// helloHandler demonstrates query parameters. Browsers, which ask for
+// text/html, get a page; html/template escapes the name, so
+// ?name=<script> is shown rather than run. Everyone else gets plain
+// text.
+func helloHandler(pages *Renderer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Parse query parameters
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = "Guest"
+		}
+
+		if format, _ := negotiate(r.Header.Get("Accept"), []string{"text/plain", "text/html"}); format == "text/html" {
+			pages.Render(w, http.StatusOK, "hello", struct{ Name string }{name})
+			return
+		}
+
+		// Without a Content-Type, the response would be sniffed, and a
+		// name that looks like HTML would be served as HTML
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fmt.Fprintf(w, "Hello, %s!", name)
+	}
 }
 
 // User represents a user in our system
@@ -99,42 +113,12 @@ type User struct {
 }
 
 // jsonHandler demonstrates JSON responses
-func jsonHandler(w http.ResponseWriter, r *http.Request) {
-	users := []User{
-		{ID: 1, Username: "alice", Email: "alice@example.com"},
-		{ID: 2, Username: "bob", Email: "bob@example.com"},
-		{ID: 3, Username: "carol", Email: "carol@example.com"},
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(users); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-}
-
-// userHandler demonstrates path parameters
-func userHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract ID from path: /users/{id}
-	path := strings.TrimPrefix(r.URL.Path, "/users/")
-	if path == "" {
-		http.Error(w, "User ID required", http.StatusBadRequest)
-		return
+func jsonHandler(users *UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(users.List()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
-
-	userID, err := strconv.Atoi(path)
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
-
-	// Mock user lookup
-	user := User{
-		ID:       userID,
-		Username: fmt.Sprintf("user_%d", userID),
-		Email:    fmt.Sprintf("user_%d@example.com", userID),
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyPrefix is where the proxy's routes are mounted
+const proxyPrefix = "/proxy"
+
+// proxyFile is the proxy configuration file, for example:
+//
+//	{
+//	  "health_interval": "10s",
+//	  "routes": [
+//	    {"prefix": "/books", "rewrite": "/v2/books", "upstreams": ["http://localhost:8081"], "health_path": "/v2/books"},
+//	    {"prefix": "/chat", "rewrite": "/", "upstreams": ["http://localhost:8082", "http://localhost:8083"]}
+//	  ]
+//	}
+//
+// A request for /proxy/books/1 goes to http://localhost:8081/v2/books/1.
+type proxyFile struct {
+	HealthInterval string           `json:"health_interval"` // default 10s
+	HealthTimeout  string           `json:"health_timeout"`  // default 2s
+	Routes         []proxyFileRoute `json:"routes"`
+}
+
+type proxyFileRoute struct {
+	Prefix     string   `json:"prefix"`
+	Rewrite    *string  `json:"rewrite"` // replaces Prefix; unset keeps it
+	Upstreams  []string `json:"upstreams"`
+	HealthPath string   `json:"health_path"` // default "/"
+}
+
+// Proxy forwards requests under /proxy/ to upstream servers, picked by
+// the longest matching path prefix in its configuration file. Each
+// route spreads its requests round-robin across its upstreams, skipping
+// any that failed their last health check.
+type Proxy struct {
+	file string
+
+	mu             sync.RWMutex
+	routes         []*proxyRoute // longest prefix first
+	healthInterval time.Duration
+	client         *http.Client // for health checks
+}
+
+// proxyRoute is one prefix and its upstreams
+type proxyRoute struct {
+	prefix     string // without a trailing slash
+	rewrite    string
+	healthPath string
+	upstreams  []*upstream
+	next       atomic.Uint64
+}
+
+// upstream is one server behind a route
+type upstream struct {
+	url     *url.URL
+	proxy   *httputil.ReverseProxy
+	healthy atomic.Bool
+}
+
+// NewProxy returns a proxy configured from file. Nothing is read until
+// Load is called.
+func NewProxy(file string) *Proxy {
+	return &Proxy{file: file}
+}
+
+// Load reads the configuration file and replaces the routing table. All
+// upstreams start out healthy. If the file is invalid, the current table
+// is kept and the error is returned.
+func (p *Proxy) Load() error {
+	f, err := os.Open(p.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var cfg proxyFile
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return fmt.Errorf("%s: %w", p.file, err)
+	}
+
+	interval, err := parseProxyDuration(cfg.HealthInterval, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("%s: health_interval: %w", p.file, err)
+	}
+	timeout, err := parseProxyDuration(cfg.HealthTimeout, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("%s: health_timeout: %w", p.file, err)
+	}
+
+	routes := make([]*proxyRoute, 0, len(cfg.Routes))
+	for _, fr := range cfg.Routes {
+		rt, err := newProxyRoute(fr)
+		if err != nil {
+			return fmt.Errorf("%s: route %q: %w", p.file, fr.Prefix, err)
+		}
+		for _, other := range routes {
+			if other.prefix == rt.prefix {
+				return fmt.Errorf("%s: route %q: prefix listed twice", p.file, fr.Prefix)
+			}
+		}
+		routes = append(routes, rt)
+	}
+	slices.SortFunc(routes, func(a, b *proxyRoute) int { return len(b.prefix) - len(a.prefix) })
+
+	p.mu.Lock()
+	p.routes = routes
+	p.healthInterval = interval
+	p.client = &http.Client{
+		Timeout: timeout,
+		// A redirect is an answer; the upstream is up
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+func parseProxyDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = errors.New("must be positive")
+	}
+	return d, err
+}
+
+func newProxyRoute(fr proxyFileRoute) (*proxyRoute, error) {
+	if !strings.HasPrefix(fr.Prefix, "/") {
+		return nil, errors.New("prefix must start with /")
+	}
+	if len(fr.Upstreams) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+
+	rt := &proxyRoute{
+		prefix:     strings.TrimSuffix(fr.Prefix, "/"),
+		healthPath: fr.HealthPath,
+	}
+	rt.rewrite = rt.prefix
+	if fr.Rewrite != nil {
+		rt.rewrite = strings.TrimSuffix(*fr.Rewrite, "/")
+	}
+	if rt.healthPath == "" {
+		rt.healthPath = "/"
+	}
+
+	for _, raw := range fr.Upstreams {
+		target, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+			return nil, fmt.Errorf("upstream %q: expected an http or https URL", raw)
+		}
+		u := &upstream{url: target}
+		u.proxy = &httputil.ReverseProxy{Rewrite: rt.rewriter(target)}
+		u.healthy.Store(true)
+		rt.upstreams = append(rt.upstreams, u)
+	}
+	return rt, nil
+}
+
+// match reports whether path, with /proxy already removed, is under the
+// route's prefix
+func (rt *proxyRoute) match(path string) bool {
+	return path == rt.prefix || strings.HasPrefix(path, rt.prefix+"/") || rt.prefix == ""
+}
+
+// rewriter returns the ReverseProxy Rewrite func for one upstream. It
+// swaps /proxy and the prefix for the rewrite, joins the result to the
+// upstream's own path and sets the X-Forwarded-* headers. Any
+// X-Forwarded-* headers from the client were removed before this runs,
+// so they cannot be spoofed.
+func (rt *proxyRoute) rewriter(target *url.URL) func(*httputil.ProxyRequest) {
+	return func(pr *httputil.ProxyRequest) {
+		rest := strings.TrimPrefix(strings.TrimPrefix(pr.In.URL.Path, proxyPrefix), rt.prefix)
+		path := rt.rewrite + rest
+		if path == "" {
+			path = "/"
+		}
+		pr.Out.URL.Path = path
+		pr.Out.URL.RawPath = ""
+
+		pr.SetURL(target)
+		pr.SetXForwarded()
+		pr.Out.Header.Set("X-Forwarded-Prefix", proxyPrefix+rt.prefix)
+	}
+}
+
+// pick returns the next healthy upstream in turn, or nil if there is none
+func (rt *proxyRoute) pick() *upstream {
+	n := uint64(len(rt.upstreams))
+	start := rt.next.Add(1) - 1
+	for i := range n {
+		u := rt.upstreams[(start+i)%n]
+		if u.healthy.Load() {
+			return u
+		}
+	}
+	return nil
+}
+
+// route returns the route for path, or nil
+func (p *Proxy) route(path string) *proxyRoute {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, rt := range p.routes {
+		if rt.match(path) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// ServeHTTP forwards a request under /proxy/. WebSocket and other
+// Upgrade requests are passed through by ReverseProxy, which hijacks the
+// connection and copies bytes both ways once the upstream agrees.
+// Hijacking clears the server's read and write deadlines, so the
+// upgraded connection lasts as long as the two ends want.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt := p.route(strings.TrimPrefix(r.URL.Path, proxyPrefix))
+	if rt == nil {
+		http.NotFound(w, r)
+		return
+	}
+	u := rt.pick()
+	if u == nil {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "No healthy upstream", http.StatusServiceUnavailable)
+		return
+	}
+	u.proxy.ServeHTTP(w, r)
+}
+
+// watchHealth checks every upstream straight away and then once per
+// health interval, until ctx is done
+func (p *Proxy) watchHealth(ctx context.Context) {
+	p.mu.RLock()
+	interval := p.healthInterval
+	p.mu.RUnlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.checkHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth checks every upstream once, in parallel. An upstream is
+// healthy if a GET of its route's health path answers with a status
+// below 500 in time.
+func (p *Proxy) checkHealth(ctx context.Context) {
+	p.mu.RLock()
+	routes, client := p.routes, p.client
+	p.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, rt := range routes {
+		for _, u := range rt.upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := probe(ctx, client, u.url.JoinPath(rt.healthPath).String())
+				if ctx.Err() != nil {
+					return // shutting down; the result means nothing
+				}
+				healthy := err == nil
+				if u.healthy.Swap(healthy) != healthy {
+					if healthy {
+						log.Printf("proxy: upstream %s is healthy again", u.url)
+					} else {
+						log.Printf("proxy: upstream %s is unhealthy: %v", u.url, err)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// probe makes one health check request
+func probe(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeProxyConfig writes a proxy configuration file and returns its path
+func writeProxyConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadProxy(t *testing.T, config string) *Proxy {
+	t.Helper()
+	p := NewProxy(writeProxyConfig(t, config))
+	if err := p.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return p
+}
+
+// seenRequest is what an upstream was sent
+type seenRequest struct {
+	Path, Query, Host               string
+	ForwardedFor, ForwardedHost     string
+	ForwardedProto, ForwardedPrefix string
+}
+
+func TestProxyRewrite(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(seenRequest{
+			Path:            r.URL.Path,
+			Query:           r.URL.RawQuery,
+			Host:            r.Host,
+			ForwardedFor:    r.Header.Get("X-Forwarded-For"),
+			ForwardedHost:   r.Header.Get("X-Forwarded-Host"),
+			ForwardedProto:  r.Header.Get("X-Forwarded-Proto"),
+			ForwardedPrefix: r.Header.Get("X-Forwarded-Prefix"),
+		})
+	}))
+	defer upstream.Close()
+
+	p := loadProxy(t, `{"routes": [
+		{"prefix": "/books/", "rewrite": "/v2/books", "upstreams": ["`+upstream.URL+`"]},
+		{"prefix": "/books/authors", "rewrite": "/v2/authors", "upstreams": ["`+upstream.URL+`"]},
+		{"prefix": "/chat", "rewrite": "/", "upstreams": ["`+upstream.URL+`"]},
+		{"prefix": "/keep", "upstreams": ["`+upstream.URL+`/base"]}
+	]}`)
+
+	tests := []struct {
+		path       string
+		wantPath   string
+		wantPrefix string
+	}{
+		{"/proxy/books/1?fields=title", "/v2/books/1", "/proxy/books"},
+		{"/proxy/books", "/v2/books", "/proxy/books"},
+		{"/proxy/books/authors/7", "/v2/authors/7", "/proxy/books/authors"},
+		{"/proxy/chat/ws", "/ws", "/proxy/chat"},
+		{"/proxy/chat", "/", "/proxy/chat"},
+		{"/proxy/keep/a", "/base/keep/a", "/proxy/keep"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.66") // not to be trusted
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", tt.path, w.Code)
+		}
+		var seen seenRequest
+		json.NewDecoder(w.Body).Decode(&seen)
+		if seen.Path != tt.wantPath {
+			t.Errorf("%s: expected upstream path %q, got %q", tt.path, tt.wantPath, seen.Path)
+		}
+		if seen.ForwardedPrefix != tt.wantPrefix {
+			t.Errorf("%s: expected X-Forwarded-Prefix %q, got %q", tt.path, tt.wantPrefix, seen.ForwardedPrefix)
+		}
+		if seen.ForwardedFor != "192.0.2.1" || seen.ForwardedHost != "example.com" || seen.ForwardedProto != "http" {
+			t.Errorf("%s: unexpected X-Forwarded-* headers %+v", tt.path, seen)
+		}
+		if seen.Host != strings.TrimPrefix(upstream.URL, "http://") {
+			t.Errorf("%s: expected the upstream's Host, got %q", tt.path, seen.Host)
+		}
+	}
+
+	for _, path := range []string{"/proxy/", "/proxy/bookshelf", "/proxy/chatty"} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", path, w.Code)
+		}
+	}
+}
+
+// namedUpstream answers every request with its name, and its health
+// check with the status in health
+func namedUpstream(t *testing.T, name string, health *atomic.Int32) *httptest.Server {
+	t.Helper()
+	health.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(int(health.Load()))
+			return
+		}
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// proxied sends n requests through handler and returns the bodies,
+// or the status code of any that did not succeed
+func proxied(handler http.Handler, path string, n int) []string {
+	var got []string
+	for range n {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			got = append(got, http.StatusText(w.Code))
+			continue
+		}
+		got = append(got, w.Body.String())
+	}
+	return got
+}
+
+func TestProxyRoundRobinAndHealth(t *testing.T) {
+	var healthA, healthB, healthC atomic.Int32
+	a := namedUpstream(t, "a", &healthA)
+	b := namedUpstream(t, "b", &healthB)
+	c := namedUpstream(t, "c", &healthC)
+	p := loadProxy(t, `{"routes": [
+		{"prefix": "/api", "upstreams": ["`+a.URL+`", "`+b.URL+`", "`+c.URL+`"], "health_path": "/health"}
+	]}`)
+	ctx := context.Background()
+
+	if got := strings.Join(proxied(p, "/proxy/api/x", 6), ","); got != "a,b,c,a,b,c" {
+		t.Errorf("Expected round-robin, got %s", got)
+	}
+
+	// A failing health check takes b out of the rotation
+	healthB.Store(http.StatusServiceUnavailable)
+	p.checkHealth(ctx)
+	if got := strings.Join(proxied(p, "/proxy/api/x", 4), ","); strings.Contains(got, "b") {
+		t.Errorf("Expected b to be skipped, got %s", got)
+	}
+
+	// An upstream that is not there at all fails too
+	c.Close()
+	healthA.Store(http.StatusInternalServerError)
+	p.checkHealth(ctx)
+	if got := proxied(p, "/proxy/api/x", 1)[0]; got != "Service Unavailable" {
+		t.Errorf("Expected 503 with no healthy upstream, got %s", got)
+	}
+
+	// A passing check brings an upstream back
+	healthB.Store(http.StatusOK)
+	p.checkHealth(ctx)
+	if got := strings.Join(proxied(p, "/proxy/api/x", 2), ","); got != "b,b" {
+		t.Errorf("Expected only b, got %s", got)
+	}
+}
+
+func TestProxyHealthChecksWhileServing(t *testing.T) {
+	var health atomic.Int32
+	up := namedUpstream(t, "up", &health)
+	cfg := DefaultConfig()
+	cfg.ProxyConfig = writeProxyConfig(t, `{"health_interval": "10ms", "routes": [
+		{"prefix": "/up", "upstreams": ["`+up.URL+`"], "health_path": "/health"}
+	]}`)
+	s := NewServer(cfg)
+	addr, stop, done := startServer(t, s)
+	defer func() {
+		stop()
+		<-done
+	}()
+
+	status := func() int {
+		resp, err := http.Get(addr + "/proxy/up/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := status(); got != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", got)
+	}
+	health.Store(http.StatusInternalServerError)
+	waitFor(t, func() bool { return status() == http.StatusServiceUnavailable })
+	health.Store(http.StatusOK)
+	waitFor(t, func() bool { return status() == http.StatusOK })
+}
+
+func TestProxyWebSocket(t *testing.T) {
+	// The upstream accepts the upgrade and then echoes what it reads
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws" || r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "Expected a WebSocket upgrade on /ws", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.ReadTimeout = 50 * time.Millisecond // must not cut the upgraded connection
+	cfg.ProxyConfig = writeProxyConfig(t, `{"routes": [
+		{"prefix": "/chat", "rewrite": "/", "upstreams": ["`+upstream.URL+`"]}
+	]}`)
+	addr, stop, done := startServer(t, NewServer(cfg))
+	defer func() {
+		stop()
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /proxy/chat/ws HTTP/1.1\r\nHost: example.com\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Reading the upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, got %d", resp.StatusCode)
+	}
+
+	time.Sleep(2 * cfg.ReadTimeout)
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected the echo through the proxy, got %q, %v", buf, err)
+	}
+}
+
+func TestProxyLoadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"not JSON", `routes:`},
+		{"unknown field", `{"routes": [{"prefix": "/a", "upstream": "http://localhost:1"}]}`},
+		{"relative prefix", `{"routes": [{"prefix": "a", "upstreams": ["http://localhost:1"]}]}`},
+		{"no upstreams", `{"routes": [{"prefix": "/a", "upstreams": []}]}`},
+		{"upstream without scheme", `{"routes": [{"prefix": "/a", "upstreams": ["localhost:8081"]}]}`},
+		{"duplicate prefix", `{"routes": [{"prefix": "/a", "upstreams": ["http://localhost:1"]}, {"prefix": "/a/", "upstreams": ["http://localhost:2"]}]}`},
+		{"bad interval", `{"health_interval": "often", "routes": []}`},
+		{"zero timeout", `{"health_timeout": "0s", "routes": []}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := NewProxy(writeProxyConfig(t, tt.config)).Load(); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+
+	// Serve refuses to start on a bad or missing file
+	cfg := DefaultConfig()
+	cfg.ProxyConfig = filepath.Join(t.TempDir(), "missing.json")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewServer(cfg).Serve(context.Background(), ln); err == nil {
+		t.Error("Expected Serve to fail without the proxy file")
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the settings of the HTTP server. Every field can be set
+// with a flag or, failing that, an environment variable.
+type Config struct {
+	Addr            string        // -addr, ADDR
+	TLSCert         string        // -tls-cert, TLS_CERT: serve HTTPS with this certificate
+	TLSKey          string        // -tls-key, TLS_KEY
+	RedirectAddr    string        // -redirect-addr, REDIRECT_ADDR: redirect plain HTTP here to HTTPS
+	ReadTimeout     time.Duration // -read-timeout, READ_TIMEOUT
+	WriteTimeout    time.Duration // -write-timeout, WRITE_TIMEOUT
+	IdleTimeout     time.Duration // -idle-timeout, IDLE_TIMEOUT
+	MaxHeaderBytes  int           // -max-header-bytes, MAX_HEADER_BYTES
+	MaxBodyBytes    int           // -max-body-bytes, MAX_BODY_BYTES
+	StaticDir       string        // -static-dir, STATIC_DIR
+	StaticEmbed     bool          // -static-embed, STATIC_EMBED: serve the copy built into the binary
+	SPAFallback     bool          // -spa-fallback, SPA_FALLBACK
+	EventsReplay    int           // -events-replay, EVENTS_REPLAY
+	EventsKeepAlive time.Duration // -events-keepalive, EVENTS_KEEPALIVE
+	UploadDir       string        // -upload-dir, UPLOAD_DIR
+	UploadMaxBytes  int           // -upload-max-bytes, UPLOAD_MAX_BYTES: per file
+	UploadMaxFiles  int           // -upload-max-files, UPLOAD_MAX_FILES: per request
+	ProxyConfig     string        // -proxy-config, PROXY_CONFIG: routing table for /proxy/
+	Dev             bool          // -dev, DEV: reload templates from ./templates on every request
+	ShutdownTimeout time.Duration // -shutdown-timeout, SHUTDOWN_TIMEOUT
+}
+
+// DefaultConfig returns the settings used when nothing else is given
+func DefaultConfig() Config {
+	return Config{
+		Addr:            ":8080",
+		ReadTimeout:     10 * time.Second,
+		WriteTimeout:    30 * time.Second,
+		IdleTimeout:     120 * time.Second,
+		MaxHeaderBytes:  1 << 20, // 1 MB, the same as http.DefaultMaxHeaderBytes
+		MaxBodyBytes:    1 << 20,
+		StaticDir:       "./static",
+		SPAFallback:     true,
+		EventsReplay:    100,
+		EventsKeepAlive: 15 * time.Second,
+		UploadDir:       "./uploads",
+		UploadMaxBytes:  10 << 20,
+		UploadMaxFiles:  5,
+		ShutdownTimeout: 15 * time.Second,
+	}
+}
+
+// LoadConfig parses args as command-line flags. A flag that is not given
+// falls back to its environment variable, read with getenv, and then to
+// DefaultConfig.
+func LoadConfig(args []string, getenv func(string) string) (Config, error) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("http-server", flag.ContinueOnError)
+
+	// Environment variables become the flag defaults, so an explicit flag
+	// still wins and -h shows the values in effect
+	var err error
+	str := func(p *string, name, env, usage string) {
+		if v := getenv(env); v != "" {
+			*p = v
+		}
+		fs.StringVar(p, name, *p, usage+" (env "+env+")")
+	}
+	dur := func(p *time.Duration, name, env, usage string) {
+		if v := getenv(env); v != "" {
+			d, perr := time.ParseDuration(v)
+			if perr != nil && err == nil {
+				err = fmt.Errorf("%s: %w", env, perr)
+			}
+			*p = d
+		}
+		fs.DurationVar(p, name, *p, usage+" (env "+env+")")
+	}
+	num := func(p *int, name, env, usage string) {
+		if v := getenv(env); v != "" {
+			n, perr := strconv.Atoi(v)
+			if perr != nil && err == nil {
+				err = fmt.Errorf("%s: %w", env, perr)
+			}
+			*p = n
+		}
+		fs.IntVar(p, name, *p, usage+" (env "+env+")")
+	}
+	boolean := func(p *bool, name, env, usage string) {
+		if v := getenv(env); v != "" {
+			b, perr := strconv.ParseBool(v)
+			if perr != nil && err == nil {
+				err = fmt.Errorf("%s: %w", env, perr)
+			}
+			*p = b
+		}
+		fs.BoolVar(p, name, *p, usage+" (env "+env+")")
+	}
+
+	str(&cfg.Addr, "addr", "ADDR", "address to listen on")
+	str(&cfg.TLSCert, "tls-cert", "TLS_CERT", "PEM certificate file; serves HTTPS when set, together with -tls-key")
+	str(&cfg.TLSKey, "tls-key", "TLS_KEY", "PEM private key file for -tls-cert")
+	str(&cfg.RedirectAddr, "redirect-addr", "REDIRECT_ADDR", "address on which plain HTTP is redirected to HTTPS")
+	dur(&cfg.ReadTimeout, "read-timeout", "READ_TIMEOUT", "maximum time to read a request, body included")
+	dur(&cfg.WriteTimeout, "write-timeout", "WRITE_TIMEOUT", "maximum time to write a response")
+	dur(&cfg.IdleTimeout, "idle-timeout", "IDLE_TIMEOUT", "how long a keep-alive connection may sit idle")
+	num(&cfg.MaxHeaderBytes, "max-header-bytes", "MAX_HEADER_BYTES", "maximum size of the request headers")
+	num(&cfg.MaxBodyBytes, "max-body-bytes", "MAX_BODY_BYTES", "maximum size of a request body")
+	str(&cfg.StaticDir, "static-dir", "STATIC_DIR", "directory served under /static/")
+	boolean(&cfg.StaticEmbed, "static-embed", "STATIC_EMBED", "serve the static files built into the binary instead of -static-dir")
+	boolean(&cfg.SPAFallback, "spa-fallback", "SPA_FALLBACK", "answer unknown extensionless paths under /static/ with index.html")
+	num(&cfg.EventsReplay, "events-replay", "EVENTS_REPLAY", "how many recent events /events keeps for clients that reconnect")
+	dur(&cfg.EventsKeepAlive, "events-keepalive", "EVENTS_KEEPALIVE", "interval between keep-alive comments on /events")
+	str(&cfg.UploadDir, "upload-dir", "UPLOAD_DIR", "directory uploaded files are stored in")
+	num(&cfg.UploadMaxBytes, "upload-max-bytes", "UPLOAD_MAX_BYTES", "maximum size of an uploaded file")
+	num(&cfg.UploadMaxFiles, "upload-max-files", "UPLOAD_MAX_FILES", "maximum number of files in one upload")
+	str(&cfg.ProxyConfig, "proxy-config", "PROXY_CONFIG", "JSON file of /proxy/ routes to upstream servers; the proxy is off when empty")
+	boolean(&cfg.Dev, "dev", "DEV", "development mode: reload templates from ./templates on every request")
+	dur(&cfg.ShutdownTimeout, "shutdown-timeout", "SHUTDOWN_TIMEOUT", "how long to wait for in-flight requests on shutdown (0 = no limit)")
+	if err != nil {
+		return Config{}, err
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return Config{}, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if cfg.RedirectAddr != "" && !cfg.TLS() {
+		return Config{}, errors.New("-redirect-addr needs -tls-cert and -tls-key")
+	}
+
+	// Zero switches a timeout, the header limit or the replay buffer off.
+	// The other limits and the keep-alive interval have no "off".
+	for _, v := range []struct {
+		flag   string
+		value  int64
+		zeroOK bool
+	}{
+		{"read-timeout", int64(cfg.ReadTimeout), true},
+		{"write-timeout", int64(cfg.WriteTimeout), true},
+		{"idle-timeout", int64(cfg.IdleTimeout), true},
+		{"shutdown-timeout", int64(cfg.ShutdownTimeout), true},
+		{"max-header-bytes", int64(cfg.MaxHeaderBytes), true},
+		{"events-replay", int64(cfg.EventsReplay), true},
+		{"max-body-bytes", int64(cfg.MaxBodyBytes), false},
+		{"events-keepalive", int64(cfg.EventsKeepAlive), false},
+		{"upload-max-bytes", int64(cfg.UploadMaxBytes), false},
+		{"upload-max-files", int64(cfg.UploadMaxFiles), false},
+	} {
+		switch {
+		case v.value < 0:
+			return Config{}, fmt.Errorf("-%s must not be negative", v.flag)
+		case v.value == 0 && !v.zeroOK:
+			return Config{}, fmt.Errorf("-%s must be positive", v.flag)
+		}
+	}
+	return cfg, nil
+}
+
+// TLS reports whether the server is configured to serve HTTPS
+func (c Config) TLS() bool {
+	return c.TLSCert != ""
+}
+
+// Server serves the tutorial's handlers from its own ServeMux, so any
+// number of servers can be built side by side without touching
+// http.DefaultServeMux
+type Server struct {
+	cfg    Config
+	mux    *routeMux
+	http   *http.Server
+	pages  *Renderer
+	users  *UserStore
+	events *Broker
+	blobs  BlobStore
+	certs  *certReloader // nil unless serving HTTPS
+	proxy  *Proxy        // nil unless ProxyConfig is set
+}
+
+// NewServer builds a server with every route registered. It does not
+// start listening; call Run or Serve for that.
+func NewServer(cfg Config) *Server {
+	s := &Server{
+		cfg:    cfg,
+		mux:    newRouteMux(),
+		pages:  NewRenderer(embeddedTemplatesFS(), false),
+		users:  NewUserStore(demoUsers()...),
+		events: NewBroker(cfg.EventsReplay),
+		blobs:  NewDiskStore(cfg.UploadDir),
+	}
+	if cfg.Dev {
+		s.pages = NewRenderer(os.DirFS("templates"), true)
+	}
+	if cfg.ProxyConfig != "" {
+		s.proxy = NewProxy(cfg.ProxyConfig)
+	}
+	s.routes()
+	s.http = &http.Server{
+		Addr:           cfg.Addr,
+		Handler:        s.mux,
+		ReadTimeout:    cfg.ReadTimeout,
+		WriteTimeout:   cfg.WriteTimeout,
+		IdleTimeout:    cfg.IdleTimeout,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+	if cfg.TLS() {
+		s.certs = newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		s.http.TLSConfig = s.certs.tlsConfig()
+	}
+	// Event streams never finish on their own, so end them when shutdown
+	// starts instead of waiting out the deadline
+	s.http.RegisterOnShutdown(s.events.Close)
+	return s
+}
+
+// routes registers the handlers on the server's mux
+func (s *Server) routes() {
+	s.mux.HandleFunc("GET /{$}", homeHandler(s.pages, s.mux))
+	s.mux.HandleFunc("/hello", helloHandler(s.pages))
+	s.mux.HandleFunc("/echo", echoHandler(int64(s.cfg.MaxBodyBytes), s.events))
+	s.mux.HandleFunc("/json", jsonHandler(s.users))
+
+	users := &userHandlers{store: s.users, events: s.events, maxBytes: int64(s.cfg.MaxBodyBytes)}
+	users.register(s.mux)
+
+	s.mux.HandleFunc("GET /events", eventsHandler(s.events, s.cfg.EventsKeepAlive))
+
+	// Static files, from disk or from the binary
+	static := os.DirFS(s.cfg.StaticDir)
+	if s.cfg.StaticEmbed {
+		static = embeddedStaticFS()
+	}
+	s.mux.Handle("/static/", http.StripPrefix("/static", newStaticHandler(static, s.cfg.SPAFallback)))
+
+	// Uploads are stored in the blob store and served back next to the
+	// static files; the more specific pattern wins
+	uploads := &uploadHandler{
+		store:    s.blobs,
+		events:   s.events,
+		maxBytes: int64(s.cfg.UploadMaxBytes),
+		maxFiles: s.cfg.UploadMaxFiles,
+	}
+	s.mux.HandleFunc("POST /upload", uploads.upload)
+	s.mux.HandleFunc("GET "+uploadsPrefix+"{key}", uploads.serve)
+
+	if s.proxy != nil {
+		s.mux.Handle(proxyPrefix+"/", s.proxy)
+	}
+}
+
+// routeMux is a ServeMux that remembers the patterns registered on it,
+// so the home page can list the routes that really exist
+type routeMux struct {
+	*http.ServeMux
+
+	mu       sync.Mutex
+	patterns []string
+}
+
+func newRouteMux() *routeMux {
+	return &routeMux{ServeMux: http.NewServeMux()}
+}
+
+func (m *routeMux) Handle(pattern string, handler http.Handler) {
+	m.ServeMux.Handle(pattern, handler)
+	m.mu.Lock()
+	m.patterns = append(m.patterns, pattern)
+	m.mu.Unlock()
+}
+
+func (m *routeMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.Handle(pattern, http.HandlerFunc(handler))
+}
+
+// route is one registered pattern
+type route struct {
+	Method string // empty when any method matches
+	Path   string
+}
+
+// Linkable reports whether a browser can follow the route as a link: it
+// takes GET and has no wildcards to fill in
+func (r route) Linkable() bool {
+	return (r.Method == "" || r.Method == http.MethodGet) && !strings.Contains(r.Path, "{")
+}
+
+// Routes lists the registered routes, ordered by path and then method
+func (m *routeMux) Routes() []route {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	routes := make([]route, 0, len(m.patterns))
+	for _, p := range m.patterns {
+		var r route
+		if method, path, ok := strings.Cut(p, " "); ok {
+			r = route{Method: method, Path: strings.TrimSpace(path)}
+		} else {
+			r = route{Path: p}
+		}
+		// {$} anchors a pattern to the end of the path; it is not part of
+		// any URL
+		r.Path = strings.TrimSuffix(r.Path, "{$}")
+		routes = append(routes, r)
+	}
+	slices.SortFunc(routes, func(a, b route) int {
+		if c := strings.Compare(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Method, b.Method)
+	})
+	return routes
+}
+
+// Handler returns the server's routes, for use with httptest
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// ReloadCerts loads the TLS certificate and key from disk again. New
+// connections use the new certificate; if it cannot be loaded, the old
+// one stays in use.
+func (s *Server) ReloadCerts() error {
+	if s.certs == nil {
+		return errors.New("TLS is not enabled")
+	}
+	return s.certs.Reload()
+}
+
+// Run listens on the configured address and serves until ctx is done.
+// With TLS and a RedirectAddr, it also redirects plain HTTP on that
+// address to HTTPS; if either listener fails, both are shut down.
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	if s.cfg.RedirectAddr == "" || s.certs == nil {
+		return s.Serve(ctx, ln)
+	}
+
+	rln, err := net.Listen("tcp", s.cfg.RedirectAddr)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	redirect := &http.Server{
+		Handler:           redirectToHTTPS(s.cfg.Addr),
+		ReadHeaderTimeout: s.cfg.ReadTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+		MaxHeaderBytes:    s.cfg.MaxHeaderBytes,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		err := serveGracefully(ctx, redirect, rln, s.cfg.ShutdownTimeout)
+		cancel()
+		errc <- err
+	}()
+
+	err = s.Serve(ctx, ln)
+	cancel()
+	return errors.Join(err, <-errc)
+}
+
+// Serve accepts connections on ln until ctx is done, then shuts down
+// gracefully: it stops accepting, closes idle connections and waits up
+// to ShutdownTimeout for in-flight requests to finish. Connections still
+// busy at the deadline are closed and the deadline error is returned.
+// With TLS configured, ln carries HTTPS, and HTTP/2 is offered to
+// clients that support it. With a proxy configured, its routes are
+// loaded first and its upstreams are health-checked while serving.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	if s.certs != nil {
+		if err := s.certs.Reload(); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	if s.proxy != nil {
+		if err := s.proxy.Load(); err != nil {
+			ln.Close()
+			return err
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go s.proxy.watchHealth(ctx)
+	}
+	return serveGracefully(ctx, s.http, ln, s.cfg.ShutdownTimeout)
+}
+
+// serveGracefully runs srv on ln until ctx is done and then shuts it
+// down, waiting up to timeout for in-flight requests. A timeout of 0
+// waits for as long as they take.
+func serveGracefully(ctx context.Context, srv *http.Server, ln net.Listener, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate
+			errc <- srv.ServeTLS(ln, "", "")
+		} else {
+			errc <- srv.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		// The listener failed before we were asked to stop
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		shutdownCtx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		srv.Close()
+	}
+	if serr := <-errc; !errors.Is(serr, http.ErrServerClosed) {
+		return serr
+	}
+	return err
+}
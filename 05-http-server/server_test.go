@@ -1,39 +1,51 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestHomeHandler(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	w := httptest.NewRecorder()
 
-	homeHandler(w, req)
+	NewServer(DefaultConfig()).Handler().ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", w.Code)
 	}
 
 	contentType := w.Header().Get("Content-Type")
-	if contentType != "text/html" {
-		t.Errorf("Expected Content-Type text/html, got %s", contentType)
+	if contentType != "text/html; charset=utf-8" {
+		t.Errorf("Expected Content-Type text/html; charset=utf-8, got %s", contentType)
 	}
 
 	body := w.Body.String()
 	if !strings.Contains(body, "Welcome") {
 		t.Error("Expected body to contain 'Welcome'")
 	}
+
+	// The route list comes from the mux
+	for _, want := range []string{`<a href="/json">/json</a>`, `<code>/users/{id}</code>`, "DELETE"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected the route list to contain %q", want)
+		}
+	}
 }
 
 func TestHomeHandler404(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/notfound", nil)
 	w := httptest.NewRecorder()
 
-	homeHandler(w, req)
+	homeHandler(NewRenderer(embeddedTemplatesFS(), false), newRouteMux())(w, req)
 
 	if w.Code != http.StatusNotFound {
 		t.Errorf("Expected status 404, got %d", w.Code)
@@ -56,7 +68,7 @@ func TestHelloHandler(t *testing.T) {
 			req := httptest.NewRequest(http.MethodGet, "/hello"+tt.query, nil)
 			w := httptest.NewRecorder()
 
-			helloHandler(w, req)
+			helloHandler(NewRenderer(embeddedTemplatesFS(), false))(w, req)
 
 			if w.Code != http.StatusOK {
 				t.Errorf("Expected status 200, got %d", w.Code)
@@ -75,7 +87,7 @@ func TestEchoHandler(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(body))
 	w := httptest.NewRecorder()
 
-	echoHandler(w, req)
+	echoHandler(1024, nil)(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", w.Code)
@@ -91,7 +103,7 @@ func TestEchoHandlerMethodNotAllowed(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/echo", nil)
 	w := httptest.NewRecorder()
 
-	echoHandler(w, req)
+	echoHandler(1024, nil)(w, req)
 
 	if w.Code != http.StatusMethodNotAllowed {
 		t.Errorf("Expected status 405, got %d", w.Code)
@@ -102,7 +114,7 @@ func TestJSONHandler(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/json", nil)
 	w := httptest.NewRecorder()
 
-	jsonHandler(w, req)
+	jsonHandler(NewUserStore(demoUsers()...))(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", w.Code)
@@ -128,16 +140,19 @@ func TestJSONHandler(t *testing.T) {
 }
 
 func TestUserHandler(t *testing.T) {
+	handler := NewServer(DefaultConfig()).Handler()
+
 	tests := []struct {
 		name       string
 		path       string
 		wantStatus int
 		wantID     int
 	}{
-		{"valid user", "/users/123", http.StatusOK, 123},
-		{"another valid user", "/users/456", http.StatusOK, 456},
+		{"valid user", "/users/1", http.StatusOK, 1},
+		{"another valid user", "/users/3", http.StatusOK, 3},
+		{"unknown user", "/users/123", http.StatusNotFound, 0},
 		{"invalid ID", "/users/abc", http.StatusBadRequest, 0},
-		{"missing ID", "/users/", http.StatusBadRequest, 0},
+		{"missing ID", "/users/", http.StatusNotFound, 0},
 	}
 
 	for _, tt := range tests {
@@ -145,7 +160,7 @@ func TestUserHandler(t *testing.T) {
 			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
 			w := httptest.NewRecorder()
 
-			userHandler(w, req)
+			handler.ServeHTTP(w, req)
 
 			if w.Code != tt.wantStatus {
 				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
@@ -165,11 +180,189 @@ func TestUserHandler(t *testing.T) {
 	}
 }
 
+func TestServerRoutes(t *testing.T) {
+	handler := NewServer(DefaultConfig()).Handler()
+
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{http.MethodGet, "/", http.StatusOK},
+		{http.MethodGet, "/hello?name=Alice", http.StatusOK},
+		{http.MethodPost, "/echo", http.StatusOK},
+		{http.MethodGet, "/json", http.StatusOK},
+		{http.MethodGet, "/users/1", http.StatusOK},
+		{http.MethodGet, "/static/", http.StatusOK},
+		{http.MethodGet, "/nope", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.wantStatus, w.Code)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	env := map[string]string{
+		"ADDR":             ":9090",
+		"READ_TIMEOUT":     "5s",
+		"MAX_HEADER_BYTES": "4096",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	// Flags win over the environment, which wins over the defaults
+	cfg, err := LoadConfig([]string{"-addr", ":7070", "-idle-timeout", "1m"}, getenv)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	want := DefaultConfig()
+	want.Addr = ":7070"
+	want.ReadTimeout = 5 * time.Second
+	want.IdleTimeout = time.Minute
+	want.MaxHeaderBytes = 4096
+	if cfg != want {
+		t.Errorf("Expected %+v, got %+v", want, cfg)
+	}
+
+	env["WRITE_TIMEOUT"] = "soon"
+	if _, err := LoadConfig(nil, getenv); err == nil || !strings.Contains(err.Error(), "WRITE_TIMEOUT") {
+		t.Errorf("Expected an error naming WRITE_TIMEOUT, got %v", err)
+	}
+	delete(env, "WRITE_TIMEOUT")
+
+	for _, args := range [][]string{
+		{"-tls-cert", "cert.pem"},
+		{"-redirect-addr", ":8080"},
+		{"-events-keepalive", "0"},
+		{"-events-replay", "-1"},
+		{"-read-timeout", "-1s"},
+		{"-max-body-bytes", "0"},
+		{"-upload-max-files", "0"},
+	} {
+		if _, err := LoadConfig(args, getenv); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+
+	// Zero turns these off rather than being invalid
+	if _, err := LoadConfig([]string{"-read-timeout", "0", "-events-replay", "0"}, getenv); err != nil {
+		t.Errorf("Expected zero to be accepted, got %v", err)
+	}
+}
+
+// startServer runs s on a free local port until the returned context
+// cancel is called. The error from Serve arrives on the channel.
+func startServer(t *testing.T, s *Server) (addr string, stop context.CancelFunc, done <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(ctx, ln) }()
+	scheme := "http://"
+	if s.certs != nil {
+		scheme = "https://"
+	}
+	return scheme + ln.Addr().String(), cancel, errc
+}
+
+// TestServerDrainsInFlightRequests also covers a timeout of 0, which
+// waits without any deadline
+func TestServerDrainsInFlightRequests(t *testing.T) {
+	for _, timeout := range []time.Duration{5 * time.Second, 0} {
+		t.Run(timeout.String(), func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.ShutdownTimeout = timeout
+			s := NewServer(cfg)
+
+			started, release := make(chan struct{}), make(chan struct{})
+			s.mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				io.WriteString(w, "finished")
+			})
+			addr, stop, done := startServer(t, s)
+
+			type result struct {
+				body string
+				err  error
+			}
+			resc := make(chan result, 1)
+			go func() {
+				resp, err := http.Get(addr + "/slow")
+				if err != nil {
+					resc <- result{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				resc <- result{string(body), err}
+			}()
+
+			<-started
+			stop()
+
+			// Shutdown waits for the request rather than cutting it off
+			select {
+			case err := <-done:
+				t.Fatalf("Serve returned with a request in flight: %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			close(release)
+			if res := <-resc; res.err != nil || res.body != "finished" {
+				t.Errorf("Expected the in-flight request to finish, got %q, %v", res.body, res.err)
+			}
+			if err := <-done; err != nil {
+				t.Errorf("Expected a clean shutdown, got %v", err)
+			}
+
+			// New connections are refused once the server has stopped
+			if _, err := http.Get(addr + "/"); err == nil {
+				t.Error("Expected the server to refuse new requests after shutdown")
+			}
+		})
+	}
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ShutdownTimeout = 50 * time.Millisecond
+	s := NewServer(cfg)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	s.mux.HandleFunc("/stuck", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	addr, stop, done := startServer(t, s)
+
+	go http.Get(addr + "/stuck")
+	<-started
+	stop()
+
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the shutdown deadline to be exceeded, got %v", err)
+	}
+}
+
 func BenchmarkJSONHandler(b *testing.B) {
 	req := httptest.NewRequest(http.MethodGet, "/json", nil)
 
+	handler := jsonHandler(NewUserStore(demoUsers()...))
+
 	for i := 0; i < b.N; i++ {
 		w := httptest.NewRecorder()
-		jsonHandler(w, req)
+		handler(w, req)
 	}
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// embeddedStatic is the static/ directory as it was at build time, for
+// -static-embed
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+// embeddedStaticFS returns embeddedStatic rooted at static/
+func embeddedStaticFS() fs.FS {
+	sub, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err) // the directory is embedded above, so it exists
+	}
+	return sub
+}
+
+// cacheControl is the Cache-Control header for each file extension.
+// HTML must be revalidated on every use so a deploy shows up straight
+// away; the assets it links to change less often. defaultCacheControl
+// covers everything else.
+var cacheControl = map[string]string{
+	".html":  "no-cache",
+	".json":  "no-cache",
+	".css":   "public, max-age=86400",
+	".js":    "public, max-age=86400",
+	".mjs":   "public, max-age=86400",
+	".png":   "public, max-age=604800",
+	".jpg":   "public, max-age=604800",
+	".jpeg":  "public, max-age=604800",
+	".gif":   "public, max-age=604800",
+	".svg":   "public, max-age=604800",
+	".webp":  "public, max-age=604800",
+	".ico":   "public, max-age=604800",
+	".woff":  "public, max-age=604800",
+	".woff2": "public, max-age=604800",
+}
+
+const defaultCacheControl = "public, max-age=3600"
+
+// precompressed lists the sibling files tried for each content coding,
+// best first: app.js is served from app.js.br or app.js.gz when they
+// exist and the client accepts the coding
+var precompressed = []struct {
+	coding, ext string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// staticHandler serves files from an fs.FS. Unlike http.FileServer it
+// never lists directories and it sets strong ETags and Cache-Control.
+// With spaFallback set, a path that names no file and has no extension
+// (a client-side route such as /app/settings) gets the root index.html.
+type staticHandler struct {
+	files       fs.FS
+	spaFallback bool
+
+	mu    sync.Mutex
+	etags map[string]etagEntry
+}
+
+// etagEntry caches a file's ETag until its size or mod time changes
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func newStaticHandler(files fs.FS, spaFallback bool) *staticHandler {
+	return &staticHandler{files: files, spaFallback: spaFallback, etags: make(map[string]etagEntry)}
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	// Dotfiles such as .env or .git stay private
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") && part != "." {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	info, err := fs.Stat(h.files, name)
+	if err == nil && info.IsDir() {
+		// Relative links in the directory's index.html only resolve
+		// against a URL ending in a slash
+		if !strings.HasSuffix(r.URL.Path, "/") && name != "." {
+			http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+		name = path.Join(name, "index.html")
+		info, err = fs.Stat(h.files, name)
+	}
+	if errors.Is(err, fs.ErrNotExist) && h.spaFallback && path.Ext(name) == "" {
+		name = "index.html"
+		info, err = fs.Stat(h.files, name)
+	}
+	if err != nil || info.IsDir() {
+		staticError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept-Encoding")
+	if cc, ok := cacheControl[path.Ext(name)]; ok {
+		w.Header().Set("Cache-Control", cc)
+	} else {
+		w.Header().Set("Cache-Control", defaultCacheControl)
+	}
+
+	// Prefer a precompressed sibling. Its Content-Type is that of the
+	// original, and must not be sniffed from the compressed bytes.
+	served := name
+	for _, pc := range precompressed {
+		if !acceptsEncoding(r.Header.Get("Accept-Encoding"), pc.coding) {
+			continue
+		}
+		if sib, err := fs.Stat(h.files, name+pc.ext); err == nil && !sib.IsDir() {
+			served, info = name+pc.ext, sib
+			ctype := mime.TypeByExtension(path.Ext(name))
+			if ctype == "" {
+				ctype = "application/octet-stream"
+			}
+			w.Header().Set("Content-Type", ctype)
+			w.Header().Set("Content-Encoding", pc.coding)
+			break
+		}
+	}
+
+	f, err := h.files.Open(served)
+	if err != nil {
+		staticError(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			staticError(w, r, err)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	etag, err := h.etag(served, info, content)
+	if err != nil {
+		staticError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+
+	// ServeContent answers If-None-Match, If-Modified-Since, Range and
+	// HEAD, and sets any missing Content-Type from the name
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// etag returns a strong ETag for a file: a hash of its content, so it is
+// the same on every server and changes whenever a byte does. Each
+// encoding of a file is its own file, so it gets its own ETag, as a
+// strong validator must. content is left at the start.
+func (h *staticHandler) etag(name string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	h.mu.Lock()
+	e, ok := h.etags[name]
+	h.mu.Unlock()
+	if ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.etag, nil
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum.Sum(nil)[:16]) + `"`
+
+	h.mu.Lock()
+	h.etags[name] = etagEntry{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	h.mu.Unlock()
+	return etag, nil
+}
+
+// staticError turns a file system error into a response without giving
+// away paths. A directory without an index.html is simply not found.
+func staticError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case err == nil, errors.Is(err, fs.ErrNotExist):
+		http.NotFound(w, r)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows the
+// given content coding. An entry naming the coding takes precedence over
+// *, and q=0 refuses it.
+func acceptsEncoding(header, coding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.TrimSpace(name)
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		switch {
+		case strings.EqualFold(name, coding):
+			return q > 0
+		case name == "*":
+			wildcard = q > 0
+		}
+	}
+	return wildcard
+}
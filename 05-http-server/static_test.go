@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func testStaticFS() fstest.MapFS {
+	return fstest.MapFS{
+		"index.html":        {Data: []byte("<h1>app</h1>")},
+		"app.js":            {Data: []byte("console.log('plain')")},
+		"app.js.gz":         {Data: []byte("gzip bytes")},
+		"app.js.br":         {Data: []byte("brotli bytes")},
+		"style.css":         {Data: []byte("body{}")},
+		"logo.png":          {Data: []byte("\x89PNG")},
+		"docs/index.html":   {Data: []byte("<h1>docs</h1>")},
+		"assets/readme.txt": {Data: []byte("no index here")},
+		".env":              {Data: []byte("SECRET=1")},
+	}
+}
+
+func getStatic(h http.Handler, path string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestStaticCaching(t *testing.T) {
+	h := newStaticHandler(testStaticFS(), false)
+
+	tests := []struct {
+		path         string
+		cacheControl string
+	}{
+		{"/index.html", "no-cache"},
+		{"/style.css", "public, max-age=86400"},
+		{"/logo.png", "public, max-age=604800"},
+		{"/assets/readme.txt", defaultCacheControl},
+	}
+	for _, tt := range tests {
+		w := getStatic(h, tt.path)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", tt.path, w.Code)
+		}
+		if got := w.Header().Get("Cache-Control"); got != tt.cacheControl {
+			t.Errorf("%s: expected Cache-Control %q, got %q", tt.path, tt.cacheControl, got)
+		}
+	}
+
+	// The ETag is strong and revalidation answers 304
+	w := getStatic(h, "/style.css")
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("Expected a strong ETag, got %q", etag)
+	}
+	if w := getStatic(h, "/style.css", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected status 304, got %d", w.Code)
+	}
+	if w := getStatic(h, "/index.html"); w.Header().Get("ETag") == etag {
+		t.Error("Expected different files to have different ETags")
+	}
+}
+
+func TestStaticPrecompressed(t *testing.T) {
+	h := newStaticHandler(testStaticFS(), false)
+
+	tests := []struct {
+		acceptEncoding string
+		wantEncoding   string
+		wantBody       string
+	}{
+		{"", "", "console.log('plain')"},
+		{"gzip", "gzip", "gzip bytes"},
+		{"gzip, deflate, br", "br", "brotli bytes"},
+		{"br;q=0, gzip", "gzip", "gzip bytes"},
+		{"*", "br", "brotli bytes"},
+		{"*, br;q=0, gzip;q=0", "", "console.log('plain')"},
+	}
+
+	etags := make(map[string]string)
+	for _, tt := range tests {
+		w := getStatic(h, "/app.js", "Accept-Encoding", tt.acceptEncoding)
+
+		if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+			t.Errorf("Accept-Encoding %q: expected Content-Encoding %q, got %q", tt.acceptEncoding, tt.wantEncoding, got)
+		}
+		if got := w.Body.String(); got != tt.wantBody {
+			t.Errorf("Accept-Encoding %q: expected %q, got %q", tt.acceptEncoding, tt.wantBody, got)
+		}
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/javascript") {
+			t.Errorf("Accept-Encoding %q: expected JavaScript, got %q", tt.acceptEncoding, got)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: expected Vary: Accept-Encoding", tt.acceptEncoding)
+		}
+		etags[tt.wantEncoding] = w.Header().Get("ETag")
+	}
+
+	if etags[""] == etags["gzip"] || etags["gzip"] == etags["br"] {
+		t.Errorf("Expected each encoding to have its own ETag, got %v", etags)
+	}
+}
+
+func TestStaticNoListings(t *testing.T) {
+	h := newStaticHandler(testStaticFS(), false)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/", http.StatusOK, "<h1>app</h1>"},
+		{"/docs/", http.StatusOK, "<h1>docs</h1>"},
+		{"/docs", http.StatusMovedPermanently, ""},
+		{"/assets/", http.StatusNotFound, ""},
+		{"/.env", http.StatusNotFound, ""},
+		{"/missing", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := getStatic(h, tt.path)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.wantStatus, w.Code)
+		}
+		if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+			t.Errorf("%s: expected %q, got %q", tt.path, tt.wantBody, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), "readme.txt") {
+			t.Errorf("%s: directory was listed", tt.path)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/index.html", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", w.Code)
+	}
+}
+
+func TestStaticSPAFallback(t *testing.T) {
+	h := newStaticHandler(testStaticFS(), true)
+
+	// Client-side routes get the app; missing assets are still missing
+	if w := getStatic(h, "/settings/profile"); w.Code != http.StatusOK || w.Body.String() != "<h1>app</h1>" {
+		t.Errorf("Expected index.html for a client-side route, got %d %q", w.Code, w.Body.String())
+	}
+	if w := getStatic(h, "/missing.png"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing asset, got %d", w.Code)
+	}
+	if w := getStatic(h, "/assets/"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a directory without an index, got %d", w.Code)
+	}
+}
+
+func TestStaticEmbedded(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.StaticDir = t.TempDir() // empty, so anything served must be embedded
+	cfg.StaticEmbed = true
+
+	w := getStatic(NewServer(cfg).Handler(), "/static/index.html")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Static File") {
+		t.Errorf("Expected the embedded index.html, got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// embeddedTemplates holds the HTML templates: layout.html wraps every
+// page, and each file in pages/ defines a "title" and a "content"
+// template for one page
+//
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// embeddedTemplatesFS returns embeddedTemplates rooted at templates/
+func embeddedTemplatesFS() fs.FS {
+	sub, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		panic(err) // the directory is embedded above, so it exists
+	}
+	return sub
+}
+
+// Renderer renders pages from a template file system. Each page is
+// parsed once, together with the layout, and kept. With reload set,
+// the templates are parsed again on every render instead, so edits on
+// disk show up without a restart.
+type Renderer struct {
+	files  fs.FS
+	reload bool
+
+	mu    sync.Mutex
+	pages map[string]*template.Template
+}
+
+// NewRenderer returns a renderer for the templates in files
+func NewRenderer(files fs.FS, reload bool) *Renderer {
+	return &Renderer{files: files, reload: reload, pages: make(map[string]*template.Template)}
+}
+
+// page returns the parsed template for pages/name.html
+func (rd *Renderer) page(name string) (*template.Template, error) {
+	if !rd.reload {
+		rd.mu.Lock()
+		defer rd.mu.Unlock()
+		if t, ok := rd.pages[name]; ok {
+			return t, nil
+		}
+	}
+
+	t, err := template.ParseFS(rd.files, "layout.html", "pages/"+name+".html")
+	if err != nil {
+		return nil, err
+	}
+	if !rd.reload {
+		rd.pages[name] = t
+	}
+	return t, nil
+}
+
+// Render writes pages/name.html with data. The page is rendered into a
+// buffer first, so a template error becomes a clean 500 rather than half
+// a page.
+func (rd *Renderer) Render(w http.ResponseWriter, status int, name string, data interface{}) {
+	t, err := rd.page(name)
+	var buf bytes.Buffer
+	if err == nil {
+		err = t.ExecuteTemplate(&buf, "layout.html", data)
+	}
+	if err != nil {
+		log.Printf("rendering %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedPagesParse(t *testing.T) {
+	files := embeddedTemplatesFS()
+	pages, _ := fs.Glob(files, "pages/*.html")
+	if len(pages) == 0 {
+		t.Fatal("Expected embedded pages")
+	}
+
+	rd := NewRenderer(files, false)
+	for _, p := range pages {
+		if _, err := rd.page(strings.TrimSuffix(path.Base(p), ".html")); err != nil {
+			t.Errorf("%s: %v", p, err)
+		}
+	}
+}
+
+func TestHelloEscapesHTML(t *testing.T) {
+	handler := helloHandler(NewRenderer(embeddedTemplatesFS(), false))
+	name := "%3Cscript%3Ealert(1)%3C%2Fscript%3E"
+
+	// A browser gets the page, with the name escaped
+	req := httptest.NewRequest(http.MethodGet, "/hello?name="+name, nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Expected HTML, got %q", got)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "<script>") || !strings.Contains(body, "Hello, &lt;script&gt;alert(1)&lt;/script&gt;!") {
+		t.Errorf("Expected the name to be escaped, got %s", body)
+	}
+
+	// Anything else gets text that must not be sniffed as HTML
+	req = httptest.NewRequest(http.MethodGet, "/hello?name="+name, nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+
+	if got := w.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Expected plain text, got %q", got)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("Expected nosniff on the plain text reply")
+	}
+}
+
+func testTemplates(page string) fstest.MapFS {
+	return fstest.MapFS{
+		"layout.html":     {Data: []byte(`<main>{{template "content" .}}</main>`)},
+		"pages/test.html": {Data: []byte(`{{define "content"}}` + page + `{{end}}`)},
+	}
+}
+
+func render(rd *Renderer, page string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	rd.Render(w, http.StatusOK, page, nil)
+	return w
+}
+
+func TestRendererReload(t *testing.T) {
+	files := testTemplates("v1")
+	cached := NewRenderer(files, false)
+	reloading := NewRenderer(files, true)
+	render(cached, "test")
+
+	files["pages/test.html"].Data = []byte(`{{define "content"}}v2{{end}}`)
+
+	if got := render(cached, "test").Body.String(); got != "<main>v1</main>" {
+		t.Errorf("Expected the cached page, got %q", got)
+	}
+	if got := render(reloading, "test").Body.String(); got != "<main>v2</main>" {
+		t.Errorf("Expected the edited page, got %q", got)
+	}
+}
+
+func TestRendererErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		rd   *Renderer
+	}{
+		{"missing page", "nope", NewRenderer(testTemplates("ok"), false)},
+		{"parse error", "test", NewRenderer(testTemplates("{{if}}"), false)},
+		{"exec error", "test", NewRenderer(testTemplates(`before {{template "undefined"}}`), false)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := render(tt.rd, tt.page)
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("Expected status 500, got %d", w.Code)
+			}
+			// Nothing of the page leaks out ahead of the error
+			if strings.Contains(w.Body.String(), "<main>") {
+				t.Errorf("Expected no partial page, got %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRouteMuxRoutes(t *testing.T) {
+	mux := newRouteMux()
+	noop := func(http.ResponseWriter, *http.Request) {}
+	mux.HandleFunc("POST /users", noop)
+	mux.HandleFunc("GET /users/{id}", noop)
+	mux.HandleFunc("GET /users", noop)
+	mux.HandleFunc("GET /{$}", noop)
+	mux.HandleFunc("/echo", noop)
+
+	want := []struct {
+		route
+		linkable bool
+	}{
+		{route{"GET", "/"}, true},
+		{route{"", "/echo"}, true},
+		{route{"GET", "/users"}, true},
+		{route{"POST", "/users"}, false},
+		{route{"GET", "/users/{id}"}, false},
+	}
+	got := mux.Routes()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d routes, got %+v", len(want), got)
+	}
+	for i, w := range want {
+		if got[i] != w.route || got[i].Linkable() != w.linkable {
+			t.Errorf("Route %d: expected %+v (linkable %v), got %+v", i, w.route, w.linkable, got[i])
+		}
+	}
+}
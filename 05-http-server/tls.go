@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloader holds the server's certificate and swaps it for a fresh
+// copy from disk on Reload, so a renewed certificate is picked up
+// without a restart. Connections already open keep the certificate they
+// were made with.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) *certReloader {
+	return &certReloader{certFile: certFile, keyFile: keyFile}
+}
+
+// Reload reads the certificate and key again. If they cannot be loaded,
+// the certificate in use is kept and the error is returned.
+func (c *certReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is the tls.Config hook; it is asked for the certificate
+// on every handshake
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+	return c.cert, nil
+}
+
+// tlsConfig returns the server's TLS settings. Listing h2 first in
+// NextProtos offers HTTP/2 to every client that supports it.
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// redirectToHTTPS answers every plain HTTP request with a redirect to the
+// same URL over HTTPS on the port of httpsAddr. 308 keeps the method and
+// body, so a POST is not turned into a GET.
+func redirectToHTTPS(httpsAddr string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]") // e.g. [::1] without a port
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]" // an IPv6 address needs its brackets back
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	}
+}
+
+// Files written by gencert
+const (
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+	certFile   = "cert.pem"
+	keyFile    = "key.pem"
+)
+
+// runGencert is the gencert command:
+//
+//	go run . gencert [-dir certs] [-hosts localhost,127.0.0.1,::1]
+func runGencert(args []string) error {
+	fs := flag.NewFlagSet("gencert", flag.ContinueOnError)
+	dir := fs.String("dir", "certs", "directory to write the certificates to")
+	hosts := fs.String("hosts", "localhost,127.0.0.1,::1", "comma-separated host names and IP addresses to certify")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var names []string
+	for _, h := range strings.Split(*hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			names = append(names, h)
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("-hosts must name at least one host")
+	}
+
+	if err := generateDevCerts(*dir, names, time.Now()); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s and %s, signed by the CA in %s.\n",
+		filepath.Join(*dir, certFile), filepath.Join(*dir, keyFile), filepath.Join(*dir, caCertFile))
+	fmt.Printf("Trust %s in your browser or OS, then run:\n", filepath.Join(*dir, caCertFile))
+	fmt.Printf("  go run . -addr :8443 -tls-cert %s -tls-key %s -redirect-addr :8080\n",
+		filepath.Join(*dir, certFile), filepath.Join(*dir, keyFile))
+	return nil
+}
+
+// generateDevCerts writes a certificate for hosts into dir, signed by a
+// development CA. An existing CA in dir is reused, so a CA trusted once
+// keeps working across runs; otherwise a new one is created. The
+// private keys are readable by their owner only. The first host is the
+// certificate's common name.
+func generateDevCerts(dir string, hosts []string, now time.Time) error {
+	if len(hosts) == 0 {
+		return errors.New("no hosts to certify")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	ca, caKey, err := loadCA(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		ca, caKey, err = createCA(dir, now)
+	}
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{Organization: []string{"Go HTTP Server (development)"}, CommonName: hosts[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, 397), // the longest validity browsers accept
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	return writeKeyPair(dir, certFile, keyFile, der, key)
+}
+
+// createCA makes a new development CA in dir
+func createCA(dir string, now time.Time) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{Organization: []string{"Go HTTP Server (development)"}, CommonName: "Go HTTP Server Development CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeKeyPair(dir, caCertFile, caKeyFile, der, key); err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+// loadCA reads the development CA from dir
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: expected an ECDSA key", caKeyFile)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	return ca, key, err
+}
+
+// writeKeyPair writes a DER certificate and its key as PEM files
+func writeKeyPair(dir, certName, keyName string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, keyName), keyPEM, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, certName), certPEM, 0o644)
+}
+
+// randomSerial returns a random 128-bit certificate serial number
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// caPool returns a pool holding the development CA in dir
+func caPool(t *testing.T, dir string) *x509.CertPool {
+	t.Helper()
+	pemData, err := os.ReadFile(filepath.Join(dir, caCertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		t.Fatal("Expected a PEM certificate in ca.pem")
+	}
+	return pool
+}
+
+func TestGenerateDevCerts(t *testing.T) {
+	dir := t.TempDir()
+	if err := generateDevCerts(dir, []string{"localhost", "127.0.0.1", "::1"}, time.Now()); err != nil {
+		t.Fatalf("generateDevCerts: %v", err)
+	}
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, certFile), filepath.Join(dir, keyFile))
+	if err != nil {
+		t.Fatalf("Expected a usable key pair: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(pair.Certificate[0])
+	roots := caPool(t, dir)
+	for _, name := range []string{"localhost", "127.0.0.1", "::1"} {
+		_, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots}); err == nil {
+		t.Error("Expected the certificate not to cover example.com")
+	}
+
+	for _, name := range []string{keyFile, caKeyFile} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o600 {
+			t.Errorf("%s: expected mode 0600, got %o", name, perm)
+		}
+	}
+
+	// A second run keeps the CA, so a browser that trusts it keeps working
+	ca, _ := os.ReadFile(filepath.Join(dir, caCertFile))
+	cert, _ := os.ReadFile(filepath.Join(dir, certFile))
+	if err := generateDevCerts(dir, []string{"localhost"}, time.Now()); err != nil {
+		t.Fatalf("generateDevCerts again: %v", err)
+	}
+	ca2, _ := os.ReadFile(filepath.Join(dir, caCertFile))
+	cert2, _ := os.ReadFile(filepath.Join(dir, certFile))
+	if !bytes.Equal(ca, ca2) {
+		t.Error("Expected the CA to be reused")
+	}
+	if bytes.Equal(cert, cert2) {
+		t.Error("Expected a new certificate")
+	}
+}
+
+// servedSerial makes a new connection to addr and returns the serial
+// number of the certificate presented, and the protocol spoken
+func servedSerial(t *testing.T, addr string, roots *x509.CertPool) (*big.Int, string) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(addr + "/json")
+	if err != nil {
+		t.Fatalf("GET over TLS: %v", err)
+	}
+	resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].SerialNumber, resp.Proto
+}
+
+func TestGencertTrimsHosts(t *testing.T) {
+	dir := t.TempDir()
+	if err := runGencert([]string{"-dir", dir, "-hosts", " localhost , 127.0.0.1,"}); err != nil {
+		t.Fatalf("gencert: %v", err)
+	}
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, certFile), filepath.Join(dir, keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(pair.Certificate[0])
+	if leaf.Subject.CommonName != "localhost" || len(leaf.DNSNames) != 1 || len(leaf.IPAddresses) != 1 {
+		t.Errorf("Expected CN localhost with one name and one IP, got %q %v %v", leaf.Subject.CommonName, leaf.DNSNames, leaf.IPAddresses)
+	}
+
+	if err := runGencert([]string{"-dir", dir, "-hosts", " , "}); err == nil {
+		t.Error("Expected an error without any hosts")
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	if err := generateDevCerts(dir, []string{"127.0.0.1"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.TLSCert = filepath.Join(dir, certFile)
+	cfg.TLSKey = filepath.Join(dir, keyFile)
+	s := NewServer(cfg)
+	addr, stop, done := startServer(t, s)
+	defer func() {
+		stop()
+		<-done
+	}()
+	roots := caPool(t, dir)
+
+	first, proto := servedSerial(t, addr, roots)
+	if proto != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2, got %s", proto)
+	}
+
+	// A renewed certificate is used once reloaded
+	if err := generateDevCerts(dir, []string{"127.0.0.1"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := servedSerial(t, addr, roots); got.Cmp(first) != 0 {
+		t.Error("Expected the old certificate until reloaded")
+	}
+	if err := s.ReloadCerts(); err != nil {
+		t.Fatalf("ReloadCerts: %v", err)
+	}
+	second, _ := servedSerial(t, addr, roots)
+	if second.Cmp(first) == 0 {
+		t.Error("Expected the renewed certificate after reloading")
+	}
+
+	// A broken certificate is refused and the current one kept
+	os.WriteFile(cfg.TLSCert, []byte("not a certificate"), 0o644)
+	if err := s.ReloadCerts(); err == nil {
+		t.Error("Expected reloading a broken certificate to fail")
+	}
+	if got, _ := servedSerial(t, addr, roots); got.Cmp(second) != 0 {
+		t.Error("Expected the last good certificate to stay in use")
+	}
+}
+
+func TestServeTLSWithoutCert(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TLSCert = filepath.Join(t.TempDir(), "missing.pem")
+	cfg.TLSKey = cfg.TLSCert
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewServer(cfg).Serve(context.Background(), ln); err == nil {
+		t.Error("Expected Serve to fail without a certificate")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		httpsAddr string
+		url       string
+		want      string
+	}{
+		{":8443", "http://example.com:8080/users?id=1", "https://example.com:8443/users?id=1"},
+		{":443", "http://example.com/", "https://example.com/"},
+		{"127.0.0.1:443", "http://example.com:80/a%2Fb", "https://example.com/a%2Fb"},
+		{":8443", "http://[::1]:8080/", "https://[::1]:8443/"},
+		{":8443", "http://[::1]/", "https://[::1]:8443/"},
+		{":443", "http://[::1]:8080/", "https://[::1]/"},
+		{":443", "http://[::1]/", "https://[::1]/"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		redirectToHTTPS(tt.httpsAddr)(w, httptest.NewRequest(http.MethodPost, tt.url, nil))
+
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s: expected status 308, got %d", tt.url, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != tt.want {
+			t.Errorf("%s: expected Location %q, got %q", tt.url, tt.want, got)
+		}
+	}
+}
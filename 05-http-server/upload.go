@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// uploadTypes allow-lists what may be uploaded, keyed by the sniffed
+// media type, with the extension the stored file gets. The type a client
+// declares is ignored: it is only a claim.
+var uploadTypes = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+	"text/plain":      ".txt",
+}
+
+// uploadedFile describes one stored file in the response to POST /upload
+type uploadedFile struct {
+	Field       string `json:"field"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+// uploadsPrefix is where uploaded files are served from
+const uploadsPrefix = "/static/uploads/"
+
+// uploadHandler accepts multipart/form-data uploads and stores each file
+// part in a BlobStore
+type uploadHandler struct {
+	store    BlobStore
+	events   *Broker
+	maxBytes int64 // per file
+	maxFiles int
+}
+
+// uploadError is a client error found while reading the form
+type uploadError struct {
+	status int
+	msg    string
+}
+
+func (e *uploadError) Error() string { return e.msg }
+
+// upload handles POST /upload. The form is read part by part with
+// MultipartReader, so a file streams from the connection to the store
+// instead of being buffered in memory or in a temporary file the way
+// ParseMultipartForm does. Either every file is stored or none is.
+func (h *uploadHandler) upload(w http.ResponseWriter, r *http.Request) {
+	// The whole request may carry maxFiles files plus a little room for
+	// the multipart boundaries, headers and any plain form fields
+	limit := h.maxBytes*int64(h.maxFiles) + 1<<20
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+
+	var stored []uploadedFile
+	err = h.readParts(r, mr, &stored)
+	if err != nil {
+		// All or nothing: drop what was already stored
+		for _, f := range stored {
+			h.store.Delete(r.Context(), strings.TrimPrefix(f.URL, uploadsPrefix))
+		}
+
+		var uerr *uploadError
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &uerr):
+			http.Error(w, uerr.msg, uerr.status)
+		case errors.As(err, &tooLarge):
+			bodyTooLarge(w, limit)
+		default:
+			http.Error(w, "Error reading upload", http.StatusBadRequest)
+		}
+		return
+	}
+	if len(stored) == 0 {
+		http.Error(w, "No files in the form", http.StatusBadRequest)
+		return
+	}
+
+	for _, f := range stored {
+		h.events.PublishJSON("upload", f)
+	}
+	writeJSON(w, http.StatusCreated, stored)
+}
+
+// readParts stores every file part, appending each to stored as it goes
+func (h *uploadHandler) readParts(r *http.Request, mr *multipart.Reader, stored *[]uploadedFile) error {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Plain form fields carry nothing we keep
+		if part.FileName() == "" {
+			io.Copy(io.Discard, part)
+			continue
+		}
+		if len(*stored) == h.maxFiles {
+			return &uploadError{http.StatusBadRequest, fmt.Sprintf("At most %d files may be uploaded at once", h.maxFiles)}
+		}
+
+		f, err := h.storePart(r, part)
+		if err != nil {
+			return err
+		}
+		*stored = append(*stored, f)
+	}
+}
+
+// storePart sniffs a file part's type and streams it into the store
+func (h *uploadHandler) storePart(r *http.Request, part *multipart.Part) (uploadedFile, error) {
+	// http.DetectContentType looks at no more than the first 512 bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return uploadedFile{}, err
+	}
+	head = head[:n]
+
+	ctype := http.DetectContentType(head)
+	mediaType, _, _ := mime.ParseMediaType(ctype)
+	ext, ok := uploadTypes[mediaType]
+	if !ok {
+		return uploadedFile{}, &uploadError{http.StatusUnsupportedMediaType,
+			fmt.Sprintf("%s: %s files are not accepted", part.FileName(), mediaType)}
+	}
+
+	key, err := newBlobKey(ext)
+	if err != nil {
+		return uploadedFile{}, err
+	}
+
+	// Read one byte past the limit, so an oversized file is caught
+	// without reading the rest of it
+	body := io.LimitReader(io.MultiReader(bytes.NewReader(head), part), h.maxBytes+1)
+	size, err := h.store.Put(r.Context(), key, body, BlobMeta{ContentType: ctype, Filename: part.FileName()})
+	if err != nil {
+		return uploadedFile{}, err
+	}
+	if size > h.maxBytes {
+		h.store.Delete(r.Context(), key)
+		return uploadedFile{}, &uploadError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("%s: files must not exceed %d bytes", part.FileName(), h.maxBytes)}
+	}
+
+	return uploadedFile{
+		Field:       part.FormName(),
+		Filename:    part.FileName(),
+		ContentType: ctype,
+		Size:        size,
+		URL:         uploadsPrefix + key,
+	}, nil
+}
+
+// newBlobKey returns a random key, so that names cannot be guessed and
+// uploads never overwrite one another
+func newBlobKey(ext string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b) + ext, nil
+}
+
+// serve handles GET /static/uploads/{key}. Images are shown inline and
+// everything else downloads, under the name it was uploaded with.
+func (h *uploadHandler) serve(w http.ResponseWriter, r *http.Request) {
+	blob, err := h.store.Get(r.Context(), r.PathValue("key"))
+	if errors.Is(err, ErrBlobNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(blob.ContentType, "image/") {
+		disposition = "inline"
+	}
+	if blob.Filename != "" {
+		// FormatMediaType encodes names that are not plain ASCII (RFC 2231)
+		disposition = mime.FormatMediaType(disposition, map[string]string{"filename": blob.Filename})
+	}
+
+	w.Header().Set("Content-Type", blob.ContentType)
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// A key is never reused, so its content never changes
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", blob.ModTime, blob)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// pngData is enough of a PNG for content sniffing
+var pngData = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+
+// uploadFile is one file part for multipartBody
+type uploadFile struct {
+	field, name string
+	data        []byte
+}
+
+// multipartBody encodes files, plus a plain "note" field, as a form
+func multipartBody(files ...uploadFile) (body *bytes.Buffer, contentType string) {
+	body = new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	mw.WriteField("note", "not a file")
+	for _, f := range files {
+		// CreateFormFile labels every part application/octet-stream; the
+		// server must sniff the real type regardless
+		part, _ := mw.CreateFormFile(f.field, f.name)
+		part.Write(f.data)
+	}
+	mw.Close()
+	return body, mw.FormDataContentType()
+}
+
+func newUploadServer(t *testing.T) (http.Handler, string) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.UploadDir = t.TempDir()
+	cfg.UploadMaxBytes = 1024
+	cfg.UploadMaxFiles = 2
+	return NewServer(cfg).Handler(), cfg.UploadDir
+}
+
+func postUpload(handler http.Handler, files ...uploadFile) *httptest.ResponseRecorder {
+	body, contentType := multipartBody(files...)
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// storedBlobs counts the blobs in a DiskStore directory
+func storedBlobs(t *testing.T, dir string) int {
+	t.Helper()
+	entries, _ := os.ReadDir(dir)
+	n := 0
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), metaSuffix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestUpload(t *testing.T) {
+	handler, dir := newUploadServer(t)
+
+	w := postUpload(handler,
+		uploadFile{"avatar", "me.png", pngData},
+		uploadFile{"notes", "résumé.txt", []byte("plain text")},
+	)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var files []uploadedFile
+	json.NewDecoder(w.Body).Decode(&files)
+	if len(files) != 2 || storedBlobs(t, dir) != 2 {
+		t.Fatalf("Expected two stored files, got %+v", files)
+	}
+	if files[0].ContentType != "image/png" || files[0].Size != int64(len(pngData)) || files[0].Field != "avatar" {
+		t.Errorf("Unexpected first file: %+v", files[0])
+	}
+
+	tests := []struct {
+		file            uploadedFile
+		wantType        string
+		wantDisposition string
+	}{
+		{files[0], "image/png", `inline; filename=me.png`},
+		{files[1], "text/plain; charset=utf-8", `attachment; filename*=utf-8''r%C3%A9sum%C3%A9.txt`},
+	}
+	for _, tt := range tests {
+		if !strings.HasPrefix(tt.file.URL, "/static/uploads/") {
+			t.Fatalf("Expected a URL under /static/uploads/, got %q", tt.file.URL)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.file.URL, nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", tt.file.URL, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.wantType {
+			t.Errorf("%s: expected Content-Type %q, got %q", tt.file.Filename, tt.wantType, got)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tt.wantDisposition {
+			t.Errorf("%s: expected Content-Disposition %q, got %q", tt.file.Filename, tt.wantDisposition, got)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: expected nosniff", tt.file.Filename)
+		}
+	}
+}
+
+func TestUploadRejects(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      []uploadFile
+		wantStatus int
+	}{
+		{"no files", nil, http.StatusBadRequest},
+		{"type not allowed", []uploadFile{{"f", "page.png", []byte("<!DOCTYPE html><script>alert(1)</script>")}}, http.StatusUnsupportedMediaType},
+		{"file too large", []uploadFile{{"f", "big.txt", bytes.Repeat([]byte("a"), 1025)}}, http.StatusRequestEntityTooLarge},
+		{"too many files", []uploadFile{{"a", "a.txt", []byte("a")}, {"b", "b.txt", []byte("b")}, {"c", "c.txt", []byte("c")}}, http.StatusBadRequest},
+		{"later file bad", []uploadFile{{"a", "a.png", pngData}, {"b", "b.exe", []byte("MZ\x90\x00")}}, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, dir := newUploadServer(t)
+
+			w := postUpload(handler, tt.files...)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			// Nothing is kept from a rejected upload
+			if n := storedBlobs(t, dir); n != 0 {
+				t.Errorf("Expected no stored files, found %d", n)
+			}
+		})
+	}
+
+	handler, _ := newUploadServer(t)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(`{"not":"multipart"}`))
+	req.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a JSON body, got %d", w.Code)
+	}
+}
+
+func TestUploadNotFound(t *testing.T) {
+	handler, _ := newUploadServer(t)
+
+	for _, path := range []string{
+		"/static/uploads/0123456789abcdef0123456789abcdef.png",
+		"/static/uploads/..%2fgo.mod",
+		"/static/uploads/x.meta.json",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewDiskStore(t.TempDir() + "/blobs") // created on demand
+
+	n, err := store.Put(ctx, "a.txt", strings.NewReader("hello"), BlobMeta{ContentType: "text/plain", Filename: "hi.txt"})
+	if err != nil || n != 5 {
+		t.Fatalf("Put: %d, %v", n, err)
+	}
+
+	blob, err := store.Get(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(data) != "hello" || blob.Size != 5 || blob.Filename != "hi.txt" || blob.ModTime.IsZero() {
+		t.Errorf("Unexpected blob %q %+v", data, blob.BlobMeta)
+	}
+
+	// A failed read stores nothing
+	failing := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("connection reset")))
+	if _, err := store.Put(ctx, "b.txt", failing, BlobMeta{}); err == nil {
+		t.Error("Expected Put to fail")
+	}
+	if _, err := store.Get(ctx, "b.txt"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Expected nothing stored after a failed Put, got %v", err)
+	}
+
+	for _, key := range []string{"", "../x", "a/b", ".hidden", "a.txt.meta.json"} {
+		if _, err := store.Put(ctx, key, strings.NewReader("x"), BlobMeta{}); err == nil {
+			t.Errorf("Expected key %q to be refused", key)
+		}
+	}
+
+	if err := store.Delete(ctx, "a.txt"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := store.Delete(ctx, "a.txt"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Expected ErrBlobNotFound on second delete, got %v", err)
+	}
+}
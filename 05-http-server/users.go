@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrUserNotFound is returned for an ID the store does not hold
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUsernameTaken is returned when another user already has the
+	// username
+	ErrUsernameTaken = errors.New("username already taken")
+)
+
+// validate checks the fields a client may set
+func (u User) validate() error {
+	if strings.TrimSpace(u.Username) == "" {
+		return errors.New("username is required")
+	}
+	if !strings.Contains(u.Email, "@") {
+		return errors.New("email must be an email address")
+	}
+	return nil
+}
+
+// UserStore keeps users in memory. It is safe for concurrent use.
+type UserStore struct {
+	mu     sync.RWMutex
+	users  map[int]User
+	nextID int
+}
+
+// NewUserStore returns a store holding the given users. IDs are assigned
+// in order, starting at 1.
+func NewUserStore(users ...User) *UserStore {
+	s := &UserStore{users: make(map[int]User), nextID: 1}
+	for _, u := range users {
+		if _, err := s.Create(u); err != nil {
+			panic(err)
+		}
+	}
+	return s
+}
+
+// demoUsers are the users a new server starts with
+func demoUsers() []User {
+	return []User{
+		{Username: "alice", Email: "alice@example.com"},
+		{Username: "bob", Email: "bob@example.com"},
+		{Username: "carol", Email: "carol@example.com"},
+	}
+}
+
+// List returns every user, ordered by ID
+func (s *UserStore) List() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	slices.SortFunc(users, func(a, b User) int { return a.ID - b.ID })
+	return users
+}
+
+// Get returns the user with the given ID
+func (s *UserStore) Get(id int) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return u, nil
+}
+
+// Create stores a new user under the next free ID and returns it
+func (s *UserStore) Create(u User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.taken(u.Username, 0) {
+		return User{}, ErrUsernameTaken
+	}
+	u.ID = s.nextID
+	s.nextID++
+	s.users[u.ID] = u
+	return u, nil
+}
+
+// Update replaces the user with the given ID
+func (s *UserStore) Update(id int, u User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return User{}, ErrUserNotFound
+	}
+	if s.taken(u.Username, id) {
+		return User{}, ErrUsernameTaken
+	}
+	u.ID = id
+	s.users[id] = u
+	return u, nil
+}
+
+// Delete removes the user with the given ID
+func (s *UserStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, id)
+	return nil
+}
+
+// taken reports whether a user other than except has the username.
+// The caller holds s.mu.
+func (s *UserStore) taken(username string, except int) bool {
+	for id, u := range s.users {
+		if id != except && strings.EqualFold(u.Username, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// userHandlers serves CRUD on /users and /users/{id}. Every change is
+// published on events as a user.created, user.updated or user.deleted
+// event.
+type userHandlers struct {
+	store    *UserStore
+	events   *Broker
+	maxBytes int64
+}
+
+// register adds the user routes to mux, using Go 1.22 method and
+// wildcard patterns. The mux answers 405 with an Allow header for other
+// methods.
+func (h *userHandlers) register(mux *routeMux) {
+	mux.HandleFunc("GET /users", h.list)
+	mux.HandleFunc("POST /users", h.create)
+	mux.HandleFunc("GET /users/{id}", h.get)
+	mux.HandleFunc("PUT /users/{id}", h.update)
+	mux.HandleFunc("DELETE /users/{id}", h.delete)
+}
+
+func (h *userHandlers) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.store.List())
+}
+
+func (h *userHandlers) get(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	user, err := h.store.Get(id)
+	if err != nil {
+		userError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (h *userHandlers) create(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.readUser(w, r)
+	if !ok {
+		return
+	}
+	user, err := h.store.Create(user)
+	if err != nil {
+		userError(w, err)
+		return
+	}
+	h.events.PublishJSON("user.created", user)
+	w.Header().Set("Location", "/users/"+strconv.Itoa(user.ID))
+	writeJSON(w, http.StatusCreated, user)
+}
+
+func (h *userHandlers) update(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	user, ok := h.readUser(w, r)
+	if !ok {
+		return
+	}
+	if user.ID != 0 && user.ID != id {
+		http.Error(w, "User ID in body does not match the URL", http.StatusBadRequest)
+		return
+	}
+	user, err := h.store.Update(id, user)
+	if err != nil {
+		userError(w, err)
+		return
+	}
+	h.events.PublishJSON("user.updated", user)
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (h *userHandlers) delete(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	if err := h.store.Delete(id); err != nil {
+		userError(w, err)
+		return
+	}
+	h.events.PublishJSON("user.deleted", User{ID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userID parses the {id} path value. When ok is false the 400 response
+// has already been written.
+func userID(w http.ResponseWriter, r *http.Request) (id int, ok bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// readUser decodes and validates a user from the request body. When ok
+// is false the error response has already been written.
+func (h *userHandlers) readUser(w http.ResponseWriter, r *http.Request) (user User, ok bool) {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.maxBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&user); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			bodyTooLarge(w, h.maxBytes)
+		} else {
+			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		}
+		return User{}, false
+	}
+	if err := user.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return User{}, false
+	}
+	return user, true
+}
+
+// userError maps a store error to a response
+func userError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, ErrUsernameTaken):
+		http.Error(w, "Username already taken", http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeJSON writes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
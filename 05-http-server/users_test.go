@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUserStore(t *testing.T) {
+	store := NewUserStore(demoUsers()...)
+
+	created, err := store.Create(User{Username: "dave", Email: "dave@example.com"})
+	if err != nil || created.ID != 4 {
+		t.Fatalf("Expected dave to get ID 4, got %+v, %v", created, err)
+	}
+	if _, err := store.Create(User{Username: "Alice", Email: "a@example.com"}); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("Expected ErrUsernameTaken, got %v", err)
+	}
+
+	// A user may keep their own username, but not take someone else's
+	if _, err := store.Update(1, User{Username: "alice", Email: "new@example.com"}); err != nil {
+		t.Errorf("Expected update to succeed, got %v", err)
+	}
+	if _, err := store.Update(1, User{Username: "bob", Email: "a@example.com"}); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("Expected ErrUsernameTaken, got %v", err)
+	}
+	if _, err := store.Update(99, User{Username: "x", Email: "x@example.com"}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+
+	if err := store.Delete(2); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(2); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound after delete, got %v", err)
+	}
+	if err := store.Delete(2); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound on second delete, got %v", err)
+	}
+
+	var ids []int
+	for _, u := range store.List() {
+		ids = append(ids, u.ID)
+	}
+	if fmt.Sprint(ids) != "[1 3 4]" {
+		t.Errorf("Expected users 1, 3 and 4 in order, got %v", ids)
+	}
+}
+
+func TestUserStoreConcurrent(t *testing.T) {
+	store := NewUserStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u, err := store.Create(User{Username: fmt.Sprintf("user%d", i), Email: "u@example.com"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			store.Get(u.ID)
+			store.List()
+		}(i)
+	}
+	wg.Wait()
+
+	users := store.List()
+	if len(users) != 50 || users[49].ID != 50 {
+		t.Errorf("Expected 50 users with IDs 1 to 50, got %d", len(users))
+	}
+}
+
+// doUsers sends a request with an optional JSON body to handler
+func doUsers(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestUserCRUD(t *testing.T) {
+	handler := NewServer(DefaultConfig()).Handler()
+
+	// Create
+	w := doUsers(handler, http.MethodPost, "/users", `{"username":"dave","email":"dave@example.com"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var dave User
+	json.NewDecoder(w.Body).Decode(&dave)
+	if w.Header().Get("Location") != "/users/4" || dave.ID != 4 {
+		t.Errorf("Expected dave at /users/4, got %q, %+v", w.Header().Get("Location"), dave)
+	}
+
+	// Read, through /users and the /json listing
+	for _, path := range []string{"/users", "/json"} {
+		var users []User
+		json.NewDecoder(doUsers(handler, http.MethodGet, path, "").Body).Decode(&users)
+		if len(users) != 4 || users[3].Username != "dave" {
+			t.Errorf("%s: expected dave to be listed, got %+v", path, users)
+		}
+	}
+
+	// Update
+	w = doUsers(handler, http.MethodPut, "/users/4", `{"username":"dave","email":"d@example.com"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "d@example.com") {
+		t.Errorf("Expected the update to be returned, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Delete
+	if w := doUsers(handler, http.MethodDelete, "/users/4", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", w.Code)
+	}
+	if w := doUsers(handler, http.MethodGet, "/users/4", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestUserErrors(t *testing.T) {
+	handler := NewServer(DefaultConfig()).Handler()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"unknown user", http.MethodGet, "/users/99", "", http.StatusNotFound},
+		{"update unknown", http.MethodPut, "/users/99", `{"username":"x","email":"x@example.com"}`, http.StatusNotFound},
+		{"delete unknown", http.MethodDelete, "/users/99", "", http.StatusNotFound},
+		{"zero ID", http.MethodGet, "/users/0", "", http.StatusBadRequest},
+		{"bad JSON", http.MethodPost, "/users", `{"username":`, http.StatusBadRequest},
+		{"unknown field", http.MethodPost, "/users", `{"username":"x","email":"x@example.com","admin":true}`, http.StatusBadRequest},
+		{"missing username", http.MethodPost, "/users", `{"email":"x@example.com"}`, http.StatusBadRequest},
+		{"bad email", http.MethodPost, "/users", `{"username":"x","email":"x"}`, http.StatusBadRequest},
+		{"taken username", http.MethodPost, "/users", `{"username":"bob","email":"b@example.com"}`, http.StatusConflict},
+		{"mismatched ID", http.MethodPut, "/users/1", `{"id":2,"username":"alice","email":"a@example.com"}`, http.StatusBadRequest},
+		{"wrong method", http.MethodPatch, "/users/1", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doUsers(handler, tt.method, tt.path, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testSecret signs every token in the test suite; routers under test
+// get it through WithAuthSecret
+var testSecret = []byte("test-secret")
+
+// testToken mints a bearer token for role, valid for an hour of real
+// time. Routers on a fake clock in the past accept it too.
+func testToken(role Role) string {
+	token, err := NewAuthenticator(testSecret, time.Now).Issue("test-"+string(role), role, time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+// authorize adds a bearer token for role to req
+func authorize(req *http.Request, role Role) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+testToken(role))
+	return req
+}
+
+// serve runs req through router and returns the recorded response
+func serve(router *gin.Engine, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthenticatorRoundTrip(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	auth := NewAuthenticator(testSecret, clock.Now)
+
+	token, err := auth.Issue("alice", RoleLibrarian, time.Hour)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	claims, err := auth.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.Subject != "alice" || claims.Role != RoleLibrarian {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+
+	clock.Advance(time.Hour)
+	if _, err := auth.Verify(token); err != ErrTokenExpired {
+		t.Errorf("Expected ErrTokenExpired, got %v", err)
+	}
+
+	if _, err := auth.Issue("bob", Role("superuser"), time.Hour); err == nil {
+		t.Error("Expected an unknown role to be refused")
+	}
+}
+
+func TestAuthenticatorRejectsForgedTokens(t *testing.T) {
+	auth := NewAuthenticator(testSecret, time.Now)
+	good, _ := auth.Issue("alice", RoleReader, time.Hour)
+	parts := strings.Split(good, ".")
+
+	otherKey, _ := NewAuthenticator([]byte("other-secret"), time.Now).Issue("alice", RoleAdmin, time.Hour)
+	noneHeader := "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0" // {"alg":"none","typ":"JWT"}
+	adminPayload := strings.Split(otherKey, ".")[1]
+
+	tests := map[string]string{
+		"wrong key":           otherKey,
+		"alg none":            noneHeader + "." + parts[1] + ".",
+		"swapped payload":     parts[0] + "." + adminPayload + "." + parts[2],
+		"two segments":        parts[0] + "." + parts[1],
+		"garbage":             "not-a-token",
+		"truncated signature": parts[0] + "." + parts[1] + "." + parts[2][:10],
+	}
+	for name, token := range tests {
+		if _, err := auth.Verify(token); err == nil {
+			t.Errorf("%s: expected the token to be rejected", name)
+		}
+	}
+}
+
+func TestRoleIncludes(t *testing.T) {
+	if !RoleAdmin.Includes(RoleLibrarian) || !RoleLibrarian.Includes(RoleReader) {
+		t.Error("Expected higher roles to include lower ones")
+	}
+	if RoleReader.Includes(RoleLibrarian) || RoleLibrarian.Includes(RoleAdmin) {
+		t.Error("Expected lower roles not to include higher ones")
+	}
+	if Role("").Includes(RoleReader) {
+		t.Error("Expected an empty role to include nothing")
+	}
+}
+
+func TestRouteAuthorization(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	book := `{"title":"T","author":"A","year":2020}`
+	tests := []struct {
+		method, path, body string
+		role               Role // "" sends no token
+		want               int
+	}{
+		{"GET", "/v1/books", "", "", http.StatusOK},
+		{"GET", "/v1/books/1", "", "", http.StatusOK},
+		{"GET", "/v1/authors", "", "", http.StatusOK},
+		{"POST", "/v1/books", book, "", http.StatusUnauthorized},
+		{"POST", "/v1/books", book, RoleReader, http.StatusForbidden},
+		{"POST", "/v1/books", book, RoleLibrarian, http.StatusCreated},
+		{"PUT", "/v1/books/1", book, RoleReader, http.StatusForbidden},
+		{"PUT", "/v1/books/1", book, RoleLibrarian, http.StatusOK},
+		{"PATCH", "/v1/books/1", `{"year":2016}`, "", http.StatusUnauthorized},
+		{"DELETE", "/v1/books/1", "", "", http.StatusUnauthorized},
+		{"DELETE", "/v1/books/1", "", RoleLibrarian, http.StatusForbidden},
+		{"DELETE", "/v1/books/1", "", RoleAdmin, http.StatusOK},
+		{"POST", "/v1/authors", `{"name":"N"}`, RoleReader, http.StatusForbidden},
+		{"DELETE", "/v1/authors/1", "", RoleLibrarian, http.StatusForbidden},
+		{"POST", "/v1/books/2/checkout", `{"borrower_id":"alice"}`, "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		router := newTestRouter()
+		req, _ := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		if tt.method == "PATCH" {
+			req.Header.Set("Content-Type", mergePatchType)
+		}
+		if tt.role != "" {
+			authorize(req, tt.role)
+		}
+		w := serve(router, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %s as %q: expected %d, got %d", tt.method, tt.path, tt.role, tt.want, w.Code)
+		}
+	}
+}
+
+func TestAuthProblems(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	req, _ := http.NewRequest("DELETE", "/v1/books/1", nil)
+	w := serve(router, req)
+	decodeProblem(t, w, http.StatusUnauthorized, "unauthenticated")
+	if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+		t.Errorf("Expected a Bearer challenge, got %q", w.Header().Get("WWW-Authenticate"))
+	}
+
+	req, _ = http.NewRequest("DELETE", "/v1/books/1", nil)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	w = serve(router, req)
+	decodeProblem(t, w, http.StatusUnauthorized, "invalid_token")
+	if !strings.Contains(w.Header().Get("WWW-Authenticate"), `error="invalid_token"`) {
+		t.Errorf("Expected invalid_token challenge, got %q", w.Header().Get("WWW-Authenticate"))
+	}
+
+	req, _ = http.NewRequest("DELETE", "/v1/books/1", nil)
+	authorize(req, RoleReader)
+	w = serve(router, req)
+	decodeProblem(t, w, http.StatusForbidden, "insufficient_role")
+	if !strings.Contains(w.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`) {
+		t.Errorf("Expected insufficient_scope challenge, got %q", w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestRouterWithoutSecretRefusesWrites(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := setupRouter(NewMemoryBookRepository(defaultBooks()...))
+
+	req, _ := http.NewRequest("DELETE", "/v1/books/1", nil)
+	authorize(req, RoleAdmin)
+	decodeProblem(t, serve(router, req), http.StatusUnauthorized, "invalid_token")
+}
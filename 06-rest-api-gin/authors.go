@@ -0,0 +1,547 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// ErrAuthorNotFound is returned when no author exists with the requested ID
+	ErrAuthorNotFound = errors.New("author not found")
+	// ErrAuthorHasBooks is returned when deleting an author who is still
+	// credited on at least one book
+	ErrAuthorHasBooks = errors.New("author still has books")
+	// ErrAuthorRequired is returned for a book with neither an author
+	// byline nor author IDs
+	ErrAuthorRequired = errors.New("author or author_ids is required")
+)
+
+// UnknownAuthorError reports an author ID on a book that does not exist
+type UnknownAuthorError struct {
+	ID int
+}
+
+func (e *UnknownAuthorError) Error() string {
+	return fmt.Sprintf("unknown author id %d", e.ID)
+}
+
+func (e *UnknownAuthorError) Unwrap() error { return ErrAuthorNotFound }
+
+// Author is a person credited on one or more books
+type Author struct {
+	ID   int    `json:"id"`
+	Name string `json:"name" binding:"required"`
+	Bio  string `json:"bio,omitempty"`
+}
+
+// AuthorService stores authors and owns the book-author relation. The
+// relation itself lives on Book.AuthorIDs; the service makes sure those
+// IDs always point at real authors. Given a StateStore, authors are
+// saved there after every change.
+//
+// Book writes that carry author IDs run under the read lock (see Link)
+// and author deletes take the write lock, so an author can never be
+// removed while a book referencing them is being saved.
+type AuthorService struct {
+	mu      sync.RWMutex
+	books   BookRepository
+	store   StateStore // nil keeps authors in memory only
+	authors map[int]Author
+	nextID  int
+}
+
+// authorStateName is the AuthorService's document in a StateStore
+const authorStateName = "authors"
+
+// authorState is what the AuthorService saves in its StateStore
+type authorState struct {
+	NextID  int      `json:"next_id"`
+	Authors []Author `json:"authors"`
+}
+
+// NewAuthorService creates an author store linked to books, restoring
+// any authors saved in store. store may be nil.
+//
+// New IDs start above every author ID a book credits, saved or not, so
+// a new author can never take over an old author's books.
+func NewAuthorService(books BookRepository, store StateStore) (*AuthorService, error) {
+	s := &AuthorService{
+		books:   books,
+		store:   store,
+		authors: make(map[int]Author),
+		nextID:  1,
+	}
+	if store != nil {
+		var state authorState
+		if _, err := store.LoadState(authorStateName, &state); err != nil {
+			return nil, err
+		}
+		for _, a := range state.Authors {
+			s.authors[a.ID] = a
+			s.nextID = max(s.nextID, a.ID+1)
+		}
+		s.nextID = max(s.nextID, state.NextID)
+	}
+
+	all, err := books.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range all {
+		for _, id := range b.AuthorIDs {
+			s.nextID = max(s.nextID, id+1)
+		}
+	}
+	return s, nil
+}
+
+// save persists the authors, if there is a store. Callers must hold the
+// write lock and undo their change when it fails.
+func (s *AuthorService) save() error {
+	if s.store == nil {
+		return nil
+	}
+	state := authorState{NextID: s.nextID, Authors: make([]Author, 0, len(s.authors))}
+	for _, a := range s.authors {
+		state.Authors = append(state.Authors, a)
+	}
+	sort.Slice(state.Authors, func(i, j int) bool { return state.Authors[i].ID < state.Authors[j].ID })
+	return s.store.SaveState(authorStateName, state)
+}
+
+func (s *AuthorService) List() []Author {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Author, 0, len(s.authors))
+	for _, a := range s.authors {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (s *AuthorService) Get(id int) (Author, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	a, ok := s.authors[id]
+	if !ok {
+		return Author{}, ErrAuthorNotFound
+	}
+	return a, nil
+}
+
+func (s *AuthorService) Create(a Author) (Author, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a.ID = s.nextID
+	s.nextID++
+	s.authors[a.ID] = a
+	if err := s.save(); err != nil {
+		delete(s.authors, a.ID)
+		s.nextID--
+		return Author{}, err
+	}
+	return a, nil
+}
+
+// Update renames an author and refreshes the byline of every book
+// crediting them. The books are rewritten before the author is saved;
+// if any of them cannot be, the rename is undone.
+func (s *AuthorService) Update(id int, a Author) (Author, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.authors[id]
+	if !ok {
+		return Author{}, ErrAuthorNotFound
+	}
+	books, err := s.booksBy(id)
+	if err != nil {
+		return Author{}, err
+	}
+
+	// Nobody else can read the author until the lock is released, so
+	// the new name is only visible once everything is saved
+	a.ID = id
+	s.authors[id] = a
+	saved, err := s.relink(books, func(*Book) {})
+	if err == nil {
+		err = s.save()
+	}
+	if err != nil {
+		s.authors[id] = old
+		s.unlink(books, saved)
+		return Author{}, err
+	}
+	return a, nil
+}
+
+// Delete removes an author who is no longer credited on any live book.
+// Deleted books that still credit them lose the credit but keep the
+// byline as free text, so restoring one never leaves a dangling ID.
+func (s *AuthorService) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.authors[id]
+	if !ok {
+		return ErrAuthorNotFound
+	}
+	books, err := s.booksBy(id)
+	if err != nil {
+		return err
+	}
+	for _, b := range books {
+		if !b.Deleted() {
+			return ErrAuthorHasBooks
+		}
+	}
+
+	saved, err := s.relink(books, func(b *Book) {
+		ids := make([]int, 0, len(b.AuthorIDs))
+		for _, aid := range b.AuthorIDs {
+			if aid != id {
+				ids = append(ids, aid)
+			}
+		}
+		b.AuthorIDs = ids // with no IDs left the old byline stays
+	})
+	if err != nil {
+		s.unlink(books, saved)
+		return err
+	}
+	delete(s.authors, id)
+	if err := s.save(); err != nil {
+		s.authors[id] = old
+		s.unlink(books, saved)
+		return err
+	}
+	return nil
+}
+
+// relinkAttempts is how many times relink tries to save one book that
+// keeps changing under it
+const relinkAttempts = 5
+
+// relink applies edit to each book, re-resolves its byline and saves it.
+// A book changed by another write in the meantime is read again and
+// retried. It returns the IDs of the books it saved. Callers must hold
+// the write lock.
+func (s *AuthorService) relink(books []Book, edit func(*Book)) ([]int, error) {
+	var saved []int
+	for _, b := range books {
+		for attempt := 1; ; attempt++ {
+			edit(&b)
+			if err := s.resolve(&b); err != nil {
+				return saved, err
+			}
+			_, err := s.books.Update(b.ID, b, b.Version)
+			if err == nil {
+				saved = append(saved, b.ID)
+				break
+			}
+			if errors.Is(err, ErrBookNotFound) {
+				break
+			}
+			if !errors.Is(err, ErrVersionConflict) || attempt == relinkAttempts {
+				return saved, err
+			}
+			if b, err = s.books.Get(b.ID); err != nil {
+				return saved, err
+			}
+		}
+	}
+	return saved, nil
+}
+
+// unlink puts back the credits and bylines of the books relink saved,
+// after the author change itself has been undone. It is best effort:
+// the error that caused the undo is the one worth reporting.
+func (s *AuthorService) unlink(books []Book, saved []int) {
+	credits := make(map[int][]int, len(books))
+	for _, b := range books {
+		credits[b.ID] = b.AuthorIDs
+	}
+	current := make([]Book, 0, len(saved))
+	for _, id := range saved {
+		if b, err := s.books.Get(id); err == nil {
+			current = append(current, b)
+		}
+	}
+	s.relink(current, func(b *Book) { b.AuthorIDs = credits[b.ID] })
+}
+
+// Books lists every live book crediting the author
+func (s *AuthorService) Books(id int) ([]Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.authors[id]; !ok {
+		return nil, ErrAuthorNotFound
+	}
+	all, err := s.booksBy(id)
+	if err != nil {
+		return nil, err
+	}
+	books := []Book{}
+	for _, b := range all {
+		if !b.Deleted() {
+			books = append(books, b)
+		}
+	}
+	return books, nil
+}
+
+// Expand returns the authors credited on a book, in credit order
+func (s *AuthorService) Expand(b Book) []Author {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	authors := make([]Author, 0, len(b.AuthorIDs))
+	for _, id := range b.AuthorIDs {
+		if a, ok := s.authors[id]; ok {
+			authors = append(authors, a)
+		}
+	}
+	return authors
+}
+
+// Resolve checks a book's author IDs and derives its byline from them
+func (s *AuthorService) Resolve(b *Book) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.resolve(b)
+}
+
+// Link resolves every book and then runs write while still holding the
+// read lock, so none of the referenced authors can be deleted before
+// the write lands
+func (s *AuthorService) Link(write func() error, books ...*Book) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, b := range books {
+		if err := s.resolve(b); err != nil {
+			return err
+		}
+	}
+	return write()
+}
+
+// resolve de-duplicates AuthorIDs, rejects unknown ones and sets the
+// Author byline to the credited names, e.g. "Donovan & Kernighan".
+// Books without author IDs keep their free-text byline. Callers must
+// hold at least the read lock.
+func (s *AuthorService) resolve(b *Book) error {
+	if len(b.AuthorIDs) == 0 {
+		b.AuthorIDs = nil
+		if strings.TrimSpace(b.Author) == "" {
+			return ErrAuthorRequired
+		}
+		return nil
+	}
+
+	seen := make(map[int]bool)
+	ids := make([]int, 0, len(b.AuthorIDs))
+	names := make([]string, 0, len(b.AuthorIDs))
+	for _, id := range b.AuthorIDs {
+		if seen[id] {
+			continue
+		}
+		a, ok := s.authors[id]
+		if !ok {
+			return &UnknownAuthorError{ID: id}
+		}
+		seen[id] = true
+		ids = append(ids, id)
+		names = append(names, a.Name)
+	}
+	b.AuthorIDs = ids
+	b.Author = strings.Join(names, bylineSeparator)
+	return nil
+}
+
+// booksBy scans the catalogue for books crediting an author, deleted
+// ones included so their bylines stay current for a restore. Callers
+// must hold the lock.
+func (s *AuthorService) booksBy(id int) ([]Book, error) {
+	all, err := s.books.List()
+	if err != nil {
+		return nil, err
+	}
+	books := []Book{}
+	for _, b := range all {
+		for _, aid := range b.AuthorIDs {
+			if aid == id {
+				books = append(books, b)
+				break
+			}
+		}
+	}
+	return books, nil
+}
+
+// bookWithAuthors is the ?include=authors representation of a book
+type bookWithAuthors struct {
+	Book
+	Authors []Author `json:"authors"`
+}
+
+// parseIncludes validates ?include=; only "authors" is supported. When
+// ok is false the 400 response has already been written.
+func parseIncludes(c *gin.Context) (includeAuthors, ok bool) {
+	raw := c.Query("include")
+	if raw == "" {
+		return false, true
+	}
+	for _, inc := range strings.Split(raw, ",") {
+		if strings.TrimSpace(inc) != "authors" {
+			respondProblem(c, http.StatusBadRequest, "invalid_query", "Invalid query parameters",
+				Violation{Field: "include", Rule: "oneof", Message: fmt.Sprintf("unknown include %q", inc)})
+			return false, false
+		}
+	}
+	return true, true
+}
+
+// authorHandler serves the /authors routes
+type authorHandler struct {
+	authors *AuthorService
+	books   *bookHandler // renders books in the API version's shape
+}
+
+func (h *authorHandler) getAuthors(c *gin.Context) {
+	c.JSON(http.StatusOK, h.authors.List())
+}
+
+func (h *authorHandler) getAuthor(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	author, err := h.authors.Get(id)
+	if err != nil {
+		respondAuthorError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, author)
+}
+
+func (h *authorHandler) createAuthor(c *gin.Context) {
+	var author Author
+	if err := c.ShouldBindJSON(&author); err != nil {
+		respondInvalid(c, http.StatusBadRequest, err)
+		return
+	}
+	created, err := h.authors.Create(author)
+	if err != nil {
+		respondAuthorError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+func (h *authorHandler) updateAuthor(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	var author Author
+	if err := c.ShouldBindJSON(&author); err != nil {
+		respondInvalid(c, http.StatusBadRequest, err)
+		return
+	}
+
+	updated, err := h.authors.Update(id, author)
+	if err != nil {
+		respondAuthorChangeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+func (h *authorHandler) deleteAuthor(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.authors.Delete(id); err != nil {
+		respondAuthorChangeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Author deleted"})
+}
+
+func (h *authorHandler) getAuthorBooks(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	fields, ok := parseFields(c, bookMembers(h.books.codec))
+	if !ok {
+		return
+	}
+
+	books, err := h.authors.Books(id)
+	if err != nil {
+		respondAuthorError(c, err)
+		return
+	}
+	body := make([]bookView, len(books))
+	for i, b := range books {
+		body[i] = h.books.view(b, false, fields)
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// respondAuthorError maps author errors to HTTP responses
+func respondAuthorError(c *gin.Context, err error) {
+	var unknown *UnknownAuthorError
+	switch {
+	case errors.As(err, &unknown), errors.Is(err, ErrAuthorRequired):
+		// The request names an author that does not exist: the book
+		// itself is fine, but the reference cannot be processed
+		respondProblem(c, http.StatusUnprocessableEntity, "validation_failed", "The request did not pass validation",
+			authorViolation(err))
+	case errors.Is(err, ErrAuthorNotFound):
+		respondProblem(c, http.StatusNotFound, "author_not_found", "Author not found")
+	case errors.Is(err, ErrAuthorHasBooks):
+		respondProblem(c, http.StatusConflict, "author_has_books", err.Error())
+	default:
+		respondRepoError(c, err)
+	}
+}
+
+// respondAuthorChangeError maps errors from renaming or deleting an
+// author. Those requests carry no If-Match, so a book that kept changing
+// while its byline was rewritten is a conflict to retry, not a failed
+// precondition.
+func respondAuthorChangeError(c *gin.Context, err error) {
+	if errors.Is(err, ErrVersionConflict) {
+		respondProblem(c, http.StatusConflict, "concurrent_modification", "A book was modified concurrently, retry the request")
+		return
+	}
+	respondAuthorError(c, err)
+}
+
+// authorViolation describes a book's bad author reference as a field
+// violation
+func authorViolation(err error) Violation {
+	if errors.Is(err, ErrAuthorRequired) {
+		return Violation{Field: "author", Rule: "required_without", Message: err.Error()}
+	}
+	return Violation{Field: "author_ids", Rule: "exists", Message: err.Error()}
+}
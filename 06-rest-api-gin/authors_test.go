@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func doJSON(router *gin.Engine, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, &buf)
+	authorize(req, RoleAdmin)
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func createAuthor(t *testing.T, router *gin.Engine, name string) Author {
+	t.Helper()
+	w := doJSON(router, "POST", "/v1/authors", Author{Name: name})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201 creating author, got %d", w.Code)
+	}
+	var a Author
+	json.Unmarshal(w.Body.Bytes(), &a)
+	return a
+}
+
+func TestAuthorCRUD(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	a := createAuthor(t, router, "Alan Donovan")
+
+	if w := doJSON(router, "GET", "/v1/authors/1", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+	if w := doJSON(router, "POST", "/v1/authors", map[string]string{"bio": "no name"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without name, got %d", w.Code)
+	}
+
+	w := doJSON(router, "PUT", "/v1/authors/1", Author{Name: "Alan A. A. Donovan"})
+	var updated Author
+	json.Unmarshal(w.Body.Bytes(), &updated)
+	if updated.ID != a.ID || updated.Name != "Alan A. A. Donovan" {
+		t.Errorf("Unexpected updated author %+v", updated)
+	}
+
+	if w := doJSON(router, "DELETE", "/v1/authors/1", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 deleting author, got %d", w.Code)
+	}
+	if w := doJSON(router, "GET", "/v1/authors/1", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestBookWithCoAuthors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	donovan := createAuthor(t, router, "Alan Donovan")
+	kernighan := createAuthor(t, router, "Brian Kernighan")
+
+	w := doJSON(router, "POST", "/v1/books", map[string]interface{}{
+		"title":      "The Go Programming Language",
+		"year":       2015,
+		"author_ids": []int{donovan.ID, kernighan.ID, donovan.ID},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var book Book
+	json.Unmarshal(w.Body.Bytes(), &book)
+	if book.Author != "Alan Donovan & Brian Kernighan" {
+		t.Errorf("Expected byline derived from authors, got %q", book.Author)
+	}
+	if len(book.AuthorIDs) != 2 {
+		t.Errorf("Expected duplicate author IDs to collapse, got %v", book.AuthorIDs)
+	}
+
+	// Both authors list the book
+	for _, a := range []Author{donovan, kernighan} {
+		w := doJSON(router, "GET", "/v1/authors/"+strconv.Itoa(a.ID)+"/books", nil)
+		var books []Book
+		json.Unmarshal(w.Body.Bytes(), &books)
+		if len(books) != 1 || books[0].ID != book.ID {
+			t.Errorf("Expected author %d to have book %d, got %+v", a.ID, book.ID, books)
+		}
+	}
+
+	// Renaming an author refreshes the byline
+	doJSON(router, "PUT", "/v1/authors/"+strconv.Itoa(kernighan.ID), Author{Name: "Brian W. Kernighan"})
+	w = doJSON(router, "GET", "/v1/books/"+strconv.Itoa(book.ID), nil)
+	json.Unmarshal(w.Body.Bytes(), &book)
+	if book.Author != "Alan Donovan & Brian W. Kernighan" {
+		t.Errorf("Expected byline to follow rename, got %q", book.Author)
+	}
+}
+
+func TestIncludeAuthors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	a := createAuthor(t, router, "Robert Martin")
+	doJSON(router, "PUT", "/v1/books/2", map[string]interface{}{
+		"title": "Clean Code", "year": 2008, "author_ids": []int{a.ID},
+	})
+
+	w := doJSON(router, "GET", "/v1/books/2?include=authors", nil)
+	var expanded struct {
+		Book
+		Authors []Author `json:"authors"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &expanded)
+	if len(expanded.Authors) != 1 || expanded.Authors[0].Name != "Robert Martin" {
+		t.Errorf("Expected expanded authors, got %+v", expanded.Authors)
+	}
+
+	w = doJSON(router, "GET", "/v1/books?include=authors", nil)
+	var list []struct {
+		ID      int      `json:"id"`
+		Authors []Author `json:"authors"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 2 || len(list[0].Authors) != 0 || len(list[1].Authors) != 1 {
+		t.Errorf("Unexpected expanded list %+v", list)
+	}
+
+	if w := doJSON(router, "GET", "/v1/books/2?include=reviews", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for unknown include, got %d", w.Code)
+	}
+}
+
+func TestBookWithUnknownAuthor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w := doJSON(router, "POST", "/v1/books", map[string]interface{}{
+		"title": "Ghost Written", "year": 2020, "author_ids": []int{42},
+	})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for unknown author, got %d", w.Code)
+	}
+
+	w = doJSON(router, "POST", "/v1/books", map[string]interface{}{"title": "Anonymous", "year": 2020})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 with neither author nor author_ids, got %d", w.Code)
+	}
+}
+
+func TestDeleteAuthorWithBooks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	a := createAuthor(t, router, "Martin Fowler")
+	w := doJSON(router, "POST", "/v1/books", map[string]interface{}{
+		"title": "Refactoring", "year": 1999, "author_ids": []int{a.ID},
+	})
+	var book Book
+	json.Unmarshal(w.Body.Bytes(), &book)
+
+	if w := doJSON(router, "DELETE", "/v1/authors/"+strconv.Itoa(a.ID), nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 deleting an author with books, got %d", w.Code)
+	}
+
+	doJSON(router, "DELETE", "/v1/books/"+strconv.Itoa(book.ID), nil)
+	if w := doJSON(router, "DELETE", "/v1/authors/"+strconv.Itoa(a.ID), nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 once the author has no books, got %d", w.Code)
+	}
+}
+
+func TestAuthorsSurviveRestart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	path := filepath.Join(t.TempDir(), "books.json")
+	restart := func() *gin.Engine {
+		t.Helper()
+		repo, err := NewFileBookRepository(path, defaultBooks()...)
+		if err != nil {
+			t.Fatalf("NewFileBookRepository: %v", err)
+		}
+		return setupRouter(repo, WithAuthSecret(testSecret))
+	}
+
+	router := restart()
+	author := createAuthor(t, router, "Ursula K. Le Guin")
+	doJSON(router, "POST", "/v1/books", Book{Title: "The Dispossessed", Year: 1974, AuthorIDs: []int{author.ID}})
+
+	router = restart()
+	w := doJSON(router, "GET", "/v1/authors/"+strconv.Itoa(author.ID), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the author after a restart, got %d", w.Code)
+	}
+	if next := createAuthor(t, router, "Someone Else"); next.ID == author.ID {
+		t.Errorf("Expected a new ID, got %d again", next.ID)
+	}
+}
+
+func TestNewAuthorIDsSkipCreditedOnes(t *testing.T) {
+	// Books saved before authors were persisted still credit old IDs
+	repo := NewMemoryBookRepository(Book{Title: "Orphaned", Author: "Gone", Year: 2000, AuthorIDs: []int{5}})
+	authors, err := NewAuthorService(repo, nil)
+	if err != nil {
+		t.Fatalf("NewAuthorService: %v", err)
+	}
+	a, err := authors.Create(Author{Name: "New"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if a.ID != 6 {
+		t.Errorf("Expected ID 6 above the credited author 5, got %d", a.ID)
+	}
+}
+
+// conflictingRepository fails updates to one book with a version
+// conflict, as if another write kept getting there first. A negative
+// failures count fails them forever.
+type conflictingRepository struct {
+	*MemoryBookRepository
+	bookID   int
+	failures int
+}
+
+func (r *conflictingRepository) Update(id int, b Book, version int) (Book, error) {
+	if id == r.bookID && r.failures != 0 {
+		r.failures--
+		return Book{}, ErrVersionConflict
+	}
+	return r.MemoryBookRepository.Update(id, b, version)
+}
+
+func TestRenameAuthorWithConflictingBook(t *testing.T) {
+	repo := &conflictingRepository{MemoryBookRepository: NewMemoryBookRepository()}
+	authors, _ := NewAuthorService(repo, nil)
+	a, _ := authors.Create(Author{Name: "Old"})
+	first, _ := repo.Create(Book{Title: "First", Author: "Old", Year: 2001, AuthorIDs: []int{a.ID}})
+	second, _ := repo.Create(Book{Title: "Second", Author: "Old", Year: 2002, AuthorIDs: []int{a.ID}})
+
+	// A book that never settles undoes the whole rename
+	repo.bookID, repo.failures = second.ID, -1
+	if _, err := authors.Update(a.ID, Author{Name: "New"}); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("Expected a version conflict, got %v", err)
+	}
+	if got, _ := authors.Get(a.ID); got.Name != "Old" {
+		t.Errorf("Expected the author to keep the old name, got %q", got.Name)
+	}
+	if got, _ := repo.Get(first.ID); got.Author != "Old" {
+		t.Errorf("Expected the first book's byline to be put back, got %q", got.Author)
+	}
+
+	// A book that settles after a retry or two is renamed with the rest
+	repo.failures = 2
+	if _, err := authors.Update(a.ID, Author{Name: "New"}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	for _, id := range []int{first.ID, second.ID} {
+		if got, _ := repo.Get(id); got.Author != "New" {
+			t.Errorf("Book %d: expected the new byline, got %q", id, got.Author)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	maxImportBytes   = 10 << 20 // 10 MB per import request
+	maxNDJSONLine    = 1 << 20  // 1 MB per NDJSON record
+	exportFlushEvery = 100      // rows written between flushes
+)
+
+// Import modes
+const (
+	importAllOrNothing = "all_or_nothing"
+	importBestEffort   = "best_effort"
+)
+
+// csvColumns is the column order used by the CSV export. Imports match
+// columns by header name, so any order works and id/version are ignored.
+var csvColumns = []string{"id", "title", "author", "year", "isbn"}
+
+// importRow is one decoded record from an import file
+type importRow struct {
+	line int
+	book Book
+	err  error // set when the record could not be decoded at all
+}
+
+// rowError lists everything wrong with one record
+type rowError struct {
+	Line       int         `json:"line"`
+	Violations []Violation `json:"violations"`
+}
+
+// importResult is the response body for POST /books/import. In a dry
+// run Imported counts the books that would have been created.
+type importResult struct {
+	DryRun   bool       `json:"dry_run"`
+	Mode     string     `json:"mode"`
+	Total    int        `json:"total"`
+	Imported int        `json:"imported"`
+	Failed   int        `json:"failed"`
+	IDs      []int      `json:"ids,omitempty"`
+	Errors   []rowError `json:"errors,omitempty"`
+}
+
+func (h *bookHandler) importBooks(c *gin.Context) {
+	mode := c.DefaultQuery("mode", importAllOrNothing)
+	if mode != importAllOrNothing && mode != importBestEffort {
+		respondProblem(c, http.StatusBadRequest, "invalid_query", "Invalid query parameters",
+			Violation{Field: "mode", Rule: "oneof", Message: "mode must be all_or_nothing or best_effort"})
+		return
+	}
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		respondProblem(c, http.StatusBadRequest, "invalid_query", "Invalid query parameters",
+			Violation{Field: "dry_run", Rule: "boolean", Message: "dry_run must be true or false"})
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	var rows []importRow
+	switch c.ContentType() {
+	case "text/csv":
+		rows, err = readCSVBooks(body)
+	case "application/x-ndjson", "application/ndjson":
+		rows, err = readNDJSONBooks(body, h.codec)
+	default:
+		respondProblem(c, http.StatusUnsupportedMediaType, "unsupported_media_type", "Content-Type must be text/csv or application/x-ndjson")
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondProblem(c, http.StatusRequestEntityTooLarge, "import_too_large", fmt.Sprintf("Import is larger than %d bytes", tooLarge.Limit))
+		return
+	}
+	if err != nil {
+		respondProblem(c, http.StatusBadRequest, "malformed_body", err.Error())
+		return
+	}
+	if len(rows) == 0 {
+		respondProblem(c, http.StatusBadRequest, "empty_import", "Import contains no books")
+		return
+	}
+
+	result := importResult{DryRun: dryRun, Mode: mode, Total: len(rows)}
+	valid, validLines := h.validateImport(rows, &result)
+	repo := h.repo.As(subject(c))
+
+	switch {
+	case mode == importAllOrNothing && result.Failed > 0:
+		// One bad row rejects the whole file
+	case dryRun:
+		result.Imported = len(valid)
+	case mode == importAllOrNothing:
+		var created []Book
+		err := h.authors.Link(func() error {
+			var err error
+			created, err = repo.CreateMany(valid)
+			return err
+		}, bookPointers(valid)...)
+		if err != nil {
+			respondAuthorError(c, err)
+			return
+		}
+		for _, b := range created {
+			result.IDs = append(result.IDs, b.ID)
+		}
+		result.Imported = len(created)
+	default:
+		for i, b := range valid {
+			var created Book
+			err := h.authors.Link(func() error {
+				var err error
+				created, err = repo.Create(b)
+				return err
+			}, &b)
+			if err != nil {
+				// Lost a race with another writer since validation
+				result.Errors = append(result.Errors, rowError{Line: validLines[i], Violations: rowViolations(err)})
+				result.Failed++
+				continue
+			}
+			result.IDs = append(result.IDs, created.ID)
+			result.Imported++
+		}
+	}
+
+	if result.Imported == 0 && result.Failed > 0 {
+		// Nothing was imported: report a problem, keeping the per-row
+		// breakdown as extension members
+		p := newProblem(c, http.StatusUnprocessableEntity, "import_failed",
+			fmt.Sprintf("%d of %d books failed validation", result.Failed, result.Total))
+		p.Extensions = map[string]interface{}{
+			"dry_run":  result.DryRun,
+			"mode":     result.Mode,
+			"total":    result.Total,
+			"imported": result.Imported,
+			"failed":   result.Failed,
+			"errors":   result.Errors,
+		}
+		writeProblem(c, p)
+		return
+	}
+
+	status := http.StatusCreated
+	if dryRun {
+		status = http.StatusOK
+	}
+	c.JSON(status, result)
+}
+
+// validateImport applies the same rules as createBook to every row and
+// also rejects ISBNs that clash with the catalogue or an earlier row.
+// It returns the books that passed along with their line numbers.
+func (h *bookHandler) validateImport(rows []importRow, result *importResult) ([]Book, []int) {
+	var valid []Book
+	var lines []int
+	seenISBN := make(map[string]int)
+
+	for _, row := range rows {
+		var violations []Violation
+		book := row.book
+
+		switch {
+		case row.err != nil:
+			violations = append(violations, rowViolations(row.err)...)
+		default:
+			if err := binding.Validator.ValidateStruct(&book); err != nil {
+				violations = append(violations, violationsFrom(err)...)
+			}
+			if err := book.normalize(); err != nil {
+				violations = append(violations, violationsFrom(err)...)
+			}
+			if err := h.authors.Resolve(&book); err != nil {
+				violations = append(violations, authorViolation(err))
+			}
+		}
+
+		if len(violations) == 0 && book.ISBN != "" {
+			if line, ok := seenISBN[book.ISBN]; ok {
+				violations = append(violations, Violation{Field: "isbn", Rule: "unique",
+					Message: fmt.Sprintf("isbn %s duplicates line %d", book.ISBN, line)})
+			} else if _, err := h.repo.GetByISBN(book.ISBN); err == nil {
+				violations = append(violations, Violation{Field: "isbn", Rule: "unique", Message: ErrDuplicateISBN.Error()})
+			}
+			seenISBN[book.ISBN] = row.line
+		}
+
+		if len(violations) > 0 {
+			result.Errors = append(result.Errors, rowError{Line: row.line, Violations: violations})
+			result.Failed++
+			continue
+		}
+		valid = append(valid, book)
+		lines = append(lines, row.line)
+	}
+	return valid, lines
+}
+
+func bookPointers(books []Book) []*Book {
+	ptrs := make([]*Book, len(books))
+	for i := range books {
+		ptrs[i] = &books[i]
+	}
+	return ptrs
+}
+
+// rowViolations describes a record that failed to decode or save. Errors
+// that do not point at a single field become a field-less violation.
+func rowViolations(err error) []Violation {
+	if violations := violationsFrom(err); len(violations) > 0 {
+		return violations
+	}
+	return []Violation{{Rule: "decode", Message: err.Error()}}
+}
+
+// readCSVBooks decodes a CSV import. The first line is a header naming
+// the columns; title, author and year are required.
+func readCSVBooks(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1 // short rows are reported per row, not fatal
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("csv header: %w", err)
+	}
+
+	index := make(map[string]int)
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"title", "author", "year"} {
+		if _, ok := index[required]; !ok {
+			return nil, fmt.Errorf("csv header is missing the %q column", required)
+		}
+	}
+
+	var rows []importRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, importRow{line: parseErr.Line, err: parseErr.Err})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := cr.FieldPos(0)
+		field := func(name string) string {
+			i, ok := index[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		row := importRow{line: line, book: Book{
+			Title:  field("title"),
+			Author: field("author"),
+			ISBN:   field("isbn"),
+		}}
+		if year := field("year"); year != "" {
+			if row.book.Year, err = strconv.Atoi(year); err != nil {
+				row.err = &FieldError{Violation: Violation{Field: "year", Rule: "type", Message: fmt.Sprintf("year %q is not a number", year)}, Err: err}
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// readNDJSONBooks decodes newline-delimited JSON, one book per line in
+// the codec's representation. Blank lines are skipped.
+func readNDJSONBooks(r io.Reader, codec bookCodec) ([]importRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxNDJSONLine)
+
+	var rows []importRow
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		row := importRow{line: line}
+		book, err := codec.decode([]byte(text))
+		var syntaxErr *json.SyntaxError
+		switch {
+		case errors.As(err, &syntaxErr):
+			row.err = fmt.Errorf("invalid JSON: %v", err)
+		case err != nil:
+			row.err = err
+		default:
+			row.book = book
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// exportBooks streams the catalogue as CSV or NDJSON. Rows are encoded
+// straight onto the response and flushed in batches, so the encoded
+// export is never held in memory as a whole.
+func (h *bookHandler) exportBooks(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "ndjson" {
+		respondProblem(c, http.StatusBadRequest, "invalid_query", "Invalid query parameters",
+			Violation{Field: "format", Rule: "oneof", Message: "format must be csv or ndjson"})
+		return
+	}
+
+	all, err := h.repo.List()
+	if err != nil {
+		respondRepoError(c, err)
+		return
+	}
+	books := all[:0]
+	for _, b := range all {
+		if !b.Deleted() {
+			books = append(books, b)
+		}
+	}
+
+	contentType := "text/csv"
+	if format == "ndjson" {
+		contentType = "application/x-ndjson"
+	}
+	c.Header("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "utf-8"}))
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "books." + format}))
+	c.Status(http.StatusOK)
+
+	if format == "csv" {
+		writeCSVBooks(c.Writer, books)
+	} else {
+		writeNDJSONBooks(c.Writer, books, h.codec)
+	}
+}
+
+func writeCSVBooks(w gin.ResponseWriter, books []Book) {
+	cw := csv.NewWriter(w)
+	cw.Write(csvColumns)
+	for i, b := range books {
+		cw.Write([]string{strconv.Itoa(b.ID), b.Title, b.Author, strconv.Itoa(b.Year), b.ISBN})
+		if (i+1)%exportFlushEvery == 0 {
+			cw.Flush()
+			w.Flush()
+		}
+	}
+	cw.Flush()
+}
+
+func writeNDJSONBooks(w gin.ResponseWriter, books []Book, codec bookCodec) {
+	enc := json.NewEncoder(w) // Encode appends the newline for us
+	for i, b := range books {
+		if err := enc.Encode(codec.encode(b)); err != nil {
+			return // client went away
+		}
+		if (i+1)%exportFlushEvery == 0 {
+			w.Flush()
+		}
+	}
+}
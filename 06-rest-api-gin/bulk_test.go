@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func importRequest(router *gin.Engine, query, contentType, body string) (*httptest.ResponseRecorder, importResult) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/books/import"+query, strings.NewReader(body))
+	authorize(req, RoleAdmin)
+	req.Header.Set("Content-Type", contentType)
+	router.ServeHTTP(w, req)
+
+	var result importResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w, result
+}
+
+func countBooks(t *testing.T, router *gin.Engine) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books?per_page=100", nil)
+	router.ServeHTTP(w, req)
+	var books []Book
+	json.Unmarshal(w.Body.Bytes(), &books)
+	return len(books)
+}
+
+const validCSV = `title,author,year,isbn
+Refactoring,Martin Fowler,1999,
+"Design Patterns, Elements",Gamma et al.,1994,0-201-63361-2
+`
+
+const mixedNDJSON = `{"title":"Refactoring","author":"Martin Fowler","year":1999}
+
+{"title":"","author":"Nobody","year":2000}
+{"title":"Ancient","author":"Scribe","year":500}
+not json
+{"title":"Design Patterns","author":"Gamma et al.","year":1994,"isbn":"0201633612"}
+`
+
+func TestImportCSV(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w, result := importRequest(router, "", "text/csv", validCSV)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if result.Imported != 2 || len(result.IDs) != 2 {
+		t.Errorf("Expected 2 imported books, got %+v", result)
+	}
+	if got := countBooks(t, router); got != 4 {
+		t.Errorf("Expected 4 books after import, got %d", got)
+	}
+
+	// The ISBN went through the same normalisation as createBook
+	w2 := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books/isbn/9780201633610", nil)
+	router.ServeHTTP(w2, req)
+	if w2.Code != http.StatusOK {
+		t.Errorf("Expected imported ISBN to be found, got %d", w2.Code)
+	}
+}
+
+func TestImportAllOrNothing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w, result := importRequest(router, "", "application/x-ndjson", mixedNDJSON)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422, got %d", w.Code)
+	}
+	if result.Imported != 0 || result.Failed != 3 {
+		t.Errorf("Expected 0 imported and 3 failed, got %+v", result)
+	}
+
+	// Line numbers count the blank line too
+	wantLines := []int{3, 4, 5}
+	for i, e := range result.Errors {
+		if e.Line != wantLines[i] {
+			t.Errorf("Error %d: expected line %d, got %d", i, wantLines[i], e.Line)
+		}
+	}
+	if got := countBooks(t, router); got != 2 {
+		t.Errorf("Expected catalogue untouched with 2 books, got %d", got)
+	}
+}
+
+func TestImportBestEffort(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w, result := importRequest(router, "?mode=best_effort", "application/x-ndjson", mixedNDJSON)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", w.Code)
+	}
+	if result.Imported != 2 || result.Failed != 3 {
+		t.Errorf("Expected 2 imported and 3 failed, got %+v", result)
+	}
+	if got := countBooks(t, router); got != 4 {
+		t.Errorf("Expected 4 books after import, got %d", got)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w, result := importRequest(router, "?dry_run=true", "text/csv", validCSV)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if !result.DryRun || result.Imported != 2 || len(result.IDs) != 0 {
+		t.Errorf("Expected dry run reporting 2 importable books, got %+v", result)
+	}
+	if got := countBooks(t, router); got != 2 {
+		t.Errorf("Expected dry run to leave 2 books, got %d", got)
+	}
+}
+
+func TestImportDuplicateISBN(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	body := `title,author,year,isbn
+A,X,2000,9780132350884
+B,Y,2001,0132350882
+`
+	w, result := importRequest(router, "?mode=best_effort", "text/csv", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", w.Code)
+	}
+	if result.Imported != 1 || result.Failed != 1 || result.Errors[0].Line != 3 {
+		t.Errorf("Expected the second row to be rejected as duplicate, got %+v", result)
+	}
+}
+
+func TestImportBadRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{"unknown mode", "?mode=yolo", "text/csv", validCSV, http.StatusBadRequest},
+		{"bad dry_run", "?dry_run=maybe", "text/csv", validCSV, http.StatusBadRequest},
+		{"unsupported type", "", "application/json", "[]", http.StatusUnsupportedMediaType},
+		{"missing column", "", "text/csv", "title,author\nA,B\n", http.StatusBadRequest},
+		{"empty", "", "text/csv", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, _ := importRequest(router, tt.query, tt.contentType, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestExportBooks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	t.Run("csv", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books/export?format=csv", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+			t.Errorf("Expected text/csv, got %s", w.Header().Get("Content-Type"))
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("Invalid CSV: %v", err)
+		}
+		if len(records) != 3 || records[1][1] != "The Go Programming Language" {
+			t.Errorf("Unexpected CSV export: %v", records)
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books/export?format=ndjson", nil)
+		router.ServeHTTP(w, req)
+
+		lines := 0
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var b Book
+			if err := json.Unmarshal(scanner.Bytes(), &b); err != nil {
+				t.Fatalf("Invalid NDJSON line %q: %v", scanner.Text(), err)
+			}
+			lines++
+		}
+		if lines != 2 {
+			t.Errorf("Expected 2 lines, got %d", lines)
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books/export?format=xml", nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	source := newTestRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books/export?format=csv", nil)
+	source.ServeHTTP(w, req)
+
+	target := setupRouter(NewMemoryBookRepository(), WithAuthSecret(testSecret))
+	resp, result := importRequest(target, "", "text/csv", w.Body.String())
+	if resp.Code != http.StatusCreated || result.Imported != 2 {
+		t.Errorf("Expected exported CSV to import cleanly, got %d %+v", resp.Code, result)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	if w := doJSON(router, "DELETE", "/v1/books/1", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	// Hidden by default, visible on request
+	lists := map[string]int{"/v1/books": 1, "/v1/books?deleted=include": 2, "/v1/books?deleted=only": 1}
+	for path, want := range lists {
+		var books []Book
+		json.Unmarshal(doJSON(router, "GET", path, nil).Body.Bytes(), &books)
+		if len(books) != want {
+			t.Errorf("%s: expected %d books, got %d", path, want, len(books))
+		}
+	}
+	var deleted []Book
+	json.Unmarshal(doJSON(router, "GET", "/v1/books?deleted=only", nil).Body.Bytes(), &deleted)
+	if len(deleted) != 1 || deleted[0].ID != 1 || deleted[0].DeletedAt == nil {
+		t.Errorf("Expected book 1 with deleted_at, got %+v", deleted)
+	}
+	decodeProblem(t, doJSON(router, "GET", "/v1/books?deleted=maybe", nil), http.StatusBadRequest, "invalid_query")
+
+	// Reads and writes treat it as gone
+	decodeProblem(t, doJSON(router, "GET", "/v1/books/1", nil), http.StatusNotFound, "book_deleted")
+	decodeProblem(t, doJSON(router, "PUT", "/v1/books/1", Book{Title: "T", Author: "A", Year: 2000}), http.StatusNotFound, "book_deleted")
+	decodeProblem(t, doJSON(router, "DELETE", "/v1/books/1", nil), http.StatusNotFound, "book_deleted")
+	decodeProblem(t, doJSON(router, "POST", "/v1/books/1/checkout", map[string]string{"borrower_id": "alice"}),
+		http.StatusNotFound, "book_deleted")
+
+	w := doJSON(router, "POST", "/v1/books/1/restore", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected restore status 200, got %d", w.Code)
+	}
+	var restored Book
+	json.Unmarshal(w.Body.Bytes(), &restored)
+	if restored.Deleted() || restored.Version != 3 {
+		t.Errorf("Expected a live book at version 3, got %+v", restored)
+	}
+	if w := doJSON(router, "GET", "/v1/books/1", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected restored book to be readable, got %d", w.Code)
+	}
+
+	decodeProblem(t, doJSON(router, "POST", "/v1/books/1/restore", nil), http.StatusConflict, "book_not_deleted")
+	decodeProblem(t, doJSON(router, "POST", "/v1/books/999/restore", nil), http.StatusNotFound, "book_not_found")
+}
+
+func TestBookHistory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	repo := NewMemoryBookRepository()
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	repo.now = clock.Now
+	router := setupRouter(repo, WithAuthSecret(testSecret))
+
+	var book Book
+	json.Unmarshal(doJSON(router, "POST", "/v1/books", Book{Title: "Draft", Author: "A", Year: 2020}).Body.Bytes(), &book)
+	path := "/v1/books/" + strconv.Itoa(book.ID)
+
+	clock.Advance(time.Hour)
+	doJSON(router, "PUT", path, Book{Title: "Final", Author: "A", Year: 2021})
+	clock.Advance(time.Hour)
+	doJSON(router, "DELETE", path, nil)
+	clock.Advance(time.Hour)
+	doJSON(router, "POST", path+"/restore", nil)
+
+	w := doJSON(router, "GET", path+"/history", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var history []Change
+	json.Unmarshal(w.Body.Bytes(), &history)
+
+	wantActions := []string{ActionCreate, ActionUpdate, ActionDelete, ActionRestore}
+	if len(history) != len(wantActions) {
+		t.Fatalf("Expected %d changes, got %+v", len(wantActions), history)
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, c := range history {
+		if c.Action != wantActions[i] || c.Version != i+1 {
+			t.Errorf("Change %d: expected %s at version %d, got %s at %d", i, wantActions[i], i+1, c.Action, c.Version)
+		}
+		if !c.At.Equal(start.Add(time.Duration(i) * time.Hour)) {
+			t.Errorf("Change %d: unexpected timestamp %v", i, c.At)
+		}
+		if c.Actor != "test-admin" {
+			t.Errorf("Change %d: expected the token subject as actor, got %q", i, c.Actor)
+		}
+		if c.After == nil || (i == 0) != (c.Before == nil) {
+			t.Errorf("Change %d: unexpected snapshots before=%v after=%v", i, c.Before, c.After)
+		}
+	}
+
+	update := history[1]
+	if update.Before.Title != "Draft" || update.After.Title != "Final" {
+		t.Errorf("Expected update from Draft to Final, got %s -> %s", update.Before.Title, update.After.Title)
+	}
+	if history[2].After.DeletedAt == nil || history[3].After.DeletedAt != nil {
+		t.Error("Expected delete to set deleted_at and restore to clear it")
+	}
+
+	decodeProblem(t, doJSON(router, "GET", "/v1/books/999/history", nil), http.StatusNotFound, "book_not_found")
+}
+
+func TestDeleteAuthorOfDeletedBook(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	a := createAuthor(t, router, "Martin Fowler")
+	var book Book
+	json.Unmarshal(doJSON(router, "POST", "/v1/books", map[string]interface{}{
+		"title": "Refactoring", "year": 1999, "author_ids": []int{a.ID},
+	}).Body.Bytes(), &book)
+	path := "/v1/books/" + strconv.Itoa(book.ID)
+
+	doJSON(router, "DELETE", path, nil)
+	if w := doJSON(router, "DELETE", "/v1/authors/"+strconv.Itoa(a.ID), nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected deleted books not to block the author delete, got %d", w.Code)
+	}
+
+	// The restored book keeps the byline but no longer points at the author
+	var restored Book
+	json.Unmarshal(doJSON(router, "POST", path+"/restore", nil).Body.Bytes(), &restored)
+	if len(restored.AuthorIDs) != 0 || restored.Author != "Martin Fowler" {
+		t.Errorf("Expected free-text byline without author IDs, got %+v", restored)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	gopath "path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// link is a hypermedia link in the style of HAL. Method names the verb
+// to follow it with when that is not GET, Templated marks an RFC 6570
+// URI template such as /v2/books/{id}, and Role is the least role the
+// route accepts.
+type link struct {
+	Href      string `json:"href"`
+	Method    string `json:"method,omitempty"`
+	Templated bool   `json:"templated,omitempty"`
+	Role      Role   `json:"role,omitempty"`
+}
+
+// routeTable registers one version's routes and remembers each of them
+// as a link relation, so the index at GET / is generated from the
+// routes that actually exist
+type routeTable struct {
+	group *gin.RouterGroup
+	auth  *Authenticator
+	links map[string]link
+}
+
+func newRouteTable(group *gin.RouterGroup, auth *Authenticator) *routeTable {
+	return &routeTable{group: group, auth: auth, links: make(map[string]link)}
+}
+
+// pathParam matches gin's :name segments
+var pathParam = regexp.MustCompile(`:(\w+)`)
+
+// handle registers a route under the relation rel. A non-empty role puts
+// requireRole in front of the handlers.
+func (t *routeTable) handle(rel, method, path string, role Role, handlers ...gin.HandlerFunc) {
+	if _, dup := t.links[rel]; dup {
+		panic("duplicate link relation " + rel)
+	}
+	if role != "" {
+		handlers = append([]gin.HandlerFunc{requireRole(t.auth, role)}, handlers...)
+	}
+	t.group.Handle(method, path, handlers...)
+
+	full := gopath.Join(t.group.BasePath(), path)
+	l := link{Href: pathParam.ReplaceAllString(full, "{$1}"), Role: role}
+	l.Templated = l.Href != full
+	if method != http.MethodGet {
+		l.Method = method
+	}
+	t.links[rel] = l
+}
+
+// apiVersion is one mounted version of the API as listed by GET /
+type apiVersion struct {
+	Status string          `json:"status"`
+	Sunset string          `json:"sunset,omitempty"`
+	Links  map[string]link `json:"_links"`
+}
+
+// homeHandler is the API index: every version with the link relations
+// it serves
+func homeHandler(versions map[string]*apiVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Welcome to Book API",
+			"_links":   gin.H{"self": link{Href: "/"}, "service-desc": link{Href: "/openapi.json"}},
+			"versions": versions,
+		})
+	}
+}
+
+// bookLinks are the links on a single book. A deleted book can only be
+// restored; a live one can be updated and deleted, and links to its
+// loans once it has been checked out.
+func (h *bookHandler) bookLinks(b Book) map[string]link {
+	self := h.base + "/books/" + strconv.Itoa(b.ID)
+	links := map[string]link{"self": {Href: self}}
+	if b.Deleted() {
+		links["restore"] = link{Href: self + "/restore", Method: http.MethodPost, Role: RoleAdmin}
+		return links
+	}
+	links["update"] = link{Href: self, Method: http.MethodPut, Role: RoleLibrarian}
+	links["delete"] = link{Href: self, Method: http.MethodDelete, Role: RoleAdmin}
+	if h.loans.HasLoans(b.ID) {
+		links["loans"] = link{Href: h.base + "/loans?book_id=" + strconv.Itoa(b.ID)}
+	}
+	return links
+}
+
+// view wraps a book for a response in the handler's version, with its
+// _links, trimmed to fields when that is not nil
+func (h *bookHandler) view(b Book, expand bool, fields map[string]bool) bookView {
+	v := bookView{book: h.codec.encode(b), links: h.bookLinks(b), fields: fields}
+	if expand {
+		v.book = h.codec.expand(b)
+	}
+	return v
+}
+
+// bookMembers lists the members ?fields= may select for a codec: those
+// of its expanded representation plus _links
+func bookMembers(codec bookCodec) []string {
+	return append(jsonMembers(reflect.TypeOf(codec.expand(Book{}))), "_links")
+}
+
+// jsonMembers lists the JSON member names of a struct type, including
+// those promoted from embedded structs
+func jsonMembers(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			names = append(names, jsonMembers(f.Type)...)
+			continue
+		}
+		if name := jsonName(f); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseFields reads a ?fields=id,title sparse fieldset. fields is nil
+// when the parameter is absent, meaning every member. When ok is false
+// the 400 response has already been written.
+func parseFields(c *gin.Context, allowed []string) (fields map[string]bool, ok bool) {
+	raw, present := c.GetQuery("fields")
+	if !present {
+		return nil, true
+	}
+
+	known := make(map[string]bool, len(allowed))
+	for _, name := range allowed {
+		known[name] = true
+	}
+	fields = make(map[string]bool)
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			respondProblem(c, http.StatusBadRequest, "invalid_query", "Invalid query parameters",
+				Violation{Field: "fields", Rule: "oneof",
+					Message: fmt.Sprintf("unknown field %q; fields may name %s", name, strings.Join(allowed, ", "))})
+			return nil, false
+		}
+		fields[name] = true
+	}
+	if len(fields) == 0 {
+		respondProblem(c, http.StatusBadRequest, "invalid_query", "Invalid query parameters",
+			Violation{Field: "fields", Rule: "required", Message: "fields must name at least one field"})
+		return nil, false
+	}
+	return fields, true
+}
+
+// member is one name/value pair of a JSON object, the value already
+// encoded
+type member struct {
+	name  string
+	value json.RawMessage
+}
+
+// bookView is how a handler writes a book: the version's encoding, then
+// its _links and any extra members such as a search score, keeping
+// only the members in fields when that is not nil
+type bookView struct {
+	book   interface{}
+	links  map[string]link
+	extra  []member
+	fields map[string]bool
+}
+
+func (v bookView) MarshalJSON() ([]byte, error) {
+	body, err := json.Marshal(v.book)
+	if err != nil {
+		return nil, err
+	}
+	members, err := objectMembers(body)
+	if err != nil {
+		return nil, err
+	}
+	if v.links != nil {
+		links, err := json.Marshal(v.links)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member{"_links", links})
+	}
+	members = append(members, v.extra...)
+
+	// Re-assemble the object by hand so the book keeps its member order
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	first := true
+	for _, m := range members {
+		if v.fields != nil && !v.fields[m.name] {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		name, _ := json.Marshal(m.name)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(m.value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// objectMembers splits an encoded JSON object into its members, in order
+func objectMembers(data []byte) ([]member, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	var members []member
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		members = append(members, member{tok.(string), value})
+	}
+	return members, nil
+}
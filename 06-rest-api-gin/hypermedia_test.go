@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSparseFieldsets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	for _, path := range []string{
+		"/v1/books?fields=id,title",
+		"/v2/books?fields=title,id",
+		"/v1/books/search?q=go&fields=id,title",
+	} {
+		w := doJSON(router, "GET", path, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+
+		var books []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &books)
+		if len(books) == 0 {
+			t.Fatalf("%s: expected books, got none", path)
+		}
+		for _, b := range books {
+			if len(b) != 2 || b["id"] == nil || b["title"] == nil {
+				t.Errorf("%s: expected only id and title, got %v", path, b)
+			}
+		}
+	}
+
+	// Members keep their order whatever order fields lists them in
+	w := doJSON(router, "GET", "/v2/books/1?fields=title,id", nil)
+	if got := w.Body.String(); got != `{"id":1,"title":"The Go Programming Language"}` {
+		t.Errorf("Expected trimmed v2 book, got %s", got)
+	}
+
+	// Fields are checked against the version's own shape
+	decodeProblem(t, doJSON(router, "GET", "/v2/books?fields=id,year", nil), http.StatusBadRequest, "invalid_query")
+	decodeProblem(t, doJSON(router, "GET", "/v1/books/1?fields=price", nil), http.StatusBadRequest, "invalid_query")
+	decodeProblem(t, doJSON(router, "GET", "/v1/books?fields=", nil), http.StatusBadRequest, "invalid_query")
+	if w := doJSON(router, "GET", "/v1/books/search?q=go&fields=score", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected score to be selectable on search, got %d", w.Code)
+	}
+}
+
+// bookLinksOf fetches a book and decodes its _links
+func bookLinksOf(t *testing.T, router *gin.Engine, path string) map[string]link {
+	t.Helper()
+	var body struct {
+		Links map[string]link `json:"_links"`
+	}
+	json.Unmarshal(doJSON(router, "GET", path, nil).Body.Bytes(), &body)
+	return body.Links
+}
+
+func TestBookLinks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	links := bookLinksOf(t, router, "/v2/books/1")
+	want := map[string]link{
+		"self":   {Href: "/v2/books/1"},
+		"update": {Href: "/v2/books/1", Method: "PUT", Role: RoleLibrarian},
+		"delete": {Href: "/v2/books/1", Method: "DELETE", Role: RoleAdmin},
+	}
+	if len(links) != len(want) {
+		t.Errorf("Expected links %v, got %v", want, links)
+	}
+	for rel, l := range want {
+		if links[rel] != l {
+			t.Errorf("%s: expected %+v, got %+v", rel, l, links[rel])
+		}
+	}
+
+	// A loans link appears once the book has been lent, and leads to
+	// exactly its loans
+	doLoanRequest(router, "POST", "/v1/books/1/checkout", `{"borrower_id":"alice"}`)
+	loans, ok := bookLinksOf(t, router, "/v1/books/1")["loans"]
+	if !ok || loans.Href != "/v1/loans?book_id=1" {
+		t.Fatalf("Expected a loans link, got %+v", loans)
+	}
+	var lent []Loan
+	json.Unmarshal(doJSON(router, "GET", loans.Href, nil).Body.Bytes(), &lent)
+	if len(lent) != 1 || lent[0].BookID != 1 {
+		t.Errorf("Expected the one loan of book 1, got %+v", lent)
+	}
+	decodeProblem(t, doJSON(router, "GET", "/v1/loans?book_id=x", nil), http.StatusBadRequest, "invalid_query")
+
+	// A deleted book can only be restored
+	doJSON(router, "DELETE", "/v1/books/2", nil)
+	var deleted []struct {
+		ID    int             `json:"id"`
+		Links map[string]link `json:"_links"`
+	}
+	json.Unmarshal(doJSON(router, "GET", "/v1/books?deleted=only", nil).Body.Bytes(), &deleted)
+	if len(deleted) != 1 || len(deleted[0].Links) != 2 || deleted[0].Links["restore"].Href != "/v1/books/2/restore" {
+		t.Errorf("Expected self and restore links on the deleted book, got %+v", deleted)
+	}
+}
+
+func TestHomeLinksEveryRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	var home struct {
+		Versions map[string]apiVersion `json:"versions"`
+	}
+	json.Unmarshal(doJSON(router, "GET", "/", nil).Body.Bytes(), &home)
+
+	v2 := home.Versions["v2"]
+	if v2.Status != "current" || home.Versions["v1"].Status != "deprecated" || home.Versions["v1"].Sunset == "" {
+		t.Errorf("Expected v1 deprecated and v2 current, got %+v", home.Versions)
+	}
+	if got := v2.Links["book"]; got != (link{Href: "/v2/books/{id}", Templated: true}) {
+		t.Errorf("Expected a templated book link, got %+v", got)
+	}
+	if got := v2.Links["create-book"]; got != (link{Href: "/v2/books", Method: "POST", Role: RoleLibrarian}) {
+		t.Errorf("Expected create-book to need a librarian, got %+v", got)
+	}
+
+	// Every route the router serves under a version is listed
+	listed := make(map[string]bool)
+	for _, v := range home.Versions {
+		for _, l := range v.Links {
+			method := l.Method
+			if method == "" {
+				method = "GET"
+			}
+			listed[method+" "+l.Href] = true
+		}
+	}
+	for _, r := range router.Routes() {
+		if r.Path == "/" || r.Path == "/openapi.json" {
+			continue
+		}
+		if key := r.Method + " " + pathParam.ReplaceAllString(r.Path, "{$1}"); !listed[key] {
+			t.Errorf("Route %s is missing from the index", key)
+		}
+	}
+}
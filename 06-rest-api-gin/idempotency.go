@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+	maxIdempotentBody    = 1 << 20 // 1 MB; only single-book writes are idempotent
+)
+
+// idempotencyEntry is one key's recorded response. While the first
+// request is still running, done is open and the response fields are
+// unset.
+type idempotencyEntry struct {
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	failed      bool // the first request did not produce a response worth replaying
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+// IdempotencyStore remembers responses by Idempotency-Key so that a
+// retried request is answered with the original response instead of
+// being executed twice. Keys are scoped to the caller's token subject,
+// so one client can neither replay nor block another's. Entries expire
+// ttl after they were recorded.
+type IdempotencyStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	now       func() time.Time
+	entries   map[string]*idempotencyEntry
+	nextSweep time.Time
+}
+
+// NewIdempotencyStore creates an empty store. now is the clock used for
+// expiry; pass time.Now outside of tests.
+func NewIdempotencyStore(ttl time.Duration, now func() time.Time) *IdempotencyStore {
+	return &IdempotencyStore{
+		ttl:     ttl,
+		now:     now,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// begin looks up key. If nobody holds it, a new in-flight entry is
+// reserved and owner is true: the caller must run the request and call
+// finish. Otherwise the existing entry is returned, possibly still in
+// flight.
+func (s *IdempotencyStore) begin(key string, fingerprint [sha256.Size]byte) (e *idempotencyEntry, owner bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if !now.Before(s.nextSweep) {
+		s.sweep(now)
+		s.nextSweep = now.Add(s.ttl / 10)
+	}
+
+	if e, ok := s.entries[key]; ok && !s.expired(e, now) {
+		return e, false
+	}
+	e = &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	s.entries[key] = e
+	return e, true
+}
+
+// finish records the response for an entry reserved by begin and wakes
+// any requests waiting on it. Server errors are not recorded, so the
+// client can retry with the same key.
+func (s *IdempotencyStore) finish(key string, e *idempotencyEntry, status int, header http.Header, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status >= http.StatusInternalServerError {
+		e.failed = true
+		if s.entries[key] == e {
+			delete(s.entries, key)
+		}
+	} else {
+		e.status = status
+		e.header = header
+		e.body = body
+		e.expires = s.now().Add(s.ttl)
+	}
+	close(e.done)
+}
+
+// expired reports whether a finished entry has outlived the TTL.
+// In-flight entries never expire. Callers must hold the lock.
+func (s *IdempotencyStore) expired(e *idempotencyEntry, now time.Time) bool {
+	select {
+	case <-e.done:
+		return !now.Before(e.expires)
+	default:
+		return false
+	}
+}
+
+// sweep drops expired entries. Callers must hold the lock.
+func (s *IdempotencyStore) sweep(now time.Time) {
+	for key, e := range s.entries {
+		if s.expired(e, now) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// requestFingerprint identifies what a request asked for. JSON bodies
+// are compared by content, so a retry that re-encodes the same object
+// with different spacing or key order still matches.
+func requestFingerprint(r *http.Request, body []byte) [sha256.Size]byte {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		body, _ = json.Marshal(v) // maps marshal with sorted keys
+	}
+
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// recordingWriter passes the response through while keeping a copy of
+// the body
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent makes a handler safe to retry. Requests without an
+// Idempotency-Key pass straight through. The first request with a key
+// runs normally and its response is recorded; later requests with the
+// same key and body get that response replayed, and the same key with
+// a different body is rejected with 422. A request arriving while the
+// first one is still running waits for it to finish. It must run after
+// requireRole, which identifies the caller the key belongs to.
+func idempotent(store *IdempotencyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			respondProblem(c, http.StatusBadRequest, "invalid_idempotency_key", "Idempotency-Key must be at most 255 characters",
+				Violation{Field: idempotencyHeader, Rule: "max", Message: "Idempotency-Key must be at most 255 characters"})
+			return
+		}
+
+		// The body is held in memory to fingerprint and replay it
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIdempotentBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondProblem(c, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit))
+			return
+		}
+		if err != nil {
+			respondProblem(c, http.StatusBadRequest, "malformed_body", err.Error())
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(c.Request, body)
+		key = subject(c) + "\x00" + key
+
+		for {
+			e, owner := store.begin(key, fingerprint)
+			if owner {
+				runRecorded(c, store, key, e)
+				return
+			}
+			if e.fingerprint != fingerprint {
+				respondProblem(c, http.StatusUnprocessableEntity, "idempotency_key_reused",
+					"Idempotency-Key was already used for a different request")
+				return
+			}
+
+			select {
+			case <-e.done:
+			case <-c.Request.Context().Done():
+				c.Abort()
+				return
+			}
+			if e.failed {
+				continue // the first attempt failed; this one takes over
+			}
+
+			header := c.Writer.Header()
+			for name, values := range e.header {
+				header[name] = values
+			}
+			header.Set("Idempotent-Replayed", "true")
+			c.Writer.WriteHeader(e.status)
+			c.Writer.Write(e.body)
+			c.Abort()
+			return
+		}
+	}
+}
+
+// runRecorded runs the rest of the chain and records its response. If
+// the handler panics the entry is released so waiters do not hang.
+func runRecorded(c *gin.Context, store *IdempotencyStore, key string, e *idempotencyEntry) {
+	rw := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = rw
+
+	finished := false
+	defer func() {
+		c.Writer = rw.ResponseWriter
+		if !finished {
+			store.finish(key, e, http.StatusInternalServerError, nil, nil)
+		}
+	}()
+
+	c.Next()
+	store.finish(key, e, rw.Status(), rw.Header().Clone(), rw.body.Bytes())
+	finished = true
+}
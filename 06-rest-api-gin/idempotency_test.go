@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func postWithKey(router *gin.Engine, key, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/books", strings.NewReader(body))
+	authorize(req, RoleAdmin)
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(idempotencyHeader, key)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotentCreateReplays(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	body := `{"title":"Retry Me","author":"Client","year":2024}`
+	first := postWithKey(router, "abc", body)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", first.Code)
+	}
+
+	// Same object, different spacing and key order
+	second := postWithKey(router, "abc", `{"year":2024, "author":"Client", "title":"Retry Me"}`)
+	if second.Code != http.StatusCreated {
+		t.Fatalf("Expected replayed status 201, got %d", second.Code)
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("Expected replayed body %s, got %s", first.Body, second.Body)
+	}
+	if second.Header().Get("ETag") != first.Header().Get("ETag") {
+		t.Errorf("Expected replayed ETag %s, got %s", first.Header().Get("ETag"), second.Header().Get("ETag"))
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected Idempotent-Replayed header on the replay")
+	}
+	if got := countBooks(t, router); got != 3 {
+		t.Errorf("Expected exactly one book created, catalogue has %d", got)
+	}
+}
+
+func TestIdempotencyKeyReusedWithDifferentBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	postWithKey(router, "abc", `{"title":"One","author":"A","year":2024}`)
+	w := postWithKey(router, "abc", `{"title":"Two","author":"A","year":2024}`)
+	decodeProblem(t, w, http.StatusUnprocessableEntity, "idempotency_key_reused")
+	if got := countBooks(t, router); got != 3 {
+		t.Errorf("Expected the second body to be rejected, catalogue has %d", got)
+	}
+}
+
+func TestIdempotencyReplaysErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	body := `{"title":"No Year","author":"A"}`
+	first := postWithKey(router, "bad", body)
+	second := postWithKey(router, "bad", body)
+	if first.Code != http.StatusBadRequest || second.Code != http.StatusBadRequest {
+		t.Fatalf("Expected both attempts to get 400, got %d and %d", first.Code, second.Code)
+	}
+	if second.Header().Get("Content-Type") != first.Header().Get("Content-Type") {
+		t.Errorf("Expected replayed Content-Type %q, got %q", first.Header().Get("Content-Type"), second.Header().Get("Content-Type"))
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+	router := setupRouter(NewMemoryBookRepository(defaultBooks()...),
+		WithClock(clock.Now), WithIdempotencyTTL(time.Hour), WithAuthSecret(testSecret))
+
+	body := `{"title":"Later","author":"A","year":2024}`
+	var first, second Book
+	json.Unmarshal(postWithKey(router, "k", body).Body.Bytes(), &first)
+
+	clock.Advance(30 * time.Minute)
+	json.Unmarshal(postWithKey(router, "k", body).Body.Bytes(), &second)
+	if second.ID != first.ID {
+		t.Fatalf("Expected replay within the TTL, got IDs %d and %d", first.ID, second.ID)
+	}
+
+	clock.Advance(time.Hour)
+	json.Unmarshal(postWithKey(router, "k", body).Body.Bytes(), &second)
+	if second.ID == first.ID {
+		t.Errorf("Expected a new book once the key expired, got ID %d again", second.ID)
+	}
+}
+
+func TestIdempotencyConcurrentRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	body := `{"title":"Racing","author":"A","year":2024}`
+	const n = 20
+	ids := make([]int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := postWithKey(router, "race", body)
+			if w.Code != http.StatusCreated {
+				t.Errorf("Expected status 201, got %d", w.Code)
+				return
+			}
+			var b Book
+			json.Unmarshal(w.Body.Bytes(), &b)
+			ids[i] = b.ID
+		}(i)
+	}
+	wg.Wait()
+
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			t.Fatalf("Expected every request to see the same book, got IDs %v", ids)
+		}
+	}
+	if got := countBooks(t, router); got != 3 {
+		t.Errorf("Expected exactly one book created, catalogue has %d", got)
+	}
+}
+
+func TestIdempotencyKeyTooLong(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w := postWithKey(router, strings.Repeat("k", maxIdempotencyKeyLen+1), `{"title":"T","author":"A","year":2024}`)
+	decodeProblem(t, w, http.StatusBadRequest, "invalid_idempotency_key")
+}
+
+func TestIdempotencyKeyScopedToCaller(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+	body := `{"title":"Mine","author":"A","year":2024}`
+	postWithKey(router, "abc", body) // as test-admin
+
+	// Another subject using the same key gets its own request run
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/books", strings.NewReader(body))
+	authorize(req, RoleLibrarian)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyHeader, "abc")
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Expected a fresh 201 for another caller, got %d (replayed %q)", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if got := countBooks(t, router); got != 4 {
+		t.Errorf("Expected both books created, catalogue has %d", got)
+	}
+}
+
+func TestIdempotentBodyTooLarge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	body := `{"title":"` + strings.Repeat("x", maxIdempotentBody) + `","author":"A","year":2024}`
+	w := postWithKey(router, "big", body)
+	decodeProblem(t, w, http.StatusRequestEntityTooLarge, "body_too_large")
+}
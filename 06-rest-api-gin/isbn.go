@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrInvalidISBN is returned for ISBNs with the wrong length,
+	// characters or check digit
+	ErrInvalidISBN = errors.New("invalid ISBN")
+	// ErrDuplicateISBN is returned when another book already has the ISBN
+	ErrDuplicateISBN = errors.New("a book with this ISBN already exists")
+)
+
+// NormalizeISBN validates an ISBN-10 or ISBN-13 and returns it as a
+// bare 13-digit ISBN. Hyphens and spaces are ignored, so
+// "0-13-468599-7" and "978-0134685991" both normalise to
+// "9780134685991".
+func NormalizeISBN(s string) (string, error) {
+	digits := strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(s))
+
+	switch len(digits) {
+	case 10:
+		if !validISBN10(digits) {
+			return "", ErrInvalidISBN
+		}
+		// ISBN-10s map into the 978 prefix with a recomputed check digit
+		body := "978" + digits[:9]
+		return body + string(isbn13CheckDigit(body)), nil
+	case 13:
+		if !allDigits(digits) || isbn13CheckDigit(digits[:12]) != digits[12] {
+			return "", ErrInvalidISBN
+		}
+		return digits, nil
+	default:
+		return "", ErrInvalidISBN
+	}
+}
+
+// validISBN10 checks the mod-11 checksum; the last character may be
+// X, standing for 10
+func validISBN10(s string) bool {
+	if !allDigits(s[:9]) {
+		return false
+	}
+
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(s[i]-'0') * (10 - i)
+	}
+	switch last := s[9]; {
+	case last == 'X':
+		sum += 10
+	case last >= '0' && last <= '9':
+		sum += int(last - '0')
+	default:
+		return false
+	}
+	return sum%11 == 0
+}
+
+// isbn13CheckDigit computes the check digit for the first 12 digits
+// using alternating weights of 1 and 3
+func isbn13CheckDigit(s string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += int(s[i]-'0') * weight
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		err   bool
+	}{
+		{"bare ISBN-13", "9780134190440", "9780134190440", false},
+		{"hyphenated ISBN-13", "978-0-13-419044-0", "9780134190440", false},
+		{"ISBN-10 converted", "0134190440", "9780134190440", false},
+		{"hyphenated ISBN-10", "0-13-235088-2", "9780132350884", false},
+		{"ISBN-10 with X check digit", "0-8044-2957-X", "9780804429573", false},
+		{"lowercase x", "080442957x", "9780804429573", false},
+		{"spaces", "978 0 13 235088 4", "9780132350884", false},
+		{"bad ISBN-13 checksum", "9780134190441", "", true},
+		{"bad ISBN-10 checksum", "0134190441", "", true},
+		{"X in the middle", "01341X0440", "", true},
+		{"letters", "97801341904AB", "", true},
+		{"wrong length", "12345", "", true},
+		{"empty", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeISBN(tt.input)
+			if tt.err {
+				if !errors.Is(err, ErrInvalidISBN) {
+					t.Errorf("Expected ErrInvalidISBN, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeISBN(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func postBook(router *gin.Engine, book interface{}) *httptest.ResponseRecorder {
+	jsonData, _ := json.Marshal(book)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/books", bytes.NewBuffer(jsonData))
+	authorize(req, RoleAdmin)
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestCreateBookISBN(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w := postBook(router, Book{Title: "Clean Code", Author: "Robert Martin", Year: 2008, ISBN: "0-13-235088-2"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created Book
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.ISBN != "9780132350884" {
+		t.Errorf("Expected normalised ISBN-13, got %s", created.ISBN)
+	}
+
+	// Same book spelled as ISBN-13 is still a duplicate
+	dup := postBook(router, Book{Title: "Copy", Author: "Someone", Year: 2010, ISBN: "978-0132350884"})
+	if dup.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for duplicate ISBN, got %d", dup.Code)
+	}
+
+	bad := postBook(router, Book{Title: "Bad", Author: "Someone", Year: 2010, ISBN: "1234567890"})
+	if bad.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid ISBN, got %d", bad.Code)
+	}
+
+	// Books without an ISBN never clash with each other
+	for i := 0; i < 2; i++ {
+		if w := postBook(router, Book{Title: "No ISBN", Author: "Anon", Year: 2000}); w.Code != http.StatusCreated {
+			t.Errorf("Expected status 201 for book without ISBN, got %d", w.Code)
+		}
+	}
+}
+
+func TestUpdateBookDuplicateISBN(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	postBook(router, Book{Title: "Clean Code", Author: "Robert Martin", Year: 2008, ISBN: "9780132350884"})
+
+	jsonData, _ := json.Marshal(Book{Title: "Taken", Author: "Author", Year: 2015, ISBN: "0132350882"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/v1/books/1", bytes.NewBuffer(jsonData))
+	authorize(req, RoleAdmin)
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d", w.Code)
+	}
+}
+
+func TestGetBookByISBN(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	postBook(router, Book{Title: "The Go Programming Language", Author: "Donovan & Kernighan", Year: 2015, ISBN: "978-0134190440"})
+
+	tests := []struct {
+		name       string
+		isbn       string
+		wantStatus int
+	}{
+		{"ISBN-13", "9780134190440", http.StatusOK},
+		{"ISBN-10 form", "0-13-419044-0", http.StatusOK},
+		{"unknown", "9780132350884", http.StatusNotFound},
+		{"invalid", "123", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/v1/books/isbn/"+tt.isbn, nil)
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// ErrBookOnLoan is returned when a book is already checked out, or
+	// when deleting a book that is still checked out
+	ErrBookOnLoan = errors.New("book is on loan")
+	// ErrNoActiveLoan is returned when returning or renewing a book that
+	// is not checked out
+	ErrNoActiveLoan = errors.New("book has no active loan")
+	// ErrRenewalLimit is returned once a loan has been renewed as often
+	// as the policy allows
+	ErrRenewalLimit = errors.New("renewal limit reached")
+	// ErrLoanOverdue is returned when renewing a loan that is already
+	// late; overdue books must be returned first
+	ErrLoanOverdue = errors.New("loan is overdue")
+)
+
+// LoanPolicy holds the lending rules. Fines are in cents.
+type LoanPolicy struct {
+	Period      time.Duration // how long a checkout or renewal lasts
+	MaxRenewals int
+	FinePerDay  int // charged for each started day past the due date
+	MaxFine     int // cap per loan; 0 means no cap
+}
+
+// DefaultLoanPolicy is two weeks, two renewals, 25 cents a day capped at $10
+func DefaultLoanPolicy() LoanPolicy {
+	return LoanPolicy{
+		Period:      14 * 24 * time.Hour,
+		MaxRenewals: 2,
+		FinePerDay:  25,
+		MaxFine:     1000,
+	}
+}
+
+// fine computes what a loan due at due owes at time at
+func (p LoanPolicy) fine(due, at time.Time) int {
+	if !at.After(due) {
+		return 0
+	}
+	days := int((at.Sub(due) + 24*time.Hour - 1) / (24 * time.Hour))
+	fine := days * p.FinePerDay
+	if p.MaxFine > 0 && fine > p.MaxFine {
+		fine = p.MaxFine
+	}
+	return fine
+}
+
+// Loan records one checkout of a book
+type Loan struct {
+	ID           int        `json:"id"`
+	BookID       int        `json:"book_id"`
+	BorrowerID   string     `json:"borrower_id"`
+	CheckedOutAt time.Time  `json:"checked_out_at"`
+	DueAt        time.Time  `json:"due_at"`
+	ReturnedAt   *time.Time `json:"returned_at,omitempty"`
+	Renewals     int        `json:"renewals"`
+	Overdue      bool       `json:"overdue"`
+	Fine         int        `json:"fine_cents"` // final once returned, accrued so far otherwise
+}
+
+// LoanService tracks loans and enforces the LoanPolicy. It checks books
+// exist through the BookRepository but never writes to it. Given a
+// StateStore, every change to the loans is saved there, so loans
+// survive a restart along with the books.
+type LoanService struct {
+	mu     sync.Mutex
+	books  BookRepository
+	store  StateStore // nil keeps loans in memory only
+	policy LoanPolicy
+	now    func() time.Time
+	loans  []Loan
+	active map[int]int   // book ID -> index into loans
+	byBook map[int][]int // book ID -> indexes into loans, oldest first
+}
+
+// loanStateName is the LoanService's document in a StateStore
+const loanStateName = "loans"
+
+// loanState is what the LoanService saves in its StateStore
+type loanState struct {
+	Loans []Loan `json:"loans"`
+}
+
+// NewLoanService creates a loan service, restoring any loans saved in
+// store. store may be nil. now is the clock used for due dates and
+// fines; pass time.Now outside of tests.
+func NewLoanService(books BookRepository, store StateStore, policy LoanPolicy, now func() time.Time) (*LoanService, error) {
+	s := &LoanService{
+		books:  books,
+		store:  store,
+		policy: policy,
+		now:    now,
+		active: make(map[int]int),
+		byBook: make(map[int][]int),
+	}
+	if store == nil {
+		return s, nil
+	}
+
+	var state loanState
+	if _, err := store.LoadState(loanStateName, &state); err != nil {
+		return nil, err
+	}
+	for _, l := range state.Loans {
+		s.add(l)
+	}
+	return s, nil
+}
+
+// add appends a loan and indexes it. Callers must hold the lock.
+func (s *LoanService) add(l Loan) {
+	s.loans = append(s.loans, l)
+	i := len(s.loans) - 1
+	s.byBook[l.BookID] = append(s.byBook[l.BookID], i)
+	if l.ReturnedAt == nil {
+		s.active[l.BookID] = i
+	}
+}
+
+// save persists the loans, if there is a store. Callers must hold the
+// lock and undo their change when it fails.
+func (s *LoanService) save() error {
+	if s.store == nil {
+		return nil
+	}
+	return s.store.SaveState(loanStateName, loanState{Loans: s.loans})
+}
+
+// view fills in the fields that depend on the current time
+func (s *LoanService) view(l Loan, now time.Time) Loan {
+	if l.ReturnedAt == nil {
+		l.Overdue = now.After(l.DueAt)
+		l.Fine = s.policy.fine(l.DueAt, now)
+	}
+	return l
+}
+
+func (s *LoanService) Checkout(bookID int, borrowerID string) (Loan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	book, err := s.books.Get(bookID)
+	if err != nil {
+		return Loan{}, err
+	}
+	if book.Deleted() {
+		return Loan{}, ErrBookDeleted
+	}
+	if _, onLoan := s.active[bookID]; onLoan {
+		return Loan{}, ErrBookOnLoan
+	}
+
+	now := s.now()
+	loan := Loan{
+		ID:           len(s.loans) + 1,
+		BookID:       bookID,
+		BorrowerID:   borrowerID,
+		CheckedOutAt: now,
+		DueAt:        now.Add(s.policy.Period),
+	}
+	s.add(loan)
+	if err := s.save(); err != nil {
+		s.loans = s.loans[:len(s.loans)-1]
+		s.byBook[bookID] = s.byBook[bookID][:len(s.byBook[bookID])-1]
+		delete(s.active, bookID)
+		return Loan{}, err
+	}
+	return s.view(loan, now), nil
+}
+
+// Return closes the active loan on a book and fixes its fine
+func (s *LoanService) Return(bookID int) (Loan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.active[bookID]
+	if !ok {
+		return Loan{}, ErrNoActiveLoan
+	}
+
+	now := s.now()
+	before := s.loans[i]
+	loan := &s.loans[i]
+	loan.Overdue = now.After(loan.DueAt)
+	loan.Fine = s.policy.fine(loan.DueAt, now)
+	loan.ReturnedAt = &now
+	delete(s.active, bookID)
+	if err := s.save(); err != nil {
+		s.loans[i] = before
+		s.active[bookID] = i
+		return Loan{}, err
+	}
+	return *loan, nil
+}
+
+// Renew extends the due date by one loan period from now
+func (s *LoanService) Renew(bookID int) (Loan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.active[bookID]
+	if !ok {
+		return Loan{}, ErrNoActiveLoan
+	}
+
+	now := s.now()
+	loan := &s.loans[i]
+	if now.After(loan.DueAt) {
+		return Loan{}, ErrLoanOverdue
+	}
+	if loan.Renewals >= s.policy.MaxRenewals {
+		return Loan{}, ErrRenewalLimit
+	}
+	before := *loan
+	loan.Renewals++
+	loan.DueAt = now.Add(s.policy.Period)
+	if err := s.save(); err != nil {
+		s.loans[i] = before
+		return Loan{}, err
+	}
+	return s.view(*loan, now), nil
+}
+
+// LoanFilter narrows List; zero values match everything
+type LoanFilter struct {
+	ActiveOnly  bool
+	OverdueOnly bool
+	BorrowerID  string
+	BookID      int
+}
+
+// List returns matching loans, newest first
+func (s *LoanService) List(f LoanFilter) []Loan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	candidates := s.loans
+	if f.BookID != 0 {
+		candidates = make([]Loan, len(s.byBook[f.BookID]))
+		for j, i := range s.byBook[f.BookID] {
+			candidates[j] = s.loans[i]
+		}
+	}
+
+	now := s.now()
+	result := []Loan{}
+	for _, l := range candidates {
+		l = s.view(l, now)
+		if f.ActiveOnly && l.ReturnedAt != nil {
+			continue
+		}
+		if f.OverdueOnly && (l.ReturnedAt != nil || !l.Overdue) {
+			continue
+		}
+		if f.BorrowerID != "" && l.BorrowerID != f.BorrowerID {
+			continue
+		}
+		if f.BookID != 0 && l.BookID != f.BookID {
+			continue
+		}
+		result = append(result, l)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID > result[j].ID })
+	return result
+}
+
+// HasLoans reports whether a book has ever been checked out
+func (s *LoanService) HasLoans(bookID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.byBook[bookID]) > 0
+}
+
+// GuardDelete runs del only if the book has no active loan. The check
+// and the delete happen under the same lock, so a checkout cannot slip
+// in between.
+func (s *LoanService) GuardDelete(bookID int, del func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, onLoan := s.active[bookID]; onLoan {
+		return ErrBookOnLoan
+	}
+	return del()
+}
+
+// loanHandler serves checkout, return, renewal and the loan listing
+type loanHandler struct {
+	loans *LoanService
+}
+
+type checkoutRequest struct {
+	BorrowerID string `json:"borrower_id" binding:"required"`
+}
+
+func (h *loanHandler) checkout(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	var req checkoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondInvalid(c, http.StatusBadRequest, err)
+		return
+	}
+
+	loan, err := h.loans.Checkout(id, req.BorrowerID)
+	if err != nil {
+		respondLoanError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, loan)
+}
+
+func (h *loanHandler) returnBook(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	loan, err := h.loans.Return(id)
+	if err != nil {
+		respondLoanError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, loan)
+}
+
+func (h *loanHandler) renew(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	loan, err := h.loans.Renew(id)
+	if err != nil {
+		respondLoanError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, loan)
+}
+
+func (h *loanHandler) getLoans(c *gin.Context) {
+	var f LoanFilter
+	for name, target := range map[string]*bool{"active": &f.ActiveOnly, "overdue": &f.OverdueOnly} {
+		raw, ok := c.GetQuery(name)
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			respondProblem(c, http.StatusBadRequest, "invalid_query", "Invalid query parameters",
+				Violation{Field: name, Rule: "boolean", Message: name + " must be true or false"})
+			return
+		}
+		*target = v
+	}
+	f.BorrowerID = c.Query("borrower_id")
+	if raw, ok := c.GetQuery("book_id"); ok {
+		id, err := strconv.Atoi(raw)
+		if err != nil || id < 1 {
+			respondProblem(c, http.StatusBadRequest, "invalid_query", "Invalid query parameters",
+				Violation{Field: "book_id", Rule: "min", Message: "book_id must be a positive integer"})
+			return
+		}
+		f.BookID = id
+	}
+
+	c.JSON(http.StatusOK, h.loans.List(f))
+}
+
+// respondLoanError maps loan errors to HTTP responses
+func respondLoanError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrBookOnLoan):
+		respondProblem(c, http.StatusConflict, "book_on_loan", err.Error())
+	case errors.Is(err, ErrNoActiveLoan):
+		respondProblem(c, http.StatusConflict, "no_active_loan", err.Error())
+	case errors.Is(err, ErrRenewalLimit):
+		respondProblem(c, http.StatusConflict, "renewal_limit", err.Error())
+	case errors.Is(err, ErrLoanOverdue):
+		respondProblem(c, http.StatusConflict, "loan_overdue", err.Error())
+	default:
+		respondRepoError(c, err)
+	}
+}
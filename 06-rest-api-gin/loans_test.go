@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeClock is a settable time source for loan tests
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newLoanTestRouter(clock *fakeClock) *gin.Engine {
+	return setupRouter(NewMemoryBookRepository(defaultBooks()...),
+		WithClock(clock.Now),
+		WithAuthSecret(testSecret),
+		WithLoanPolicy(LoanPolicy{Period: 7 * 24 * time.Hour, MaxRenewals: 1, FinePerDay: 50, MaxFine: 200}),
+	)
+}
+
+func doLoanRequest(router *gin.Engine, method, path, body string) (*httptest.ResponseRecorder, Loan) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	authorize(req, RoleAdmin)
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	var loan Loan
+	json.Unmarshal(w.Body.Bytes(), &loan)
+	return w, loan
+}
+
+func TestLoanPolicyFine(t *testing.T) {
+	p := LoanPolicy{FinePerDay: 25, MaxFine: 100}
+	due := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want int
+	}{
+		{"on time", due, 0},
+		{"early", due.Add(-time.Hour), 0},
+		{"one hour late counts as a day", due.Add(time.Hour), 25},
+		{"exactly two days late", due.Add(48 * time.Hour), 50},
+		{"capped", due.Add(30 * 24 * time.Hour), 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.fine(due, tt.at); got != tt.want {
+				t.Errorf("fine = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckoutAndReturn(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+	router := newLoanTestRouter(clock)
+
+	w, loan := doLoanRequest(router, "POST", "/v1/books/1/checkout", `{"borrower_id":"alice"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if !loan.DueAt.Equal(clock.now.Add(7 * 24 * time.Hour)) {
+		t.Errorf("Unexpected due date %v", loan.DueAt)
+	}
+
+	// Someone else cannot check out the same copy
+	if w, _ := doLoanRequest(router, "POST", "/v1/books/1/checkout", `{"borrower_id":"bob"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for double checkout, got %d", w.Code)
+	}
+
+	clock.Advance(3 * 24 * time.Hour)
+	w, loan = doLoanRequest(router, "POST", "/v1/books/1/return", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if loan.ReturnedAt == nil || loan.Fine != 0 || loan.Overdue {
+		t.Errorf("Expected on-time return without fine, got %+v", loan)
+	}
+
+	if w, _ := doLoanRequest(router, "POST", "/v1/books/1/return", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 when returning a book that is not out, got %d", w.Code)
+	}
+}
+
+func TestLateReturnFine(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+	router := newLoanTestRouter(clock)
+
+	doLoanRequest(router, "POST", "/v1/books/2/checkout", `{"borrower_id":"alice"}`)
+	clock.Advance(9 * 24 * time.Hour) // two days late
+
+	_, loan := doLoanRequest(router, "POST", "/v1/books/2/return", "")
+	if !loan.Overdue || loan.Fine != 100 {
+		t.Errorf("Expected overdue loan with fine 100, got %+v", loan)
+	}
+}
+
+func TestRenewLoan(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+	router := newLoanTestRouter(clock)
+
+	doLoanRequest(router, "POST", "/v1/books/1/checkout", `{"borrower_id":"alice"}`)
+
+	clock.Advance(6 * 24 * time.Hour)
+	w, loan := doLoanRequest(router, "POST", "/v1/books/1/renew", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if loan.Renewals != 1 || !loan.DueAt.Equal(clock.now.Add(7*24*time.Hour)) {
+		t.Errorf("Unexpected renewed loan %+v", loan)
+	}
+
+	if w, _ := doLoanRequest(router, "POST", "/v1/books/1/renew", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 past the renewal limit, got %d", w.Code)
+	}
+	if w, _ := doLoanRequest(router, "POST", "/v1/books/2/renew", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 renewing a book that is not out, got %d", w.Code)
+	}
+}
+
+func TestRenewOverdueLoanRefused(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+	router := newLoanTestRouter(clock)
+
+	doLoanRequest(router, "POST", "/v1/books/1/checkout", `{"borrower_id":"alice"}`)
+	clock.Advance(8 * 24 * time.Hour)
+
+	if w, _ := doLoanRequest(router, "POST", "/v1/books/1/renew", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 renewing an overdue loan, got %d", w.Code)
+	}
+}
+
+func TestListOverdueLoans(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+	router := newLoanTestRouter(clock)
+
+	doLoanRequest(router, "POST", "/v1/books/1/checkout", `{"borrower_id":"alice"}`)
+	clock.Advance(5 * 24 * time.Hour)
+	doLoanRequest(router, "POST", "/v1/books/2/checkout", `{"borrower_id":"bob"}`)
+	clock.Advance(3 * 24 * time.Hour) // book 1 is now a day late, book 2 is not
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/loans?overdue=true", nil)
+	router.ServeHTTP(w, req)
+
+	var loans []Loan
+	json.Unmarshal(w.Body.Bytes(), &loans)
+	if len(loans) != 1 || loans[0].BookID != 1 || loans[0].Fine != 50 {
+		t.Errorf("Expected only book 1 overdue with fine 50, got %+v", loans)
+	}
+
+	w2 := httptest.NewRecorder()
+	req2, _ := http.NewRequest("GET", "/v1/loans?overdue=perhaps", nil)
+	router.ServeHTTP(w2, req2)
+	if w2.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for bad overdue flag, got %d", w2.Code)
+	}
+}
+
+func TestDeleteBookOnLoan(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clock := &fakeClock{now: time.Now()}
+	router := newLoanTestRouter(clock)
+
+	doLoanRequest(router, "POST", "/v1/books/1/checkout", `{"borrower_id":"alice"}`)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/v1/books/1", nil)
+	authorize(req, RoleAdmin)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status 409 deleting a book on loan, got %d", w.Code)
+	}
+
+	doLoanRequest(router, "POST", "/v1/books/1/return", "")
+
+	w2 := httptest.NewRecorder()
+	req2, _ := http.NewRequest("DELETE", "/v1/books/1", nil)
+	authorize(req2, RoleAdmin)
+	router.ServeHTTP(w2, req2)
+	if w2.Code != http.StatusOK {
+		t.Errorf("Expected status 200 after return, got %d", w2.Code)
+	}
+}
+
+func TestLoansSurviveRestart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clock := &fakeClock{now: time.Now()}
+	path := filepath.Join(t.TempDir(), "books.json")
+	restart := func() *gin.Engine {
+		t.Helper()
+		repo, err := NewFileBookRepository(path, defaultBooks()...)
+		if err != nil {
+			t.Fatalf("NewFileBookRepository: %v", err)
+		}
+		return setupRouter(repo, WithClock(clock.Now), WithAuthSecret(testSecret))
+	}
+
+	router := restart()
+	doLoanRequest(router, "POST", "/v1/books/1/checkout", `{"borrower_id":"alice"}`)
+	doLoanRequest(router, "POST", "/v1/books/2/checkout", `{"borrower_id":"bob"}`)
+	doLoanRequest(router, "POST", "/v1/books/2/return", "")
+
+	router = restart()
+	if w, _ := doLoanRequest(router, "DELETE", "/v1/books/1", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected the loan to still block deleting book 1, got %d", w.Code)
+	}
+	if w, _ := doLoanRequest(router, "POST", "/v1/books/1/checkout", `{"borrower_id":"carol"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected book 1 to still be on loan, got %d", w.Code)
+	}
+	w, loan := doLoanRequest(router, "POST", "/v1/books/2/checkout", `{"borrower_id":"carol"}`)
+	if w.Code != http.StatusCreated || loan.ID != 3 {
+		t.Errorf("Expected a new loan with ID 3 for the returned book, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCheckoutValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newLoanTestRouter(&fakeClock{now: time.Now()})
+
+	if w, _ := doLoanRequest(router, "POST", "/v1/books/1/checkout", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without borrower_id, got %d", w.Code)
+	}
+	if w, _ := doLoanRequest(router, "POST", "/v1/books/999/checkout", `{"borrower_id":"alice"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown book, got %d", w.Code)
+	}
+}
@@ -1,136 +1,598 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 // Book represents a book in our library
 type Book struct {
-	ID     int    `json:"id"`
-	Title  string `json:"title" binding:"required"`
-	Author string `json:"author" binding:"required"`
-	Year   int    `json:"year" binding:"required,min=1000,max=2100"`
+	ID        int        `json:"id"`
+	Title     string     `json:"title" binding:"required"`
+	Author    string     `json:"author" binding:"required_without=AuthorIDs"` // byline; derived from AuthorIDs when set
+	Year      int        `json:"year" binding:"required,min=1000,max=2100"`
+	Published string     `json:"published,omitempty"`  // full date when known: YYYY, YYYY-MM or YYYY-MM-DD
+	ISBN      string     `json:"isbn,omitempty"`       // optional; stored as a bare ISBN-13
+	AuthorIDs []int      `json:"author_ids,omitempty"` // credited authors, in order
+	Version   int        `json:"version"`              // bumped on every write, exposed as the ETag
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // set by a soft delete; never taken from requests
 }
 
-// In-memory storage
-var books = []Book{
-	{ID: 1, Title: "The Go Programming Language", Author: "Donovan & Kernighan", Year: 2015},
-	{ID: 2, Title: "Clean Code", Author: "Robert Martin", Year: 2008},
+// Deleted reports whether the book has been soft-deleted
+func (b Book) Deleted() bool {
+	return b.DeletedAt != nil
+}
+
+// normalize canonicalises fields that accept more than one spelling.
+// An ISBN-10 or hyphenated ISBN becomes a bare ISBN-13. Year is
+// authoritative: a published date from another year is dropped, so a
+// v1 client that only edits the year never leaves the two disagreeing.
+func (b *Book) normalize() error {
+	if b.Published != "" {
+		year, err := parsePublished(b.Published)
+		if err != nil {
+			return err
+		}
+		if year != b.Year {
+			b.Published = ""
+		}
+	}
+	if b.ISBN == "" {
+		return nil
+	}
+	isbn, err := NormalizeISBN(b.ISBN)
+	if err != nil {
+		return &FieldError{
+			Violation: Violation{Field: "isbn", Rule: "isbn", Message: fmt.Sprintf("isbn %q: %v", b.ISBN, err)},
+			Err:       err,
+		}
+	}
+	b.ISBN = isbn
+	return nil
 }
-var nextID = 3
 
 func main() {
-	router := setupRouter()
+	dataFile := flag.String("data", "", "path to a JSON file for persistent storage (in-memory if empty)")
+	policy := DefaultLoanPolicy()
+	flag.DurationVar(&policy.Period, "loan-period", policy.Period, "how long a checkout or renewal lasts")
+	flag.IntVar(&policy.MaxRenewals, "max-renewals", policy.MaxRenewals, "renewals allowed per loan")
+	flag.IntVar(&policy.FinePerDay, "fine-per-day", policy.FinePerDay, "late fine per day, in cents")
+	flag.IntVar(&policy.MaxFine, "max-fine", policy.MaxFine, "maximum fine per loan, in cents (0 = no cap)")
+	idempotencyTTL := flag.Duration("idempotency-ttl", defaultIdempotencyTTL, "how long Idempotency-Key responses are replayed")
+	jwtSecret := flag.String("jwt-secret", os.Getenv("JWT_SECRET"), "HMAC key for bearer tokens (default $JWT_SECRET)")
+	issueRole := flag.String("issue-token", "", "print a token for this role (reader, librarian or admin) and exit")
+	issueSubject := flag.String("token-subject", "dev", "subject of the token printed by -issue-token")
+	issueTTL := flag.Duration("token-ttl", 24*time.Hour, "lifetime of the token printed by -issue-token")
+	v1Sunset := flag.String("v1-sunset", defaultV1Sunset.Format("2006-01-02"), "date announced in the Sunset header of /v1 responses")
+	flag.Parse()
+
+	sunset, err := time.Parse("2006-01-02", *v1Sunset)
+	if err != nil {
+		log.Fatalf("-v1-sunset: %v", err)
+	}
+
+	if *issueRole != "" {
+		if *jwtSecret == "" {
+			log.Fatal("set -jwt-secret or JWT_SECRET to sign a token the server will accept")
+		}
+		token, err := NewAuthenticator([]byte(*jwtSecret), time.Now).Issue(*issueSubject, Role(*issueRole), *issueTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(token)
+		return
+	}
+
+	var repo BookRepository = NewMemoryBookRepository(defaultBooks()...)
+	if *dataFile != "" {
+		fileRepo, err := NewFileBookRepository(*dataFile, defaultBooks()...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		repo = fileRepo
+	}
+
+	if *jwtSecret == "" {
+		// setupRouter falls back to a random key: reads work, writes don't
+		log.Print("warning: no -jwt-secret or JWT_SECRET set; no token will be accepted, so the API is read-only")
+	}
+
+	router := setupRouter(repo,
+		WithLoanPolicy(policy),
+		WithIdempotencyTTL(*idempotencyTTL),
+		WithAuthSecret([]byte(*jwtSecret)),
+		WithV1Sunset(sunset),
+	)
 	router.Run(":8080")
 }
 
-func setupRouter() *gin.Engine {
+// routerConfig holds the optional settings for setupRouter
+type routerConfig struct {
+	loanPolicy     LoanPolicy
+	idempotencyTTL time.Duration
+	authSecret     []byte
+	v1Sunset       time.Time
+	now            func() time.Time
+}
+
+// defaultIdempotencyTTL is how long a retry can replay the original response
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// RouterOption customises setupRouter
+type RouterOption func(*routerConfig)
+
+// WithLoanPolicy overrides DefaultLoanPolicy
+func WithLoanPolicy(p LoanPolicy) RouterOption {
+	return func(cfg *routerConfig) { cfg.loanPolicy = p }
+}
+
+// WithIdempotencyTTL sets how long Idempotency-Key responses are kept
+func WithIdempotencyTTL(ttl time.Duration) RouterOption {
+	return func(cfg *routerConfig) { cfg.idempotencyTTL = ttl }
+}
+
+// WithAuthSecret sets the HMAC key bearer tokens are verified with.
+// Without it a random key is used, so no token is accepted and every
+// write is refused.
+func WithAuthSecret(secret []byte) RouterOption {
+	return func(cfg *routerConfig) { cfg.authSecret = secret }
+}
+
+// WithV1Sunset sets the date /v1 responses announce it will be removed
+func WithV1Sunset(t time.Time) RouterOption {
+	return func(cfg *routerConfig) { cfg.v1Sunset = t }
+}
+
+// WithClock replaces time.Now, so tests can move time forward
+func WithClock(now func() time.Time) RouterOption {
+	return func(cfg *routerConfig) { cfg.now = now }
+}
+
+func setupRouter(repo BookRepository, opts ...RouterOption) *gin.Engine {
+	cfg := routerConfig{
+		loanPolicy:     DefaultLoanPolicy(),
+		idempotencyTTL: defaultIdempotencyTTL,
+		v1Sunset:       defaultV1Sunset,
+		now:            time.Now,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if len(cfg.authSecret) == 0 {
+		cfg.authSecret = randomSecret()
+	}
+
+	// Loans and authors are saved alongside the books when the
+	// repository can hold their state, i.e. with -data
+	state, _ := repo.(StateStore)
+
+	// Every write below goes through the indexing wrapper, so search
+	// results always reflect the catalogue
+	existing, err := repo.List()
+	if err != nil {
+		log.Printf("search index: %v", err)
+	}
+	search := NewSearchIndex(existing...)
+	repo = &indexedRepository{BookRepository: repo, index: search}
+
 	router := gin.Default()
+	loans, err := NewLoanService(repo, state, cfg.loanPolicy, cfg.now)
+	if err != nil {
+		// Starting without them would drop every saved loan on the
+		// next write
+		log.Fatalf("loans: %v", err)
+	}
+	authors, err := NewAuthorService(repo, state)
+	if err != nil {
+		log.Fatalf("authors: %v", err)
+	}
+	lh := &loanHandler{loans: loans}
+	idempotency := NewIdempotencyStore(cfg.idempotencyTTL, cfg.now)
+
+	// Reads are open; creating and changing things needs a librarian,
+	// deleting (or undoing a delete) needs an admin
+	auth := NewAuthenticator(cfg.authSecret, cfg.now)
+
+	index := make(map[string]*apiVersion)
+	root := newRouteTable(&router.RouterGroup, auth)
+	root.handle("index", "GET", "/", "", homeHandler(index))
+	specs := []specVersion{{routes: root}}
 
-	// Routes
-	router.GET("/", homeHandler)
-	router.GET("/books", getBooks)
-	router.GET("/books/:id", getBook)
-	router.POST("/books", createBook)
-	router.PUT("/books/:id", updateBook)
-	router.DELETE("/books/:id", deleteBook)
+	// Every version exposes the same routes over the same services and
+	// differs only in how books are represented
+	versions := []struct {
+		name    string
+		group   *gin.RouterGroup
+		codec   bookCodec
+		version apiVersion
+	}{
+		{"v1", router.Group("/v1", deprecated(v1DeprecatedAt, cfg.v1Sunset)), v1Codec{authors: authors},
+			apiVersion{Status: "deprecated", Sunset: cfg.v1Sunset.Format("2006-01-02")}},
+		{"v2", router.Group("/v2"), v2Codec{authors: authors}, apiVersion{Status: "current"}},
+	}
+	for _, v := range versions {
+		h := &bookHandler{repo: repo, loans: loans, authors: authors, search: search, codec: v.codec, base: v.group.BasePath()}
+		ah := &authorHandler{authors: authors, books: h}
+
+		r := newRouteTable(v.group, auth)
+		r.handle("books", "GET", "/books", "", h.getBooks)
+		r.handle("book", "GET", "/books/:id", "", h.getBook)
+		r.handle("book-by-isbn", "GET", "/books/isbn/:isbn", "", h.getBookByISBN)
+		r.handle("search", "GET", "/books/search", "", h.searchBooks)
+		r.handle("export", "GET", "/books/export", "", h.exportBooks)
+		r.handle("create-book", "POST", "/books", RoleLibrarian, idempotent(idempotency), h.createBook)
+		r.handle("import", "POST", "/books/import", RoleLibrarian, h.importBooks)
+		r.handle("update-book", "PUT", "/books/:id", RoleLibrarian, h.updateBook)
+		r.handle("patch-book", "PATCH", "/books/:id", RoleLibrarian, h.patchBook)
+		r.handle("delete-book", "DELETE", "/books/:id", RoleAdmin, h.deleteBook)
+		r.handle("restore-book", "POST", "/books/:id/restore", RoleAdmin, h.restoreBook)
+		r.handle("book-history", "GET", "/books/:id/history", "", h.getBookHistory)
+		r.handle("checkout", "POST", "/books/:id/checkout", RoleLibrarian, lh.checkout)
+		r.handle("return", "POST", "/books/:id/return", RoleLibrarian, lh.returnBook)
+		r.handle("renew", "POST", "/books/:id/renew", RoleLibrarian, lh.renew)
+		r.handle("loans", "GET", "/loans", "", lh.getLoans)
+		r.handle("authors", "GET", "/authors", "", ah.getAuthors)
+		r.handle("author", "GET", "/authors/:id", "", ah.getAuthor)
+		r.handle("author-books", "GET", "/authors/:id/books", "", ah.getAuthorBooks)
+		r.handle("create-author", "POST", "/authors", RoleLibrarian, ah.createAuthor)
+		r.handle("update-author", "PUT", "/authors/:id", RoleLibrarian, ah.updateAuthor)
+		r.handle("delete-author", "DELETE", "/authors/:id", RoleAdmin, ah.deleteAuthor)
+
+		version := v.version
+		version.Links = r.links
+		index[v.name] = &version
+		specs = append(specs, specVersion{routes: r, book: reflect.TypeOf(v.codec.encode(Book{})), dateMember: v.codec.dateMember(),
+			deprecated: v.version.Status == "deprecated"})
+	}
+	root.handle("openapi", "GET", "/openapi.json", "", openAPIHandler(specs))
+	router.NoRoute(func(c *gin.Context) {
+		detail := "No route matches " + c.Request.Method + " " + c.Request.URL.Path
+		if !strings.HasPrefix(c.Request.URL.Path, "/v1/") && !strings.HasPrefix(c.Request.URL.Path, "/v2/") {
+			detail += "; the API is served under /v1 and /v2"
+		}
+		respondProblem(c, http.StatusNotFound, "route_not_found", detail)
+	})
 
 	return router
 }
 
-func homeHandler(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Welcome to Book API",
-		"endpoints": gin.H{
-			"GET /books":      "List all books",
-			"GET /books/:id":  "Get book by ID",
-			"POST /books":     "Create new book",
-			"PUT /books/:id":  "Update book",
-			"DELETE /books/:id": "Delete book",
-		},
-	})
+// bookHandler serves the /books routes. It only talks to the
+// repository interface, never to storage directly.
+type bookHandler struct {
+	repo    BookRepository
+	loans   *LoanService   // consulted so books on loan cannot be deleted
+	authors *AuthorService // validates author_ids and expands ?include=authors
+	search  *SearchIndex   // kept in sync by indexedRepository
+	codec   bookCodec      // the API version's representation of a book
+	base    string         // the version's path prefix, for _links
 }
 
-func getBooks(c *gin.Context) {
-	c.JSON(http.StatusOK, books)
+func (h *bookHandler) getBooks(c *gin.Context) {
+	query, errs := parseBookQuery(c.Request.URL.Query(), h.codec.dateMember())
+	if len(errs) > 0 {
+		respondProblem(c, http.StatusBadRequest, "invalid_query", "Invalid query parameters", errs...)
+		return
+	}
+
+	includeAuthors, ok := parseIncludes(c)
+	if !ok {
+		return
+	}
+	fields, ok := parseFields(c, bookMembers(h.codec))
+	if !ok {
+		return
+	}
+
+	books, err := h.repo.List()
+	if err != nil {
+		respondRepoError(c, err)
+		return
+	}
+
+	page, total := query.apply(books)
+
+	body := make([]bookView, len(page))
+	for i, b := range page {
+		body[i] = h.view(b, includeAuthors, fields)
+	}
+
+	etag := listETag(body, total)
+	c.Header("ETag", etag)
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.Header("Link", query.linkHeader(c.Request.URL, total))
+	if etagMatches(c.GetHeader("If-None-Match"), etag, true) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, body)
 }
 
-func getBook(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+func (h *bookHandler) getBook(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	book, err := h.repo.Get(id)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		respondRepoError(c, err)
 		return
 	}
 
-	for _, book := range books {
-		if book.ID == id {
-			c.JSON(http.StatusOK, book)
-			return
-		}
+	h.respondBook(c, book)
+}
+
+func (h *bookHandler) getBookByISBN(c *gin.Context) {
+	isbn, err := NormalizeISBN(c.Param("isbn"))
+	if err != nil {
+		respondProblem(c, http.StatusBadRequest, "invalid_isbn", fmt.Sprintf("%q is not a valid ISBN-10 or ISBN-13", c.Param("isbn")),
+			Violation{Field: "isbn", Rule: "isbn", Message: err.Error()})
+		return
+	}
+
+	book, err := h.repo.GetByISBN(isbn)
+	if err != nil {
+		respondRepoError(c, err)
+		return
 	}
 
-	c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+	h.respondBook(c, book)
 }
 
-func createBook(c *gin.Context) {
-	var newBook Book
+// respondBook writes a single book with its ETag, honouring
+// If-None-Match, ?include=authors and ?fields=
+func (h *bookHandler) respondBook(c *gin.Context, book Book) {
+	if book.Deleted() {
+		respondRepoError(c, ErrBookDeleted)
+		return
+	}
+
+	includeAuthors, ok := parseIncludes(c)
+	if !ok {
+		return
+	}
+	fields, ok := parseFields(c, bookMembers(h.codec))
+	if !ok {
+		return
+	}
+
+	// The tag follows the stored version so it can be sent back in
+	// If-Match
+	body := h.view(book, includeAuthors, fields)
+	etag := h.etag(book)
+	if includeAuthors {
+		// Author renames change this representation without bumping
+		// the book's version, so tag the expanded body itself
+		etag = contentETag(body)
+	}
 
-	// Bind and validate
-	if err := c.ShouldBindJSON(&newBook); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag, true) {
+		c.Status(http.StatusNotModified)
 		return
 	}
+	c.JSON(http.StatusOK, body)
+}
 
-	newBook.ID = nextID
-	nextID++
+func (h *bookHandler) createBook(c *gin.Context) {
+	newBook, _, err := h.readBook(c)
+	if err != nil {
+		respondInvalid(c, http.StatusBadRequest, err)
+		return
+	}
 
-	books = append(books, newBook)
+	var created Book
+	err = h.authors.Link(func() error {
+		var err error
+		created, err = h.repo.As(subject(c)).Create(newBook)
+		return err
+	}, &newBook)
+	if err != nil {
+		respondAuthorError(c, err)
+		return
+	}
 
-	c.JSON(http.StatusCreated, newBook)
+	c.Header("ETag", h.etag(created))
+	c.JSON(http.StatusCreated, h.view(created, false, nil))
 }
 
-func updateBook(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+func (h *bookHandler) updateBook(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	updatedBook, data, err := h.readBook(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		respondInvalid(c, http.StatusBadRequest, err)
 		return
 	}
 
-	var updatedBook Book
-	if err := c.ShouldBindJSON(&updatedBook); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	current, ok := h.loadForWrite(c, id)
+	if !ok {
 		return
 	}
+	h.codec.keep(data, current, &updatedBook)
 
-	for i, book := range books {
-		if book.ID == id {
-			updatedBook.ID = id
-			books[i] = updatedBook
-			c.JSON(http.StatusOK, updatedBook)
-			return
-		}
+	// Only hold the write to the version the client saw if it asked us to
+	version := 0
+	if c.GetHeader("If-Match") != "" {
+		version = current.Version
+	}
+
+	var updated Book
+	err = h.authors.Link(func() error {
+		var err error
+		updated, err = h.repo.As(subject(c)).Update(id, updatedBook, version)
+		return err
+	}, &updatedBook)
+	if err != nil {
+		respondAuthorError(c, err)
+		return
 	}
 
-	c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+	c.Header("ETag", h.etag(updated))
+	c.JSON(http.StatusOK, h.view(updated, false, nil))
 }
 
-func deleteBook(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+func (h *bookHandler) patchBook(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	patch, err := io.ReadAll(c.Request.Body)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		respondProblem(c, http.StatusBadRequest, "malformed_body", err.Error())
 		return
 	}
 
-	for i, book := range books {
-		if book.ID == id {
-			books = append(books[:i], books[i+1:]...)
-			c.JSON(http.StatusOK, gin.H{"message": "Book deleted"})
-			return
-		}
+	book, ok := h.loadForWrite(c, id)
+	if !ok {
+		return
+	}
+
+	// Patches apply to the representation the client sees, so a v2
+	// client patches "published" and a v1 client patches "year"
+	patchedDoc, err := patchDocument(h.codec.encode(book), c.ContentType(), patch)
+	var patchErr *PatchError
+	switch {
+	case errors.Is(err, ErrUnsupportedPatch):
+		c.Header("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		respondProblem(c, http.StatusUnsupportedMediaType, "unsupported_patch", err.Error())
+		return
+	case errors.Is(err, ErrPatchTestFailed):
+		respondProblem(c, http.StatusConflict, "patch_test_failed", err.Error())
+		return
+	case errors.As(err, &patchErr):
+		respondProblem(c, http.StatusBadRequest, "invalid_patch", err.Error())
+		return
+	case err != nil:
+		respondProblem(c, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	// The patched book must satisfy the same rules as PUT. A well-formed
+	// patch can still produce something that is not a book, e.g. a
+	// string where the year should be.
+	patched, err := h.checkBook(h.codec.decode(patchedDoc))
+	if err != nil {
+		respondInvalid(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	// The patch was computed from this exact version, so never let it
+	// overwrite a newer one
+	var updated Book
+	err = h.authors.Link(func() error {
+		var err error
+		updated, err = h.repo.As(subject(c)).Update(id, patched, book.Version)
+		return err
+	}, &patched)
+	if errors.Is(err, ErrVersionConflict) && c.GetHeader("If-Match") == "" {
+		respondProblem(c, http.StatusConflict, "concurrent_modification", "Book was modified concurrently, retry the patch")
+		return
+	}
+	if err != nil {
+		respondAuthorError(c, err)
+		return
+	}
+
+	c.Header("ETag", h.etag(updated))
+	c.JSON(http.StatusOK, h.view(updated, false, nil))
+}
+
+func (h *bookHandler) deleteBook(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	current, ok := h.loadForWrite(c, id)
+	if !ok {
+		return
+	}
+
+	version := 0
+	if c.GetHeader("If-Match") != "" {
+		version = current.Version
+	}
+
+	err := h.loans.GuardDelete(id, func() error {
+		return h.repo.As(subject(c)).Delete(id, version)
+	})
+	if err != nil {
+		respondLoanError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Book deleted"})
+}
+
+// loadForWrite fetches the book a write targets and evaluates If-Match
+// against its current ETag. When it returns false the response has
+// already been written.
+func (h *bookHandler) loadForWrite(c *gin.Context, id int) (Book, bool) {
+	book, err := h.repo.Get(id)
+	if err == nil && book.Deleted() {
+		err = ErrBookDeleted // restore it first
 	}
+	if err != nil {
+		respondRepoError(c, err)
+		return Book{}, false
+	}
+	if !h.ifMatches(c, book) {
+		return Book{}, false
+	}
+	return book, true
+}
+
+// etag is the book's ETag as this handler serves it
+func (h *bookHandler) etag(book Book) string {
+	return bookETag(book, h.loans.HasLoans(book.ID))
+}
 
-	c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+// ifMatches evaluates If-Match against the book's current ETag and
+// answers 412 when it fails. A request without If-Match always passes.
+// The tag from before the book's first checkout still matches: only the
+// links changed, not the book.
+func (h *bookHandler) ifMatches(c *gin.Context, book Book) bool {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, bookETag(book, false), false) && !etagMatches(ifMatch, bookETag(book, true), false) {
+		c.Header("ETag", h.etag(book))
+		respondProblem(c, http.StatusPreconditionFailed, "precondition_failed", "Book has been modified since it was fetched")
+		return false
+	}
+	return true
+}
+
+// respondRepoError maps repository errors to HTTP responses
+func respondRepoError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrBookNotFound):
+		respondProblem(c, http.StatusNotFound, "book_not_found", "Book not found")
+	case errors.Is(err, ErrBookDeleted):
+		// Deleted books stay hidden, but say why and how to undo it
+		respondProblem(c, http.StatusNotFound, "book_deleted", "Book has been deleted; POST /books/:id/restore brings it back")
+	case errors.Is(err, ErrBookNotDeleted):
+		respondProblem(c, http.StatusConflict, "book_not_deleted", "Book is not deleted")
+	case errors.Is(err, ErrVersionConflict):
+		respondProblem(c, http.StatusPreconditionFailed, "precondition_failed", "Book has been modified since it was fetched")
+	case errors.Is(err, ErrDuplicateISBN):
+		respondProblem(c, http.StatusConflict, "duplicate_isbn", err.Error(),
+			Violation{Field: "isbn", Rule: "unique", Message: err.Error()})
+	default:
+		respondProblem(c, http.StatusInternalServerError, "internal_error", err.Error())
+	}
 }
@@ -5,17 +5,24 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 )
 
+// newTestRouter builds a router backed by a fresh in-memory repository
+// holding the default catalogue
+func newTestRouter() *gin.Engine {
+	return setupRouter(NewMemoryBookRepository(defaultBooks()...), WithAuthSecret(testSecret))
+}
+
 func TestGetBooks(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	router := setupRouter()
+	router := newTestRouter()
 
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/books", nil)
+	req, _ := http.NewRequest("GET", "/v1/books", nil)
 	router.ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
@@ -32,10 +39,10 @@ func TestGetBooks(t *testing.T) {
 
 func TestGetBook(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	router := setupRouter()
+	router := newTestRouter()
 
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/books/1", nil)
+	req, _ := http.NewRequest("GET", "/v1/books/1", nil)
 	router.ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
@@ -52,10 +59,10 @@ func TestGetBook(t *testing.T) {
 
 func TestGetBookNotFound(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	router := setupRouter()
+	router := newTestRouter()
 
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/books/999", nil)
+	req, _ := http.NewRequest("GET", "/v1/books/999", nil)
 	router.ServeHTTP(w, req)
 
 	if w.Code != http.StatusNotFound {
@@ -65,7 +72,7 @@ func TestGetBookNotFound(t *testing.T) {
 
 func TestCreateBook(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	router := setupRouter()
+	router := newTestRouter()
 
 	newBook := Book{
 		Title:  "Test Book",
@@ -75,7 +82,8 @@ func TestCreateBook(t *testing.T) {
 
 	jsonData, _ := json.Marshal(newBook)
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("POST", "/books", bytes.NewBuffer(jsonData))
+	req, _ := http.NewRequest("POST", "/v1/books", bytes.NewBuffer(jsonData))
+	authorize(req, RoleAdmin)
 	req.Header.Set("Content-Type", "application/json")
 	router.ServeHTTP(w, req)
 
@@ -96,7 +104,7 @@ func TestCreateBook(t *testing.T) {
 
 func TestCreateBookValidation(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	router := setupRouter()
+	router := newTestRouter()
 
 	invalidBook := map[string]interface{}{
 		"title":  "",
@@ -106,7 +114,8 @@ func TestCreateBookValidation(t *testing.T) {
 
 	jsonData, _ := json.Marshal(invalidBook)
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("POST", "/books", bytes.NewBuffer(jsonData))
+	req, _ := http.NewRequest("POST", "/v1/books", bytes.NewBuffer(jsonData))
+	authorize(req, RoleAdmin)
 	req.Header.Set("Content-Type", "application/json")
 	router.ServeHTTP(w, req)
 
@@ -117,7 +126,7 @@ func TestCreateBookValidation(t *testing.T) {
 
 func TestUpdateBook(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	router := setupRouter()
+	router := newTestRouter()
 
 	updatedBook := Book{
 		Title:  "Updated Title",
@@ -127,7 +136,8 @@ func TestUpdateBook(t *testing.T) {
 
 	jsonData, _ := json.Marshal(updatedBook)
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/books/1", bytes.NewBuffer(jsonData))
+	req, _ := http.NewRequest("PUT", "/v1/books/1", bytes.NewBuffer(jsonData))
+	authorize(req, RoleAdmin)
 	req.Header.Set("Content-Type", "application/json")
 	router.ServeHTTP(w, req)
 
@@ -146,16 +156,15 @@ func TestUpdateBook(t *testing.T) {
 func TestDeleteBook(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
-	// Reset books for this test
-	books = []Book{
-		{ID: 1, Title: "Book 1", Author: "Author 1", Year: 2020},
-		{ID: 2, Title: "Book 2", Author: "Author 2", Year: 2021},
-	}
-
-	router := setupRouter()
+	// Use a fresh repository for this test
+	router := setupRouter(NewMemoryBookRepository(
+		Book{ID: 1, Title: "Book 1", Author: "Author 1", Year: 2020},
+		Book{ID: 2, Title: "Book 2", Author: "Author 2", Year: 2021},
+	), WithAuthSecret(testSecret))
 
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("DELETE", "/books/1", nil)
+	req, _ := http.NewRequest("DELETE", "/v1/books/1", nil)
+	authorize(req, RoleAdmin)
 	router.ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
@@ -164,10 +173,184 @@ func TestDeleteBook(t *testing.T) {
 
 	// Verify book is deleted
 	w2 := httptest.NewRecorder()
-	req2, _ := http.NewRequest("GET", "/books/1", nil)
+	req2, _ := http.NewRequest("GET", "/v1/books/1", nil)
 	router.ServeHTTP(w2, req2)
 
 	if w2.Code != http.StatusNotFound {
 		t.Errorf("Expected book to be deleted, but got status %d", w2.Code)
 	}
 }
+
+func TestGetBookETag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books/1", nil)
+	router.ServeHTTP(w, req)
+
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag header")
+	}
+
+	// Same ETag: nothing changed, no body
+	w2 := httptest.NewRecorder()
+	req2, _ := http.NewRequest("GET", "/v1/books/1", nil)
+	req2.Header.Set("If-None-Match", etag)
+	router.ServeHTTP(w2, req2)
+
+	if w2.Code != http.StatusNotModified {
+		t.Errorf("Expected status 304, got %d", w2.Code)
+	}
+	if w2.Body.Len() != 0 {
+		t.Errorf("Expected empty body on 304, got %q", w2.Body.String())
+	}
+}
+
+func TestGetBookETagAfterFirstCheckout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+	before := doJSON(router, "GET", "/v1/books/1", nil).Header().Get("ETag")
+
+	// The first checkout adds a loans link without a new version
+	doJSON(router, "POST", "/v1/books/1/checkout", map[string]string{"borrower_id": "alice"})
+
+	req, _ := http.NewRequest("GET", "/v1/books/1", nil)
+	req.Header.Set("If-None-Match", before)
+	w := serve(router, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/v1/loans?book_id=1") {
+		t.Fatalf("Expected the representation with the loans link, got %d: %s", w.Code, w.Body.String())
+	}
+	after := w.Header().Get("ETag")
+	if after == before {
+		t.Errorf("Expected a new ETag once the book has loans, got %s again", after)
+	}
+
+	// The book itself did not change, so the old tag still passes If-Match
+	patch, _ := http.NewRequest("PATCH", "/v1/books/1", strings.NewReader(`{"title":"Renamed"}`))
+	authorize(patch, RoleAdmin)
+	patch.Header.Set("Content-Type", mergePatchType)
+	patch.Header.Set("If-Match", before)
+	w = serve(router, patch)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 with the pre-checkout tag, got %d", w.Code)
+	}
+	if got := doJSON(router, "GET", "/v1/books/1", nil).Header().Get("ETag"); got != w.Header().Get("ETag") {
+		t.Errorf("Expected GET to agree with the PATCH response's ETag %s, got %s", w.Header().Get("ETag"), got)
+	}
+}
+
+func TestGetBooksETag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books", nil)
+	router.ServeHTTP(w, req)
+	etag := w.Header().Get("ETag")
+
+	w2 := httptest.NewRecorder()
+	req2, _ := http.NewRequest("GET", "/v1/books", nil)
+	req2.Header.Set("If-None-Match", etag)
+	router.ServeHTTP(w2, req2)
+	if w2.Code != http.StatusNotModified {
+		t.Errorf("Expected status 304, got %d", w2.Code)
+	}
+
+	// After a write the list ETag must change
+	jsonData, _ := json.Marshal(Book{Title: "New", Author: "Author", Year: 2024})
+	w3 := httptest.NewRecorder()
+	req3, _ := http.NewRequest("POST", "/v1/books", bytes.NewBuffer(jsonData))
+	authorize(req3, RoleAdmin)
+	req3.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w3, req3)
+
+	w4 := httptest.NewRecorder()
+	req4, _ := http.NewRequest("GET", "/v1/books", nil)
+	req4.Header.Set("If-None-Match", etag)
+	router.ServeHTTP(w4, req4)
+	if w4.Code != http.StatusOK {
+		t.Errorf("Expected status 200 after a change, got %d", w4.Code)
+	}
+}
+
+func TestUpdateBookIfMatchConflict(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	// Both clients fetch the same version
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books/1", nil)
+	router.ServeHTTP(w, req)
+	etag := w.Header().Get("ETag")
+
+	update := func(title string) *httptest.ResponseRecorder {
+		jsonData, _ := json.Marshal(Book{Title: title, Author: "Author", Year: 2020})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/v1/books/1", bytes.NewBuffer(jsonData))
+		authorize(req, RoleAdmin)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", etag)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	first := update("First writer")
+	if first.Code != http.StatusOK {
+		t.Fatalf("Expected first update to succeed, got %d", first.Code)
+	}
+	if first.Header().Get("ETag") == etag {
+		t.Error("Expected ETag to change after update")
+	}
+
+	second := update("Second writer")
+	if second.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status 412 for stale If-Match, got %d", second.Code)
+	}
+
+	// The first write must have survived
+	w2 := httptest.NewRecorder()
+	req2, _ := http.NewRequest("GET", "/v1/books/1", nil)
+	router.ServeHTTP(w2, req2)
+	var book Book
+	json.Unmarshal(w2.Body.Bytes(), &book)
+	if book.Title != "First writer" {
+		t.Errorf("Expected title 'First writer', got %s", book.Title)
+	}
+}
+
+func TestPatchAndDeleteIfMatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	stale := `"1-0"`
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/v1/books/1", bytes.NewBufferString(`{"year":2016}`))
+	authorize(req, RoleAdmin)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("If-Match", stale)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected PATCH status 412, got %d", w.Code)
+	}
+
+	w2 := httptest.NewRecorder()
+	req2, _ := http.NewRequest("DELETE", "/v1/books/1", nil)
+	authorize(req2, RoleAdmin)
+	req2.Header.Set("If-Match", stale)
+	router.ServeHTTP(w2, req2)
+	if w2.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected DELETE status 412, got %d", w2.Code)
+	}
+
+	w3 := httptest.NewRecorder()
+	req3, _ := http.NewRequest("DELETE", "/v1/books/1", nil)
+	authorize(req3, RoleAdmin)
+	req3.Header.Set("If-Match", "*")
+	router.ServeHTTP(w3, req3)
+	if w3.Code != http.StatusOK {
+		t.Errorf("Expected DELETE with If-Match * to succeed, got %d", w3.Code)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPIVersion is the OpenAPI release the generated document follows.
+// 3.1 schemas are JSON Schema 2020-12, so null is a type like any other.
+const openAPIVersion = "3.1.0"
+
+// param documents a query parameter or request header
+type param struct {
+	name string
+	typ  string // JSON Schema type
+	desc string
+}
+
+// operationDoc is the hand-written part of an operation: everything the
+// route table and the Go types cannot tell the generator. Operations are
+// keyed by link relation, the same in every version.
+type operationDoc struct {
+	summary  string
+	query    []param
+	headers  []param
+	request  string // request body kind, see requestBody
+	response string // response body kind, see responseBody
+	status   int    // success status; 200 when zero
+}
+
+// Query parameters shared by every operation that returns books
+var (
+	fieldsParam  = param{"fields", "string", "Comma-separated members to return, e.g. id,title"}
+	includeParam = param{"include", "string", "authors to embed the credited authors (v1)"}
+	ifMatch      = param{"If-Match", "string", "Only apply the write to this ETag"}
+)
+
+var operationDocs = map[string]operationDoc{
+	"index":   {summary: "List API versions and their link relations", response: "object"},
+	"openapi": {summary: "This OpenAPI document", response: "object"},
+
+	"books": {summary: "List books", response: "books", query: []param{
+		{"author", "string", "Exact author, case-insensitive"},
+		{"title_contains", "string", "Substring of the title, case-insensitive"},
+		{"year_gte", "integer", "Published in or after this year"},
+		{"year_lte", "integer", "Published in or before this year"},
+		{"deleted", "string", "exclude (default), include or only"},
+		{"sort", "string", "Comma-separated id, title, author or year; prefix - to reverse"},
+		{"page", "integer", "Page number, from 1"},
+		{"per_page", "integer", "Page size"},
+		includeParam, fieldsParam,
+	}},
+	"book": {summary: "Get a book", response: "book", query: []param{includeParam, fieldsParam},
+		headers: []param{{"If-None-Match", "string", "Answer 304 if the book still has this ETag"}}},
+	"book-by-isbn": {summary: "Get a book by ISBN-10 or ISBN-13", response: "book", query: []param{includeParam, fieldsParam}},
+	"search": {summary: "Full-text search over title and author", response: "search", query: []param{
+		{"q", "string", "Words to look for; the last may be a prefix"},
+		{"limit", "integer", "Maximum hits to return"},
+		fieldsParam,
+	}},
+	"export": {summary: "Export every live book", response: "export", query: []param{
+		{"format", "string", "csv (default) or ndjson"},
+	}},
+	"create-book": {summary: "Create a book", request: "book", response: "book", status: http.StatusCreated,
+		headers: []param{{idempotencyHeader, "string", "Replay the first response for retries with the same key"}}},
+	"import": {summary: "Import books from CSV or NDJSON", request: "import", response: "import", status: http.StatusCreated,
+		query: []param{
+			{"mode", "string", "all_or_nothing (default) or best_effort"},
+			{"dry_run", "boolean", "Validate without importing"},
+		}},
+	"update-book":  {summary: "Replace a book", request: "book", response: "book", headers: []param{ifMatch}},
+	"patch-book":   {summary: "Partially update a book", request: "patch", response: "book", headers: []param{ifMatch}},
+	"delete-book":  {summary: "Soft-delete a book", response: "message", headers: []param{ifMatch}},
+	"restore-book": {summary: "Restore a deleted book", response: "book", headers: []param{ifMatch}},
+	"book-history": {summary: "List every change to a book", response: "history"},
+	"checkout":     {summary: "Check a book out", request: "checkout", response: "loan", status: http.StatusCreated},
+	"return":       {summary: "Return a book", response: "loan"},
+	"renew":        {summary: "Renew a loan", response: "loan"},
+	"loans": {summary: "List loans", response: "loans", query: []param{
+		{"active", "boolean", "Only loans not yet returned"},
+		{"overdue", "boolean", "Only active loans past their due date"},
+		{"borrower_id", "string", "Only this borrower's loans"},
+		{"book_id", "integer", "Only loans of this book"},
+	}},
+	"authors":       {summary: "List authors", response: "authors"},
+	"author":        {summary: "Get an author", response: "author"},
+	"author-books":  {summary: "List the live books crediting an author", response: "books", query: []param{fieldsParam}},
+	"create-author": {summary: "Create an author", request: "author", response: "author", status: http.StatusCreated},
+	"update-author": {summary: "Replace an author", request: "author", response: "author"},
+	"delete-author": {summary: "Delete an author no live book credits", response: "message"},
+}
+
+// publishedQuery replaces the year parameters of GET /books on versions
+// whose books have a published date instead
+var publishedQuery = map[string]param{
+	"year_gte": {"published_gte", "string", "Published on or after this date: YYYY, YYYY-MM or YYYY-MM-DD"},
+	"year_lte": {"published_lte", "string", "Published on or before this date: YYYY, YYYY-MM or YYYY-MM-DD"},
+	"sort":     {"sort", "string", "Comma-separated id, title, author or published; prefix - to reverse"},
+}
+
+// specVersion is a set of routes for the generator: one API version, or
+// the unversioned routes at the root, where book is nil
+type specVersion struct {
+	routes     *routeTable
+	book       reflect.Type // the version's book representation
+	dateMember string       // see bookCodec.dateMember
+	deprecated bool
+}
+
+// openAPIHandler serves a document built from the route tables on the
+// first request, once every route, this one included, is registered
+func openAPIHandler(versions []specVersion) gin.HandlerFunc {
+	var once sync.Once
+	var doc map[string]interface{}
+	return func(c *gin.Context) {
+		once.Do(func() { doc = buildOpenAPI(versions) })
+		c.JSON(http.StatusOK, doc)
+	}
+}
+
+// buildOpenAPI generates the document. Paths come from the route tables,
+// schemas from the Go types and their json and binding tags, and only
+// the summaries and parameters from operationDocs. A route without an
+// entry there is still listed, but with no summary.
+func buildOpenAPI(versions []specVersion) map[string]interface{} {
+	s := &schemaBuilder{components: make(map[string]interface{})}
+	problem := s.schemaOf(reflect.TypeOf(Problem{}))
+	paths := make(map[string]map[string]interface{})
+
+	for _, v := range versions {
+		rels := make([]string, 0, len(v.routes.links))
+		for rel := range v.routes.links {
+			rels = append(rels, rel)
+		}
+		sort.Strings(rels)
+
+		for _, rel := range rels {
+			l := v.routes.links[rel]
+			doc := operationDocs[rel]
+			if rel == "books" && v.dateMember == "published" {
+				query := make([]param, len(doc.query))
+				for i, p := range doc.query {
+					if alt, ok := publishedQuery[p.name]; ok {
+						p = alt
+					}
+					query[i] = p
+				}
+				doc.query = query
+			}
+			method := l.Method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			status := doc.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			operationID := rel
+			if prefix := strings.Trim(v.routes.group.BasePath(), "/"); prefix != "" {
+				operationID = prefix + "-" + rel
+			}
+			op := map[string]interface{}{
+				"operationId": operationID,
+				"summary":     doc.summary,
+				"parameters":  parameters(l.Href, doc),
+				"responses": map[string]interface{}{
+					strconv.Itoa(status): s.responseBody(doc.response, v.book),
+					"default":            problemResponse("Problem details", problem),
+				},
+			}
+			if v.deprecated {
+				op["deprecated"] = true
+			}
+			if body := s.requestBody(doc.request, v.book); body != nil {
+				op["requestBody"] = body
+			}
+			if l.Role != "" {
+				op["description"] = "Requires the " + string(l.Role) + " role or higher."
+				op["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+				responses := op["responses"].(map[string]interface{})
+				responses["401"] = problemResponse("Missing, invalid or expired token", problem)
+				responses["403"] = problemResponse("The token's role is too low", problem)
+			}
+
+			if paths[l.Href] == nil {
+				paths[l.Href] = make(map[string]interface{})
+			}
+			paths[l.Href][strings.ToLower(method)] = op
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "Book API",
+			"version": "2",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": s.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// templateParam matches the {name} variables of a URI template
+var templateParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// parameters lists the path parameters found in a URI template, then
+// the documented query parameters and headers
+func parameters(href string, doc operationDoc) []interface{} {
+	params := []interface{}{}
+	for _, m := range templateParam.FindAllStringSubmatch(href, -1) {
+		schema := map[string]interface{}{"type": "string"}
+		if m[1] == "id" {
+			schema = map[string]interface{}{"type": "integer", "minimum": 1}
+		}
+		params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": schema})
+	}
+	for _, p := range doc.query {
+		params = append(params, map[string]interface{}{"name": p.name, "in": "query", "description": p.desc,
+			"schema": map[string]interface{}{"type": p.typ}})
+	}
+	for _, p := range doc.headers {
+		params = append(params, map[string]interface{}{"name": p.name, "in": "header", "description": p.desc,
+			"schema": map[string]interface{}{"type": p.typ}})
+	}
+	return params
+}
+
+func problemResponse(description string, problem interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content":     map[string]interface{}{problemContentType: map[string]interface{}{"schema": problem}},
+	}
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// requestBody describes the body of a request kind, nil for none
+func (s *schemaBuilder) requestBody(kind string, book reflect.Type) map[string]interface{} {
+	var content map[string]interface{}
+	switch kind {
+	case "":
+		return nil
+	case "book":
+		content = jsonContent(s.schemaOf(book))
+	case "author":
+		content = jsonContent(s.schemaOf(reflect.TypeOf(Author{})))
+	case "checkout":
+		content = jsonContent(s.schemaOf(reflect.TypeOf(checkoutRequest{})))
+	case "patch":
+		content = map[string]interface{}{
+			mergePatchType: map[string]interface{}{"schema": map[string]interface{}{"type": "object"}},
+			jsonPatchType: map[string]interface{}{"schema": map[string]interface{}{
+				"type": "array", "items": s.schemaOf(reflect.TypeOf(jsonPatchOp{})),
+			}},
+		}
+	case "import":
+		content = map[string]interface{}{
+			"text/csv":             map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			"application/x-ndjson": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		}
+	default:
+		panic("unknown request body kind " + kind)
+	}
+	return map[string]interface{}{"required": true, "content": content}
+}
+
+// responseBody describes the success response of a kind
+func (s *schemaBuilder) responseBody(kind string, book reflect.Type) map[string]interface{} {
+	var schema interface{}
+	switch kind {
+	case "":
+		return map[string]interface{}{"description": "Success"}
+	case "object":
+		schema = map[string]interface{}{"type": "object"}
+	case "book":
+		schema = s.bookResource(book)
+	case "books":
+		schema = arrayOf(s.bookResource(book))
+	case "search":
+		schema = arrayOf(map[string]interface{}{"allOf": []interface{}{
+			s.bookResource(book),
+			map[string]interface{}{"properties": map[string]interface{}{"score": map[string]interface{}{"type": "number"}}},
+		}})
+	case "history":
+		snapshot := nullable(s.schemaOf(book))
+		schema = arrayOf(map[string]interface{}{
+			"type":     "object",
+			"required": []string{"action", "version", "at", "before", "after"},
+			"properties": map[string]interface{}{
+				"action":  map[string]interface{}{"enum": []string{ActionCreate, ActionUpdate, ActionDelete, ActionRestore}},
+				"version": map[string]interface{}{"type": "integer"},
+				"at":      map[string]interface{}{"type": "string", "format": "date-time"},
+				"actor":   map[string]interface{}{"type": "string"},
+				"before":  snapshot,
+				"after":   snapshot,
+			},
+		})
+	case "export":
+		return map[string]interface{}{
+			"description": "The catalogue as an attachment",
+			"content": map[string]interface{}{
+				"text/csv":             map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+				"application/x-ndjson": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			},
+		}
+	case "import":
+		schema = s.schemaOf(reflect.TypeOf(importResult{}))
+	case "message":
+		schema = map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"message": map[string]interface{}{"type": "string"}},
+		}
+	case "loan":
+		schema = s.schemaOf(reflect.TypeOf(Loan{}))
+	case "loans":
+		schema = arrayOf(s.schemaOf(reflect.TypeOf(Loan{})))
+	case "author":
+		schema = s.schemaOf(reflect.TypeOf(Author{}))
+	case "authors":
+		schema = arrayOf(s.schemaOf(reflect.TypeOf(Author{})))
+	default:
+		panic("unknown response body kind " + kind)
+	}
+	return map[string]interface{}{"description": "Success", "content": jsonContent(schema)}
+}
+
+// bookResource is a book as handlers write it: the version's shape plus
+// _links
+func (s *schemaBuilder) bookResource(book reflect.Type) interface{} {
+	return map[string]interface{}{"allOf": []interface{}{
+		s.schemaOf(book),
+		map[string]interface{}{"properties": map[string]interface{}{
+			"_links": map[string]interface{}{"type": "object", "additionalProperties": s.schemaOf(reflect.TypeOf(link{}))},
+		}},
+	}}
+}
+
+func arrayOf(items interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+// nullable widens a schema to also accept null
+func nullable(schema map[string]interface{}) map[string]interface{} {
+	if t, ok := schema["type"].(string); ok {
+		widened := make(map[string]interface{}, len(schema))
+		for k, v := range schema {
+			widened[k] = v
+		}
+		widened["type"] = []string{t, "null"}
+		return widened
+	}
+	return map[string]interface{}{"oneOf": []interface{}{schema, map[string]interface{}{"type": "null"}}}
+}
+
+// schemaBuilder turns Go types into JSON Schemas. Structs become named
+// components and are referenced by $ref.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+func (s *schemaBuilder) schemaOf(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(s.schemaOf(t.Elem()))
+	case reflect.Struct:
+		name := componentName(t)
+		if _, done := s.components[name]; !done {
+			s.components[name] = nil // reserve the name first, in case the type refers to itself
+			s.components[name] = s.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	case reflect.Slice, reflect.Array:
+		return arrayOf(s.schemaOf(t.Elem()))
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schemaOf(t.Elem())}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	default:
+		return map[string]interface{}{} // any value
+	}
+}
+
+// componentName exports a type's name, e.g. importResult -> ImportResult
+func componentName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+func (s *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	s.addFields(t, properties, &required)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields adds a struct's JSON members to properties, with the
+// constraints from their binding tags. Embedded structs contribute their
+// members directly, as encoding/json promotes them.
+func (s *schemaBuilder) addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			s.addFields(f.Type, properties, required)
+			continue
+		}
+		name := jsonName(f)
+		if name == "" {
+			continue
+		}
+
+		prop := s.schemaOf(f.Type)
+		if _, isRef := prop["$ref"]; isRef && f.Tag.Get("binding") != "" {
+			// Keywords next to $ref are allowed in 3.1, but keep refs bare
+			prop = map[string]interface{}{"allOf": []interface{}{prop}}
+		}
+		for _, rule := range strings.Split(f.Tag.Get("binding"), ",") {
+			key, arg, _ := strings.Cut(rule, "=")
+			switch key {
+			case "required":
+				*required = append(*required, name)
+			case "min", "max":
+				n, err := strconv.Atoi(arg)
+				if err != nil {
+					continue
+				}
+				prop[boundKeyword(f.Type.Kind(), key)] = n
+			case "required_without":
+				if other, ok := t.FieldByName(arg); ok {
+					prop["description"] = "Required unless " + jsonName(other) + " is given"
+				}
+			}
+		}
+		properties[name] = prop
+	}
+}
+
+// boundKeyword picks the JSON Schema keyword for a min or max rule,
+// which the validator applies to values, lengths or counts by kind
+func boundKeyword(kind reflect.Kind, rule string) string {
+	switch kind {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return rule + "Items" // minItems, maxItems
+	case reflect.String:
+		return rule + "Length" // minLength, maxLength
+	default:
+		return rule + "imum" // minimum, maximum
+	}
+}
+
+// jsonName is the member name encoding/json uses for a field, or ""
+// when the field is not encoded
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if !f.IsExported() || name == "-" {
+		return ""
+	}
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
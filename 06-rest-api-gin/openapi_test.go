@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPIOperation is the part of an operation the tests look at
+type openAPIOperation struct {
+	OperationID string        `json:"operationId"`
+	Summary     string        `json:"summary"`
+	Deprecated  bool          `json:"deprecated"`
+	Security    []interface{} `json:"security"`
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas map[string]json.RawMessage `json:"schemas"`
+	} `json:"components"`
+}
+
+func fetchOpenAPI(t *testing.T, router *gin.Engine) openAPIDocument {
+	t.Helper()
+	w := doJSON(router, "GET", "/openapi.json", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var doc openAPIDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Expected a JSON document: %v", err)
+	}
+	return doc
+}
+
+// TestOpenAPIDocumentsEveryRoute fails when a route is registered
+// without going through a route table or without an operationDocs entry
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+	doc := fetchOpenAPI(t, router)
+
+	if doc.OpenAPI != "3.1.0" {
+		t.Errorf("Expected OpenAPI 3.1.0, got %q", doc.OpenAPI)
+	}
+
+	used := make(map[string]bool)
+	for _, r := range router.Routes() {
+		path := pathParam.ReplaceAllString(r.Path, "{$1}")
+		op, ok := doc.Paths[path][strings.ToLower(r.Method)]
+		if !ok {
+			t.Errorf("%s %s is not in the OpenAPI document; register it with routeTable.handle", r.Method, path)
+			continue
+		}
+		if op.Summary == "" {
+			t.Errorf("%s %s has no summary; add an operationDocs entry for it", r.Method, path)
+		}
+		_, rel, _ := strings.Cut(op.OperationID, "-")
+		if !strings.HasPrefix(path, "/v") {
+			rel = op.OperationID
+		}
+		used[rel] = true
+	}
+
+	for rel := range operationDocs {
+		if !used[rel] {
+			t.Errorf("operationDocs documents %q, which no route uses", rel)
+		}
+	}
+}
+
+func TestOpenAPIFollowsTheCode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	doc := fetchOpenAPI(t, newTestRouter())
+
+	// Constraints come from the binding tags
+	var book struct {
+		Required   []string `json:"required"`
+		Properties map[string]struct {
+			Minimum *int `json:"minimum"`
+			Maximum *int `json:"maximum"`
+		} `json:"properties"`
+	}
+	json.Unmarshal(doc.Components.Schemas["Book"], &book)
+	year := book.Properties["year"]
+	if year.Minimum == nil || *year.Minimum != 1000 || year.Maximum == nil || *year.Maximum != 2100 {
+		t.Errorf("Expected year between 1000 and 2100, got %+v", year)
+	}
+	if strings.Join(book.Required, ",") != "title,year" {
+		t.Errorf("Expected title and year required, got %v", book.Required)
+	}
+
+	var v2 struct {
+		Properties map[string]struct {
+			MinItems int `json:"minItems"`
+		} `json:"properties"`
+	}
+	json.Unmarshal(doc.Components.Schemas["BookV2"], &v2)
+	if v2.Properties["authors"].MinItems != 1 {
+		t.Errorf("Expected at least one v2 author, got %+v", v2.Properties["authors"])
+	}
+
+	// v1 is deprecated, and writes need a token
+	if !doc.Paths["/v1/books"]["get"].Deprecated || doc.Paths["/v2/books"]["get"].Deprecated {
+		t.Error("Expected only v1 operations to be deprecated")
+	}
+	if len(doc.Paths["/v2/books/{id}"]["delete"].Security) == 0 || len(doc.Paths["/v2/books/{id}"]["get"].Security) != 0 {
+		t.Error("Expected security on writes only")
+	}
+}
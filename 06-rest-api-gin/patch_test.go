@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestApplyMergePatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"replace member", `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{"add member", `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{"null removes", `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{"nested merge", `{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{"array replaced whole", `{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{"non-object patch replaces", `{"a":"b"}`, `["c"]`, `["c"]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyMergePatch([]byte(tt.doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !jsonEqual(t, got, []byte(tt.want)) {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		patch   string
+		want    string
+		wantErr bool
+	}{
+		{"add member", `{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`, false},
+		{"add to array", `{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`, false},
+		{"append to array", `{"a":[1]}`, `[{"op":"add","path":"/a/-","value":2}]`, `{"a":[1,2]}`, false},
+		{"remove", `{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`, `{"b":2}`, false},
+		{"replace", `{"a":1}`, `[{"op":"replace","path":"/a","value":"x"}]`, `{"a":"x"}`, false},
+		{"move", `{"a":{"b":1}}`, `[{"op":"move","from":"/a/b","path":"/c"}]`, `{"a":{},"c":1}`, false},
+		{"copy", `{"a":[1]}`, `[{"op":"copy","from":"/a","path":"/b"}]`, `{"a":[1],"b":[1]}`, false},
+		{"escaped pointer", `{"a/b":1,"m~n":2}`, `[{"op":"remove","path":"/a~1b"},{"op":"remove","path":"/m~0n"}]`, `{}`, false},
+		{"test passes", `{"a":1}`, `[{"op":"test","path":"/a","value":1},{"op":"replace","path":"/a","value":2}]`, `{"a":2}`, false},
+		{"replace missing member", `{"a":1}`, `[{"op":"replace","path":"/b","value":2}]`, "", true},
+		{"unknown op", `{"a":1}`, `[{"op":"frobnicate","path":"/a"}]`, "", true},
+		{"missing value", `{"a":1}`, `[{"op":"add","path":"/b"}]`, "", true},
+		{"move into child", `{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/b"}]`, "", true},
+		{"not an array", `{"a":1}`, `{"op":"remove","path":"/a"}`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyJSONPatch([]byte(tt.doc), []byte(tt.patch))
+			if tt.wantErr {
+				var patchErr *PatchError
+				if !errors.As(err, &patchErr) {
+					t.Fatalf("Expected PatchError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !jsonEqual(t, got, []byte(tt.want)) {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestApplyJSONPatchTestFailure(t *testing.T) {
+	_, err := applyJSONPatch([]byte(`{"a":1}`), []byte(`[{"op":"test","path":"/a","value":2}]`))
+	if !errors.Is(err, ErrPatchTestFailed) {
+		t.Errorf("Expected ErrPatchTestFailed, got %v", err)
+	}
+}
+
+func TestPatchBookEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantYear    int
+	}{
+		{"merge patch year only", mergePatchType, `{"year":2016}`, http.StatusOK, 2016},
+		{"json patch year only", jsonPatchType, `[{"op":"replace","path":"/year","value":2017}]`, http.StatusOK, 2017},
+		{"merge patch cannot change id", mergePatchType, `{"id":42,"year":2018}`, http.StatusOK, 2018},
+		{"year below minimum", mergePatchType, `{"year":999}`, http.StatusUnprocessableEntity, 0},
+		{"removing required field", jsonPatchType, `[{"op":"remove","path":"/title"}]`, http.StatusUnprocessableEntity, 0},
+		{"wrong type", mergePatchType, `{"year":"soon"}`, http.StatusUnprocessableEntity, 0},
+		{"failed test op", jsonPatchType, `[{"op":"test","path":"/year","value":1900}]`, http.StatusConflict, 0},
+		{"malformed patch", jsonPatchType, `{"op":"replace"}`, http.StatusBadRequest, 0},
+		{"plain json rejected", "application/json", `{"year":2016}`, http.StatusUnsupportedMediaType, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestRouter()
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("PATCH", "/v1/books/1", strings.NewReader(tt.body))
+			authorize(req, RoleAdmin)
+			req.Header.Set("Content-Type", tt.contentType)
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var book Book
+			json.Unmarshal(w.Body.Bytes(), &book)
+			if book.ID != 1 {
+				t.Errorf("Expected ID 1, got %d", book.ID)
+			}
+			if book.Year != tt.wantYear {
+				t.Errorf("Expected year %d, got %d", tt.wantYear, book.Year)
+			}
+			if book.Title != "The Go Programming Language" {
+				t.Errorf("Expected title to be untouched, got %s", book.Title)
+			}
+		})
+	}
+}
+
+func TestPatchBookNotFound(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/v1/books/999", strings.NewReader(`{"year":2000}`))
+	authorize(req, RoleAdmin)
+	req.Header.Set("Content-Type", mergePatchType)
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("invalid JSON %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b, err)
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return string(ja) == string(jb)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details body. Code is a stable,
+// machine-readable identifier; Type is derived from it.
+type Problem struct {
+	Type       string      `json:"type"`
+	Title      string      `json:"title"`
+	Status     int         `json:"status"`
+	Detail     string      `json:"detail,omitempty"`
+	Instance   string      `json:"instance,omitempty"`
+	Code       string      `json:"code"`
+	Violations []Violation `json:"violations,omitempty"`
+
+	// Extensions are extra top-level members, as RFC 7807 allows
+	Extensions map[string]interface{} `json:"-"`
+}
+
+// Violation describes one invalid field or parameter. Field is the
+// name the client sent (JSON name or query parameter), not the Go name,
+// and is empty when the problem is not tied to one field.
+type Violation struct {
+	Field   string `json:"field,omitempty"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// MarshalJSON flattens Extensions into the top-level object
+func (p Problem) MarshalJSON() ([]byte, error) {
+	type plain Problem
+	data, err := json.Marshal(plain(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return data, err
+	}
+
+	merged := make(map[string]interface{})
+	for k, v := range p.Extensions {
+		merged[k] = v
+	}
+	var base map[string]interface{}
+	if err := json.Unmarshal(data, &base); err != nil {
+		return nil, err
+	}
+	for k, v := range base {
+		merged[k] = v // standard members win over extensions
+	}
+	return json.Marshal(merged)
+}
+
+func init() {
+	// Report JSON field names ("year") instead of Go names ("Year")
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			return name
+		})
+	}
+}
+
+// newProblem builds a problem for the current request
+func newProblem(c *gin.Context, status int, code, detail string, violations ...Violation) Problem {
+	return Problem{
+		Type:       "/problems/" + strings.ReplaceAll(code, "_", "-"),
+		Title:      http.StatusText(status),
+		Status:     status,
+		Detail:     detail,
+		Instance:   c.Request.URL.RequestURI(),
+		Code:       code,
+		Violations: violations,
+	}
+}
+
+// writeProblem sends p as application/problem+json and stops the chain
+func writeProblem(c *gin.Context, p Problem) {
+	c.Header("Content-Type", problemContentType)
+	c.AbortWithStatusJSON(p.Status, p)
+}
+
+// respondProblem is the one-liner used by handlers for error responses
+func respondProblem(c *gin.Context, status int, code, detail string, violations ...Violation) {
+	writeProblem(c, newProblem(c, status, code, detail, violations...))
+}
+
+// respondInvalid reports a request body or patched result that failed
+// binding or validation, listing every violation. Bodies that are not
+// JSON at all are always a 400.
+func respondInvalid(c *gin.Context, status int, err error) {
+	violations := violationsFrom(err)
+	if len(violations) == 0 {
+		respondProblem(c, http.StatusBadRequest, "malformed_body", "The request body could not be decoded: "+err.Error())
+		return
+	}
+	respondProblem(c, status, "validation_failed", "The request did not pass validation", violations...)
+}
+
+// paramID parses the :id path parameter, answering 400 if it is not an
+// integer. When it returns false the response has been written.
+func paramID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		respondProblem(c, http.StatusBadRequest, "invalid_id", fmt.Sprintf("ID %q is not an integer", c.Param("id")),
+			Violation{Field: "id", Rule: "integer", Message: "id must be an integer"})
+		return 0, false
+	}
+	return id, true
+}
+
+// violationsFrom converts binding, decoding and validation errors into
+// violations. Unrecognised errors produce none.
+func violationsFrom(err error) []Violation {
+	var verrs validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	var fieldErr *FieldError
+
+	switch {
+	case errors.As(err, &verrs):
+		violations := make([]Violation, 0, len(verrs))
+		for _, fe := range verrs {
+			violations = append(violations, Violation{
+				Field:   fieldPath(fe),
+				Rule:    fe.Tag(),
+				Message: ruleMessage(fe),
+			})
+		}
+		return violations
+	case errors.As(err, &typeErr):
+		return []Violation{{
+			Field:   typeErr.Field,
+			Rule:    "type",
+			Message: fmt.Sprintf("%s must be a %s", typeErr.Field, jsonTypeName(typeErr.Type)),
+		}}
+	case errors.As(err, &fieldErr):
+		return []Violation{fieldErr.Violation}
+	default:
+		return nil
+	}
+}
+
+// FieldError is a validation failure found outside the validator, such
+// as a bad ISBN checksum or an unknown author ID
+type FieldError struct {
+	Violation
+	Err error
+}
+
+func (e *FieldError) Error() string { return e.Message }
+
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// fieldPath is the JSON path of a failed field without the Go type it
+// started from, e.g. "authors[0].name" rather than "BookV2.authors[0].name"
+func fieldPath(fe validator.FieldError) string {
+	_, path, found := strings.Cut(fe.Namespace(), ".")
+	if !found {
+		return fe.Field()
+	}
+	return path
+}
+
+func ruleMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required", "required_without":
+		return fe.Field() + " is required"
+	case "min":
+		if fe.Kind() == reflect.Slice {
+			return fmt.Sprintf("%s must have at least %s entries", fe.Field(), fe.Param())
+		}
+		return fmt.Sprintf("%s must be at least %s", fe.Field(), fe.Param())
+	case "max":
+		return fmt.Sprintf("%s must be at most %s", fe.Field(), fe.Param())
+	default:
+		return fmt.Sprintf("%s failed the %s rule", fe.Field(), fe.Tag())
+	}
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice:
+		return "list"
+	case reflect.Bool:
+		return "boolean"
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// decodeProblem checks the response is a problem document with the
+// given status and code, and returns it
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder, status int, code string) Problem {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("Expected status %d, got %d: %s", status, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, problemContentType) {
+		t.Errorf("Expected Content-Type %s, got %q", problemContentType, ct)
+	}
+
+	var p Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("Response is not JSON: %v", err)
+	}
+	if p.Code != code || p.Status != status {
+		t.Errorf("Expected code %s and status %d, got %+v", code, status, p)
+	}
+	return p
+}
+
+func TestProblemInvalidID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	for _, path := range []string{"/v1/books/abc", "/v1/authors/abc"} {
+		w := doJSON(router, "GET", path, nil)
+		p := decodeProblem(t, w, http.StatusBadRequest, "invalid_id")
+		if len(p.Violations) != 1 || p.Violations[0].Field != "id" {
+			t.Errorf("%s: expected an id violation, got %+v", path, p.Violations)
+		}
+		if p.Instance != path {
+			t.Errorf("%s: expected instance %s, got %q", path, path, p.Instance)
+		}
+	}
+}
+
+func TestProblemNotFound(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	p := decodeProblem(t, doJSON(router, "GET", "/v1/books/999", nil), http.StatusNotFound, "book_not_found")
+	if p.Type != "/problems/book-not-found" || p.Title != "Not Found" {
+		t.Errorf("Unexpected type or title: %+v", p)
+	}
+	decodeProblem(t, doJSON(router, "GET", "/v1/authors/999", nil), http.StatusNotFound, "author_not_found")
+	decodeProblem(t, doJSON(router, "GET", "/nowhere", nil), http.StatusNotFound, "route_not_found")
+}
+
+func TestProblemValidationViolations(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w := doJSON(router, "POST", "/v1/books", map[string]interface{}{"author": "Someone", "year": 10})
+	p := decodeProblem(t, w, http.StatusBadRequest, "validation_failed")
+
+	want := map[string]string{"title": "required", "year": "min"}
+	if len(p.Violations) != len(want) {
+		t.Fatalf("Expected %d violations, got %+v", len(want), p.Violations)
+	}
+	for _, v := range p.Violations {
+		if want[v.Field] != v.Rule || v.Message == "" {
+			t.Errorf("Unexpected violation %+v", v)
+		}
+	}
+}
+
+func TestProblemFieldErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	tests := []struct {
+		name   string
+		body   interface{}
+		status int
+		field  string
+		rule   string
+	}{
+		{"wrong type", map[string]interface{}{"title": "T", "author": "A", "year": "1999"}, http.StatusBadRequest, "year", "type"},
+		{"bad isbn", Book{Title: "T", Author: "A", Year: 1999, ISBN: "123"}, http.StatusBadRequest, "isbn", "isbn"},
+		{"unknown author", Book{Title: "T", Year: 1999, AuthorIDs: []int{42}}, http.StatusUnprocessableEntity, "author_ids", "exists"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := decodeProblem(t, doJSON(router, "POST", "/v1/books", tt.body), tt.status, "validation_failed")
+			if len(p.Violations) != 1 || p.Violations[0].Field != tt.field || p.Violations[0].Rule != tt.rule {
+				t.Errorf("Expected %s/%s violation, got %+v", tt.field, tt.rule, p.Violations)
+			}
+		})
+	}
+}
+
+func TestProblemMalformedBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/books", strings.NewReader(`{"title":`))
+	authorize(req, RoleAdmin)
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	p := decodeProblem(t, w, http.StatusBadRequest, "malformed_body")
+	if len(p.Violations) != 0 {
+		t.Errorf("Expected no field violations, got %+v", p.Violations)
+	}
+}
+
+func TestProblemExtensions(t *testing.T) {
+	p := Problem{Type: "/problems/x", Title: "Bad", Status: 400, Code: "x",
+		Extensions: map[string]interface{}{"retry_after": 5, "code": "ignored"}}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	json.Unmarshal(data, &got)
+	if got["retry_after"] != float64(5) {
+		t.Errorf("Expected extension member, got %s", data)
+	}
+	if got["code"] != "x" {
+		t.Errorf("Extensions must not override standard members, got %s", data)
+	}
+}
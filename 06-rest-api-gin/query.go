@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// Values of ?deleted=
+const (
+	deletedExclude = "exclude"
+	deletedInclude = "include"
+	deletedOnly    = "only"
+)
+
+// sortKey is one comma-separated entry of ?sort=, e.g. "-year"
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+// bookQuery holds the parsed filters, ordering and page for GET /books
+type bookQuery struct {
+	author        string
+	titleContains string
+	deleted       string // deletedExclude, deletedInclude or deletedOnly
+	yearGTE       *int
+	yearLTE       *int
+	publishedGTE  string // a date of any precision parsePublished accepts
+	publishedLTE  string
+	sort          []sortKey
+	page          int
+	perPage       int
+}
+
+// bookLess compares two books on a single sortable field
+var bookLess = map[string]func(a, b Book) bool{
+	"id":     func(a, b Book) bool { return a.ID < b.ID },
+	"title":  func(a, b Book) bool { return strings.ToLower(a.Title) < strings.ToLower(b.Title) },
+	"author": func(a, b Book) bool { return strings.ToLower(a.Author) < strings.ToLower(b.Author) },
+	"year":   func(a, b Book) bool { return a.Year < b.Year },
+	// A bare year sorts before the more precise dates within it
+	"published": func(a, b Book) bool { return publishedDate(a) < publishedDate(b) },
+}
+
+// publishedDate is a book's publication date as v2 shows it
+func publishedDate(b Book) string {
+	if b.Published != "" {
+		return b.Published
+	}
+	return strconv.Itoa(b.Year)
+}
+
+// v1DateParams are the year filters of GET /books that v2 replaced,
+// with their v2 names
+var v1DateParams = map[string]string{
+	"year_gte": "published_gte",
+	"year_lte": "published_lte",
+}
+
+// comparePublished compares two publication dates at the precision of
+// the less precise one, so 2015 neither precedes nor follows 2015-03
+func comparePublished(a, b string) int {
+	n := min(len(a), len(b))
+	return strings.Compare(a[:n], b[:n])
+}
+
+// parseBookQuery validates the query string. dateMember is the member
+// the API version filters and sorts dates by: "year" on v1, where the
+// year_gte and year_lte filters apply, or "published" on v2, which takes
+// published_gte and published_lte instead and refuses the v1 names. All
+// problems are collected so the client can fix them in one go.
+func parseBookQuery(values url.Values, dateMember string) (bookQuery, []Violation) {
+	q := bookQuery{
+		author:        strings.TrimSpace(values.Get("author")),
+		titleContains: strings.TrimSpace(values.Get("title_contains")),
+		deleted:       deletedExclude,
+		page:          1,
+		perPage:       defaultPerPage,
+	}
+	var errs []Violation
+
+	intParam := func(name string, lo, hi int) (int, bool) {
+		raw := values.Get(name)
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			errs = append(errs, Violation{name, "integer", name + " must be an integer"})
+			return 0, false
+		}
+		if n < lo || n > hi {
+			errs = append(errs, Violation{name, "range", fmt.Sprintf("%s must be between %d and %d", name, lo, hi)})
+			return 0, false
+		}
+		return n, true
+	}
+
+	if dateMember == "published" {
+		for _, name := range []string{"year_gte", "year_lte"} {
+			if values.Has(name) {
+				errs = append(errs, Violation{name, "unknown", fmt.Sprintf("%s is not supported here; use %s", name, v1DateParams[name])})
+			}
+		}
+		dateParam := func(name string) string {
+			raw := values.Get(name)
+			if _, err := parsePublished(raw); err != nil {
+				errs = append(errs, Violation{name, "date", name + " must be YYYY, YYYY-MM or YYYY-MM-DD"})
+				return ""
+			}
+			return raw
+		}
+		if values.Has("published_gte") {
+			q.publishedGTE = dateParam("published_gte")
+		}
+		if values.Has("published_lte") {
+			q.publishedLTE = dateParam("published_lte")
+		}
+		if q.publishedGTE != "" && q.publishedLTE != "" && comparePublished(q.publishedGTE, q.publishedLTE) > 0 {
+			errs = append(errs, Violation{"published_gte", "ltefield", "published_gte must not be later than published_lte"})
+		}
+	} else {
+		if values.Has("year_gte") {
+			if n, ok := intParam("year_gte", 0, 9999); ok {
+				q.yearGTE = &n
+			}
+		}
+		if values.Has("year_lte") {
+			if n, ok := intParam("year_lte", 0, 9999); ok {
+				q.yearLTE = &n
+			}
+		}
+		if q.yearGTE != nil && q.yearLTE != nil && *q.yearGTE > *q.yearLTE {
+			errs = append(errs, Violation{"year_gte", "ltefield", "year_gte must not be greater than year_lte"})
+		}
+	}
+
+	if values.Has("deleted") {
+		switch d := values.Get("deleted"); d {
+		case deletedExclude, deletedInclude, deletedOnly:
+			q.deleted = d
+		default:
+			errs = append(errs, Violation{"deleted", "oneof", "deleted must be exclude, include or only"})
+		}
+	}
+
+	if values.Has("page") {
+		if n, ok := intParam("page", 1, 1<<30); ok {
+			q.page = n
+		}
+	}
+	if values.Has("per_page") {
+		if n, ok := intParam("per_page", 1, maxPerPage); ok {
+			q.perPage = n
+		}
+	}
+
+	if raw := values.Get("sort"); raw != "" {
+		for _, field := range strings.Split(raw, ",") {
+			key := sortKey{field: strings.TrimSpace(field)}
+			if strings.HasPrefix(key.field, "-") {
+				key.desc = true
+				key.field = key.field[1:]
+			}
+			if _, ok := bookLess[key.field]; !ok {
+				errs = append(errs, Violation{"sort", "oneof", fmt.Sprintf("unknown sort field %q", key.field)})
+				continue
+			}
+			if dateMember == "published" && key.field == "year" {
+				errs = append(errs, Violation{"sort", "oneof", `sort field "year" is not supported here; use "published"`})
+				continue
+			}
+			q.sort = append(q.sort, key)
+		}
+	}
+
+	return q, errs
+}
+
+// matches reports whether a book passes every filter
+func (q bookQuery) matches(b Book) bool {
+	if (q.deleted == deletedExclude && b.Deleted()) || (q.deleted == deletedOnly && !b.Deleted()) {
+		return false
+	}
+	if q.author != "" && !strings.EqualFold(b.Author, q.author) {
+		return false
+	}
+	if q.titleContains != "" && !strings.Contains(strings.ToLower(b.Title), strings.ToLower(q.titleContains)) {
+		return false
+	}
+	if q.yearGTE != nil && b.Year < *q.yearGTE {
+		return false
+	}
+	if q.yearLTE != nil && b.Year > *q.yearLTE {
+		return false
+	}
+	if q.publishedGTE != "" && comparePublished(publishedDate(b), q.publishedGTE) < 0 {
+		return false
+	}
+	if q.publishedLTE != "" && comparePublished(publishedDate(b), q.publishedLTE) > 0 {
+		return false
+	}
+	return true
+}
+
+// apply filters and sorts books, then returns the requested page
+// together with the number of books that matched the filters
+func (q bookQuery) apply(books []Book) ([]Book, int) {
+	filtered := make([]Book, 0, len(books))
+	for _, b := range books {
+		if q.matches(b) {
+			filtered = append(filtered, b)
+		}
+	}
+
+	// Sort keys are applied in order; ID breaks any remaining ties so
+	// paging is deterministic
+	keys := make([]sortKey, 0, len(q.sort)+1)
+	keys = append(keys, q.sort...)
+	keys = append(keys, sortKey{field: "id"})
+	sort.SliceStable(filtered, func(i, j int) bool {
+		for _, k := range keys {
+			a, b := filtered[i], filtered[j]
+			if k.desc {
+				a, b = b, a
+			}
+			less := bookLess[k.field]
+			if less(a, b) {
+				return true
+			}
+			if less(b, a) {
+				return false
+			}
+		}
+		return false
+	})
+
+	total := len(filtered)
+	start := (q.page - 1) * q.perPage
+	if start >= total {
+		return []Book{}, total
+	}
+	end := start + q.perPage
+	if end > total {
+		end = total
+	}
+	return filtered[start:end], total
+}
+
+// lastPage returns the number of pages needed for total results
+func (q bookQuery) lastPage(total int) int {
+	if total == 0 {
+		return 1
+	}
+	return (total + q.perPage - 1) / q.perPage
+}
+
+// linkHeader builds an RFC 8288 Link header with first, prev, next and
+// last relations, preserving every other query parameter
+func (q bookQuery) linkHeader(u *url.URL, total int) string {
+	last := q.lastPage(total)
+
+	link := func(page int, rel string) string {
+		values := u.Query()
+		values.Set("page", strconv.Itoa(page))
+		values.Set("per_page", strconv.Itoa(q.perPage))
+		target := *u
+		target.RawQuery = values.Encode()
+		return fmt.Sprintf("<%s>; rel=%q", target.RequestURI(), rel)
+	}
+
+	links := []string{link(1, "first")}
+	if q.page > 1 {
+		prev := q.page - 1
+		if prev > last {
+			prev = last
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	if q.page < last {
+		links = append(links, link(q.page+1, "next"))
+	}
+	links = append(links, link(last, "last"))
+	return strings.Join(links, ", ")
+}
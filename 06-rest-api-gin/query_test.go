@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func catalogueRouter() *gin.Engine {
+	return setupRouter(NewMemoryBookRepository(
+		Book{ID: 1, Title: "The Go Programming Language", Author: "Donovan & Kernighan", Year: 2015},
+		Book{ID: 2, Title: "Clean Code", Author: "Robert Martin", Year: 2008},
+		Book{ID: 3, Title: "Clean Architecture", Author: "Robert Martin", Year: 2017},
+		Book{ID: 4, Title: "Go in Action", Author: "William Kennedy", Year: 2015},
+		Book{ID: 5, Title: "Refactoring", Author: "Martin Fowler", Year: 1999},
+	))
+}
+
+func TestGetBooksQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := catalogueRouter()
+
+	tests := []struct {
+		name      string
+		query     string
+		wantIDs   []int
+		wantTotal string
+	}{
+		{"no parameters", "", []int{1, 2, 3, 4, 5}, "5"},
+		{"author exact, case-insensitive", "?author=robert+martin", []int{2, 3}, "2"},
+		{"title contains", "?title_contains=go", []int{1, 4}, "2"},
+		{"year range", "?year_gte=2010&year_lte=2015", []int{1, 4}, "2"},
+		{"sort descending year then title", "?sort=-year,title", []int{3, 4, 1, 2, 5}, "5"},
+		{"sort by title", "?sort=title", []int{3, 2, 4, 5, 1}, "5"},
+		{"first page", "?per_page=2", []int{1, 2}, "5"},
+		{"last page", "?per_page=2&page=3", []int{5}, "5"},
+		{"page past the end", "?per_page=2&page=9", []int{}, "5"},
+		{"filter and paginate", "?author=Robert%20Martin&per_page=1&page=2", []int{3}, "2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/v1/books"+tt.query, nil)
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("X-Total-Count"); got != tt.wantTotal {
+				t.Errorf("Expected X-Total-Count %s, got %s", tt.wantTotal, got)
+			}
+
+			var books []Book
+			json.Unmarshal(w.Body.Bytes(), &books)
+			if len(books) != len(tt.wantIDs) {
+				t.Fatalf("Expected %d books, got %d", len(tt.wantIDs), len(books))
+			}
+			for i, id := range tt.wantIDs {
+				if books[i].ID != id {
+					t.Errorf("Position %d: expected ID %d, got %d", i, id, books[i].ID)
+				}
+			}
+		})
+	}
+}
+
+func TestGetBooksLinkHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := catalogueRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books?per_page=2&page=2&sort=year", nil)
+	router.ServeHTTP(w, req)
+
+	link := w.Header().Get("Link")
+	for _, want := range []string{
+		`</v1/books?page=1&per_page=2&sort=year>; rel="first"`,
+		`</v1/books?page=1&per_page=2&sort=year>; rel="prev"`,
+		`</v1/books?page=3&per_page=2&sort=year>; rel="next"`,
+		`</v1/books?page=3&per_page=2&sort=year>; rel="last"`,
+	} {
+		if !strings.Contains(link, want) {
+			t.Errorf("Expected Link header to contain %s, got %s", want, link)
+		}
+	}
+}
+
+func TestGetBooksInvalidQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := catalogueRouter()
+
+	tests := []struct {
+		name      string
+		query     string
+		wantParam string
+	}{
+		{"non-numeric year", "?year_gte=abc", "year_gte"},
+		{"inverted year range", "?year_gte=2020&year_lte=2000", "year_gte"},
+		{"unknown sort field", "?sort=price", "sort"},
+		{"zero page", "?page=0", "page"},
+		{"per_page too large", "?per_page=1000", "per_page"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/v1/books"+tt.query, nil)
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("Expected status 400, got %d", w.Code)
+			}
+
+			var body Problem
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body.Code != "invalid_query" || len(body.Violations) == 0 || body.Violations[0].Field != tt.wantParam {
+				t.Errorf("Expected invalid_query for %s, got %+v", tt.wantParam, body)
+			}
+		})
+	}
+}
+
+func TestGetBooksV2DateQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := setupRouter(NewMemoryBookRepository(
+		Book{ID: 1, Title: "The Go Programming Language", Author: "Donovan & Kernighan", Year: 2015},
+		Book{ID: 2, Title: "Clean Code", Author: "Robert Martin", Year: 2008},
+		Book{ID: 3, Title: "Clean Architecture", Author: "Robert Martin", Year: 2017, Published: "2017-09-10"},
+		Book{ID: 4, Title: "Go in Action", Author: "William Kennedy", Year: 2015, Published: "2015-11"},
+		Book{ID: 5, Title: "Refactoring", Author: "Martin Fowler", Year: 1999},
+	))
+
+	tests := []struct {
+		name    string
+		query   string
+		wantIDs []int
+	}{
+		{"published range", "?published_gte=2015-06&published_lte=2017", []int{1, 3, 4}},
+		{"a bare year matches any date within it", "?published_gte=2015-12&published_lte=2016", []int{1}},
+		{"sort descending published", "?sort=-published", []int{3, 4, 1, 2, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/v2/books"+tt.query, nil)
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			var books []BookV2
+			json.Unmarshal(w.Body.Bytes(), &books)
+			ids := make([]int, len(books))
+			for i, b := range books {
+				ids[i] = b.ID
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("Expected IDs %v, got %v", tt.wantIDs, ids)
+			}
+		})
+	}
+
+	// The v1 names are refused rather than silently ignored
+	invalid := []struct {
+		query     string
+		wantParam string
+	}{
+		{"?year_gte=2010", "year_gte"},
+		{"?sort=-year", "sort"},
+		{"?published_lte=soon", "published_lte"},
+		{"?published_gte=2017&published_lte=2015-06", "published_gte"},
+	}
+	for _, tt := range invalid {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v2/books"+tt.query, nil)
+		router.ServeHTTP(w, req)
+
+		var body Problem
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusBadRequest || len(body.Violations) == 0 || body.Violations[0].Field != tt.wantParam {
+			t.Errorf("%s: expected a 400 naming %s, got %d %+v", tt.query, tt.wantParam, w.Code, body)
+		}
+	}
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBookNotFound is returned when no book exists with the requested ID
+	ErrBookNotFound = errors.New("book not found")
+	// ErrVersionConflict is returned when a conditional write expected a
+	// different version than the one stored
+	ErrVersionConflict = errors.New("book version conflict")
+	// ErrBookDeleted is returned when deleting a book that is already
+	// deleted, or checking out a deleted book
+	ErrBookDeleted = errors.New("book is deleted")
+	// ErrBookNotDeleted is returned when restoring a book that was never
+	// deleted
+	ErrBookNotDeleted = errors.New("book is not deleted")
+)
+
+// BookRepository abstracts book storage so handlers never touch
+// shared state directly and tests can swap backends.
+//
+// Every write bumps Book.Version. Update and Delete take the version
+// the caller last saw; 0 means "any version", anything else must match
+// the stored version or the call fails with ErrVersionConflict.
+// ISBNs are unique; a clash fails with ErrDuplicateISBN.
+// CreateMany is all-or-nothing: if any book is rejected none are stored.
+//
+// Delete is soft: it stamps DeletedAt and keeps the book, its ISBN and
+// its history, so Restore can bring it back. List, Get and GetByISBN
+// return deleted books too; callers decide whether to show them.
+// Every write is appended to the book's History. As returns a view of
+// the same repository whose writes are recorded as made by actor.
+type BookRepository interface {
+	List() ([]Book, error)
+	Get(id int) (Book, error)
+	GetByISBN(isbn string) (Book, error)
+	Create(book Book) (Book, error)
+	CreateMany(books []Book) ([]Book, error)
+	Update(id int, book Book, version int) (Book, error)
+	Delete(id int, version int) error
+	Restore(id int, version int) (Book, error)
+	History(id int) ([]Change, error)
+	As(actor string) BookRepository
+}
+
+// StateStore is implemented by repositories that can keep state owned
+// by other services, such as loans and authors, in the same place as
+// the books. Each service saves one JSON document under its own name.
+type StateStore interface {
+	// LoadState decodes the document saved under name into v. It
+	// reports false when nothing has been saved under name yet.
+	LoadState(name string, v interface{}) (bool, error)
+	// SaveState replaces the document saved under name
+	SaveState(name string, v interface{}) error
+}
+
+// defaultBooks returns the catalogue the API starts with
+func defaultBooks() []Book {
+	return []Book{
+		{ID: 1, Title: "The Go Programming Language", Author: "Donovan & Kernighan", Year: 2015},
+		{ID: 2, Title: "Clean Code", Author: "Robert Martin", Year: 2008},
+	}
+}
+
+// MemoryBookRepository stores books in a map guarded by a RWMutex.
+// Reads share the lock, writes take it exclusively. The views As
+// returns share the map and the lock.
+type MemoryBookRepository struct {
+	*memoryBooks
+	actor string // recorded on every change made through this view
+}
+
+// memoryBooks is the state shared by a MemoryBookRepository and the
+// views As returns
+type memoryBooks struct {
+	mu      sync.RWMutex
+	books   map[int]Book
+	byISBN  map[string]int   // ISBN -> book ID, for lookups and uniqueness
+	history map[int][]Change // book ID -> changes, oldest first
+	nextID  int
+	now     func() time.Time // stamps DeletedAt and history entries
+}
+
+// NewMemoryBookRepository creates a repository seeded with the given books
+func NewMemoryBookRepository(seed ...Book) *MemoryBookRepository {
+	r := &MemoryBookRepository{memoryBooks: &memoryBooks{
+		books:   make(map[int]Book),
+		byISBN:  make(map[string]int),
+		history: make(map[int][]Change),
+		nextID:  1,
+		now:     time.Now,
+	}}
+	r.load(seed, nil, 0)
+	return r
+}
+
+func (r *MemoryBookRepository) As(actor string) BookRepository {
+	return &MemoryBookRepository{memoryBooks: r.memoryBooks, actor: actor}
+}
+
+// load replaces the contents of the repository. Books without any
+// history, such as the seed, get a create entry stamped now. Callers
+// must hold the write lock or have exclusive access.
+func (r *MemoryBookRepository) load(books []Book, history map[int][]Change, nextID int) {
+	r.books = make(map[int]Book, len(books))
+	r.byISBN = make(map[string]int)
+	r.history = make(map[int][]Change, len(books))
+	r.nextID = 1
+	for _, b := range books {
+		if b.Version == 0 {
+			b.Version = 1
+		}
+		r.books[b.ID] = b
+		if b.ISBN != "" {
+			r.byISBN[b.ISBN] = b.ID
+		}
+		if b.ID >= r.nextID {
+			r.nextID = b.ID + 1
+		}
+		if changes := history[b.ID]; len(changes) > 0 {
+			r.history[b.ID] = append([]Change(nil), changes...)
+		} else {
+			r.record(ActionCreate, nil, b)
+		}
+	}
+	if nextID > r.nextID {
+		r.nextID = nextID
+	}
+}
+
+// record appends a change to a book's history. Callers must hold the
+// write lock.
+func (r *MemoryBookRepository) record(action string, before *Book, after Book) {
+	r.history[after.ID] = append(r.history[after.ID], Change{
+		Action:  action,
+		Version: after.Version,
+		At:      r.now(),
+		Actor:   r.actor,
+		Before:  before,
+		After:   &after,
+	})
+}
+
+// historySnapshot copies the history of every book. Changes are never
+// modified once recorded, so sharing them is safe. Callers must hold at
+// least the read lock.
+func (r *MemoryBookRepository) historySnapshot() map[int][]Change {
+	history := make(map[int][]Change, len(r.history))
+	for id, changes := range r.history {
+		history[id] = append([]Change(nil), changes...)
+	}
+	return history
+}
+
+// snapshot returns a copy of the stored books ordered by ID. Callers
+// must hold at least the read lock.
+func (r *MemoryBookRepository) snapshot() []Book {
+	list := make([]Book, 0, len(r.books))
+	for _, b := range r.books {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (r *MemoryBookRepository) List() ([]Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshot(), nil
+}
+
+func (r *MemoryBookRepository) Get(id int) (Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	book, ok := r.books[id]
+	if !ok {
+		return Book{}, ErrBookNotFound
+	}
+	return book, nil
+}
+
+func (r *MemoryBookRepository) GetByISBN(isbn string) (Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.byISBN[isbn]
+	if !ok {
+		return Book{}, ErrBookNotFound
+	}
+	return r.books[id], nil
+}
+
+func (r *MemoryBookRepository) Create(book Book) (Book, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, taken := r.byISBN[book.ISBN]; book.ISBN != "" && taken {
+		return Book{}, ErrDuplicateISBN
+	}
+
+	book.ID = r.nextID
+	book.Version = 1
+	book.DeletedAt = nil
+	r.nextID++
+	r.books[book.ID] = book
+	if book.ISBN != "" {
+		r.byISBN[book.ISBN] = book.ID
+	}
+	r.record(ActionCreate, nil, book)
+	return book, nil
+}
+
+func (r *MemoryBookRepository) CreateMany(books []Book) ([]Book, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Check every book before storing any of them
+	batch := make(map[string]bool)
+	for i, b := range books {
+		if b.ISBN == "" {
+			continue
+		}
+		if _, taken := r.byISBN[b.ISBN]; taken || batch[b.ISBN] {
+			return nil, fmt.Errorf("book %d: %w", i, ErrDuplicateISBN)
+		}
+		batch[b.ISBN] = true
+	}
+
+	created := make([]Book, len(books))
+	for i, b := range books {
+		b.ID = r.nextID
+		b.Version = 1
+		b.DeletedAt = nil
+		r.nextID++
+		r.books[b.ID] = b
+		if b.ISBN != "" {
+			r.byISBN[b.ISBN] = b.ID
+		}
+		r.record(ActionCreate, nil, b)
+		created[i] = b
+	}
+	return created, nil
+}
+
+func (r *MemoryBookRepository) Update(id int, book Book, version int) (Book, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.books[id]
+	if !ok {
+		return Book{}, ErrBookNotFound
+	}
+	if version != 0 && version != current.Version {
+		return Book{}, ErrVersionConflict
+	}
+	if owner, taken := r.byISBN[book.ISBN]; book.ISBN != "" && taken && owner != id {
+		return Book{}, ErrDuplicateISBN
+	}
+
+	book.ID = id
+	book.Version = current.Version + 1
+	book.DeletedAt = current.DeletedAt // only Delete and Restore change it
+	r.books[id] = book
+	delete(r.byISBN, current.ISBN)
+	if book.ISBN != "" {
+		r.byISBN[book.ISBN] = id
+	}
+	r.record(ActionUpdate, &current, book)
+	return book, nil
+}
+
+func (r *MemoryBookRepository) Delete(id int, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.books[id]
+	if !ok {
+		return ErrBookNotFound
+	}
+	if current.Deleted() {
+		return ErrBookDeleted
+	}
+	if version != 0 && version != current.Version {
+		return ErrVersionConflict
+	}
+
+	now := r.now()
+	book := current
+	book.DeletedAt = &now
+	book.Version++
+	r.books[id] = book
+	r.record(ActionDelete, &current, book)
+	return nil
+}
+
+func (r *MemoryBookRepository) Restore(id int, version int) (Book, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.books[id]
+	if !ok {
+		return Book{}, ErrBookNotFound
+	}
+	if !current.Deleted() {
+		return Book{}, ErrBookNotDeleted
+	}
+	if version != 0 && version != current.Version {
+		return Book{}, ErrVersionConflict
+	}
+
+	book := current
+	book.DeletedAt = nil
+	book.Version++
+	r.books[id] = book
+	r.record(ActionRestore, &current, book)
+	return book, nil
+}
+
+func (r *MemoryBookRepository) History(id int) ([]Change, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.books[id]; !ok {
+		return nil, ErrBookNotFound
+	}
+	return append([]Change{}, r.history[id]...), nil
+}
+
+// bookFile is the on-disk layout used by FileBookRepository
+type bookFile struct {
+	NextID  int                        `json:"next_id"`
+	Books   []Book                     `json:"books"`
+	History map[int][]Change           `json:"history,omitempty"`
+	State   map[string]json.RawMessage `json:"state,omitempty"` // see StateStore
+}
+
+// FileBookRepository keeps books in memory and persists every change
+// to a JSON file. Writes go to a temp file that is renamed over the
+// original, so a crash never leaves a half-written catalogue behind.
+// It is also a StateStore: other services' state is saved in the same
+// file.
+type FileBookRepository struct {
+	*fileBooks
+	mem *MemoryBookRepository // a view of the books with this view's actor
+}
+
+// fileBooks is the state shared by a FileBookRepository and the views
+// As returns
+type fileBooks struct {
+	mu    sync.Mutex // serialises mutations and their writes to disk
+	path  string
+	state map[string]json.RawMessage
+}
+
+// NewFileBookRepository opens the catalogue at path. A missing file
+// is created from seed; an existing file takes precedence over seed.
+func NewFileBookRepository(path string, seed ...Book) (*FileBookRepository, error) {
+	r := &FileBookRepository{
+		fileBooks: &fileBooks{
+			path:  path,
+			state: make(map[string]json.RawMessage),
+		},
+		mem: NewMemoryBookRepository(),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		r.mem.load(seed, nil, 0)
+		if err := r.save(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	default:
+		var f bookFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", path, err)
+		}
+		r.mem.load(f.Books, f.History, f.NextID)
+		for name, doc := range f.State {
+			r.state[name] = doc
+		}
+	}
+
+	return r, nil
+}
+
+func (r *FileBookRepository) List() ([]Book, error) {
+	return r.mem.List()
+}
+
+func (r *FileBookRepository) Get(id int) (Book, error) {
+	return r.mem.Get(id)
+}
+
+func (r *FileBookRepository) GetByISBN(isbn string) (Book, error) {
+	return r.mem.GetByISBN(isbn)
+}
+
+func (r *FileBookRepository) Create(book Book) (Book, error) {
+	var created Book
+	err := r.mutate(func() error {
+		var err error
+		created, err = r.mem.Create(book)
+		return err
+	})
+	return created, err
+}
+
+func (r *FileBookRepository) CreateMany(books []Book) ([]Book, error) {
+	var created []Book
+	err := r.mutate(func() error {
+		var err error
+		created, err = r.mem.CreateMany(books)
+		return err
+	})
+	return created, err
+}
+
+func (r *FileBookRepository) Update(id int, book Book, version int) (Book, error) {
+	var updated Book
+	err := r.mutate(func() error {
+		var err error
+		updated, err = r.mem.Update(id, book, version)
+		return err
+	})
+	return updated, err
+}
+
+func (r *FileBookRepository) Delete(id int, version int) error {
+	return r.mutate(func() error {
+		return r.mem.Delete(id, version)
+	})
+}
+
+func (r *FileBookRepository) Restore(id int, version int) (Book, error) {
+	var restored Book
+	err := r.mutate(func() error {
+		var err error
+		restored, err = r.mem.Restore(id, version)
+		return err
+	})
+	return restored, err
+}
+
+func (r *FileBookRepository) History(id int) ([]Change, error) {
+	return r.mem.History(id)
+}
+
+func (r *FileBookRepository) As(actor string) BookRepository {
+	return &FileBookRepository{
+		fileBooks: r.fileBooks,
+		mem:       r.mem.As(actor).(*MemoryBookRepository),
+	}
+}
+
+func (r *FileBookRepository) LoadState(name string, v interface{}) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	doc, ok := r.state[name]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(doc, v); err != nil {
+		return false, fmt.Errorf("decode %s state in %s: %w", name, r.path, err)
+	}
+	return true, nil
+}
+
+// SaveState persists v under name. If the write fails the previous
+// document is kept, in memory and on disk.
+func (r *FileBookRepository) SaveState(name string, v interface{}) error {
+	doc, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prev, had := r.state[name]
+	r.state[name] = doc
+	if err := r.save(); err != nil {
+		if had {
+			r.state[name] = prev
+		} else {
+			delete(r.state, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// mutate applies fn to the in-memory state and persists the result.
+// If the write fails the in-memory state is rolled back so memory and
+// disk never disagree.
+func (r *FileBookRepository) mutate(fn func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.mem.mu.RLock()
+	before, history, nextID := r.mem.snapshot(), r.mem.historySnapshot(), r.mem.nextID
+	r.mem.mu.RUnlock()
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	if err := r.save(); err != nil {
+		r.mem.mu.Lock()
+		r.mem.load(before, history, nextID)
+		r.mem.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// save writes the catalogue atomically: temp file, fsync, rename.
+// Callers must hold r.mu or have exclusive access.
+func (r *FileBookRepository) save() error {
+	r.mem.mu.RLock()
+	f := bookFile{NextID: r.mem.nextID, Books: r.mem.snapshot(), History: r.mem.historySnapshot(), State: r.state}
+	r.mem.mu.RUnlock()
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	// Clean up the temp file on any failure; after a successful
+	// rename this is a harmless no-op
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return fmt.Errorf("rename %s: %w", tmp.Name(), err)
+	}
+	return nil
+}
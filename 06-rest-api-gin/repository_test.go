@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMemoryBookRepository_CRUD(t *testing.T) {
+	repo := NewMemoryBookRepository(defaultBooks()...)
+
+	created, err := repo.Create(Book{Title: "New", Author: "Someone", Year: 2020})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if created.ID != 3 {
+		t.Errorf("Expected ID 3, got %d", created.ID)
+	}
+
+	if _, err := repo.Update(created.ID, Book{Title: "Renamed", Author: "Someone", Year: 2021}, 0); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	got, _ := repo.Get(created.ID)
+	if got.Title != "Renamed" {
+		t.Errorf("Expected title Renamed, got %s", got.Title)
+	}
+
+	if err := repo.Delete(created.ID, 0); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if got, err := repo.Get(created.ID); err != nil || !got.Deleted() {
+		t.Errorf("Expected a soft-deleted book, got %+v (%v)", got, err)
+	}
+	if err := repo.Delete(created.ID, 0); !errors.Is(err, ErrBookDeleted) {
+		t.Errorf("Expected ErrBookDeleted on second delete, got %v", err)
+	}
+	if err := repo.Delete(999, 0); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("Expected ErrBookNotFound for unknown book, got %v", err)
+	}
+}
+
+func TestMemoryBookRepository_Versions(t *testing.T) {
+	repo := NewMemoryBookRepository(defaultBooks()...)
+
+	book, _ := repo.Get(1)
+	if book.Version != 1 {
+		t.Fatalf("Expected seeded book at version 1, got %d", book.Version)
+	}
+
+	updated, err := repo.Update(1, book, 1)
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if updated.Version != 2 {
+		t.Errorf("Expected version 2 after update, got %d", updated.Version)
+	}
+
+	// A writer still holding version 1 loses
+	if _, err := repo.Update(1, book, 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict on stale update, got %v", err)
+	}
+	if err := repo.Delete(1, 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict on stale delete, got %v", err)
+	}
+	if err := repo.Delete(1, 2); err != nil {
+		t.Errorf("Expected delete at current version to succeed, got %v", err)
+	}
+}
+
+func TestMemoryBookRepository_ConcurrentCreate(t *testing.T) {
+	repo := NewMemoryBookRepository()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			repo.Create(Book{Title: "T", Author: "A", Year: 2000})
+			repo.List()
+		}()
+	}
+	wg.Wait()
+
+	books, _ := repo.List()
+	if len(books) != 100 {
+		t.Fatalf("Expected 100 books, got %d", len(books))
+	}
+	seen := make(map[int]bool)
+	for _, b := range books {
+		if seen[b.ID] {
+			t.Errorf("Duplicate ID %d", b.ID)
+		}
+		seen[b.ID] = true
+	}
+}
+
+func TestFileBookRepository_Persists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.json")
+
+	repo, err := NewFileBookRepository(path, defaultBooks()...)
+	if err != nil {
+		t.Fatalf("NewFileBookRepository: %v", err)
+	}
+	created, err := repo.Create(Book{Title: "Persisted", Author: "Disk", Year: 2022})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := repo.Delete(1, 0); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	// Reopen: the seed must be ignored in favour of the file contents
+	reopened, err := NewFileBookRepository(path, defaultBooks()...)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	books, _ := reopened.List()
+	if len(books) != 3 {
+		t.Fatalf("Expected 3 books after reopen, got %d", len(books))
+	}
+	if deleted, _ := reopened.Get(1); !deleted.Deleted() {
+		t.Errorf("Expected deleted book to stay deleted, got %+v", deleted)
+	}
+	if history, _ := reopened.History(1); len(history) != 2 || history[1].Action != ActionDelete {
+		t.Errorf("Expected create and delete in the persisted history, got %+v", history)
+	}
+	got, err := reopened.Get(created.ID)
+	if err != nil || got.Title != "Persisted" {
+		t.Errorf("Expected persisted book, got %+v (%v)", got, err)
+	}
+
+	// IDs continue from where the previous process stopped
+	next, _ := reopened.Create(Book{Title: "Next", Author: "Disk", Year: 2023})
+	if next.ID != created.ID+1 {
+		t.Errorf("Expected ID %d, got %d", created.ID+1, next.ID)
+	}
+
+	// No temp files are left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected only books.json in data dir, got %d entries", len(entries))
+	}
+}
+
+func TestFileBookRepository_RollbackOnWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "books.json")
+
+	repo, err := NewFileBookRepository(path, defaultBooks()...)
+	if err != nil {
+		t.Fatalf("NewFileBookRepository: %v", err)
+	}
+
+	// Removing the directory makes the next save fail
+	os.RemoveAll(dir)
+
+	if _, err := repo.Create(Book{Title: "Lost", Author: "Nobody", Year: 2020}); err == nil {
+		t.Fatal("Expected error when the data directory is gone")
+	}
+	books, _ := repo.List()
+	if len(books) != 2 {
+		t.Errorf("Expected in-memory state to roll back to 2 books, got %d", len(books))
+	}
+}
+
+func TestFileBookRepository_State(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.json")
+
+	repo, err := NewFileBookRepository(path, defaultBooks()...)
+	if err != nil {
+		t.Fatalf("NewFileBookRepository: %v", err)
+	}
+	var got []string
+	if ok, err := repo.LoadState("things", &got); ok || err != nil {
+		t.Fatalf("Expected no state in a new file, got %v (%v)", ok, err)
+	}
+	if err := repo.SaveState("things", []string{"a", "b"}); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+
+	// State is kept alongside the books, and a book write keeps it
+	repo.Create(Book{Title: "Persisted", Author: "Disk", Year: 2022})
+	reopened, err := NewFileBookRepository(path, defaultBooks()...)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if ok, err := reopened.LoadState("things", &got); !ok || err != nil || len(got) != 2 {
+		t.Errorf("Expected the saved state after reopen, got %v, %v (%v)", got, ok, err)
+	}
+}
+
+func TestSetupRouterWithFileRepository(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	repo, err := NewFileBookRepository(filepath.Join(t.TempDir(), "books.json"), defaultBooks()...)
+	if err != nil {
+		t.Fatalf("NewFileBookRepository: %v", err)
+	}
+	router := setupRouter(repo, WithAuthSecret(testSecret))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/v1/books/2", nil)
+	authorize(req, RoleAdmin)
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+	if book, err := repo.Get(2); err != nil || !book.Deleted() {
+		t.Errorf("Expected book 2 to be deleted in the file repository, got %+v (%v)", book, err)
+	}
+}
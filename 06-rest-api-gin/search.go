@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+
+	titleWeight  = 2.0 // a hit in the title counts double
+	authorWeight = 1.0
+	prefixWeight = 0.5 // "prog" matching "programming" scores half an exact hit
+)
+
+// fold lower-cases text and strips accents, so "Gödel" matches "godel"
+func fold(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		folded = s
+	}
+	return strings.ToLower(folded)
+}
+
+// tokenize splits folded text into words of letters and digits
+func tokenize(s string) []string {
+	return strings.FieldsFunc(fold(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// indexedBook is what the index keeps per live book
+type indexedBook struct {
+	book  Book
+	terms []string // distinct terms, so Put can remove them again
+}
+
+// SearchIndex is an in-memory inverted index over book titles and
+// authors. Each term maps to the books containing it together with a
+// field-weighted term frequency. Deleted books are removed from the
+// index but their last version is remembered, so an update that lands
+// out of order can never resurrect them.
+type SearchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[int]float64 // term -> book ID -> weight
+	terms    []string                   // sorted keys of postings, for prefix lookups
+	docs     map[int]indexedBook
+	versions map[int]int // book ID -> newest version seen, live or deleted
+}
+
+// NewSearchIndex creates an index holding books
+func NewSearchIndex(books ...Book) *SearchIndex {
+	idx := &SearchIndex{
+		postings: make(map[string]map[int]float64),
+		docs:     make(map[int]indexedBook),
+		versions: make(map[int]int),
+	}
+	for _, b := range books {
+		idx.Put(b)
+	}
+	return idx
+}
+
+// Put indexes a book, replacing any older version of it. Deleted books
+// are taken out of the index. Versions older than one already seen are
+// ignored.
+func (idx *SearchIndex) Put(b Book) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if v, ok := idx.versions[b.ID]; ok && b.Version <= v {
+		return
+	}
+	idx.versions[b.ID] = b.Version
+	idx.remove(b.ID)
+	if b.Deleted() {
+		return
+	}
+
+	weights := make(map[string]float64)
+	for _, t := range tokenize(b.Title) {
+		weights[t] += titleWeight
+	}
+	for _, t := range tokenize(b.Author) {
+		weights[t] += authorWeight
+	}
+
+	doc := indexedBook{book: b, terms: make([]string, 0, len(weights))}
+	for term, w := range weights {
+		postings, ok := idx.postings[term]
+		if !ok {
+			postings = make(map[int]float64)
+			idx.postings[term] = postings
+			i := sort.SearchStrings(idx.terms, term)
+			idx.terms = append(idx.terms, "")
+			copy(idx.terms[i+1:], idx.terms[i:])
+			idx.terms[i] = term
+		}
+		postings[b.ID] = w
+		doc.terms = append(doc.terms, term)
+	}
+	idx.docs[b.ID] = doc
+}
+
+// remove drops a book's postings. Callers must hold the write lock.
+func (idx *SearchIndex) remove(id int) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		postings := idx.postings[term]
+		delete(postings, id)
+		if len(postings) == 0 {
+			delete(idx.postings, term)
+			i := sort.SearchStrings(idx.terms, term)
+			idx.terms = append(idx.terms[:i], idx.terms[i+1:]...)
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// SearchHit is one search result
+type SearchHit struct {
+	Book
+	Score float64 `json:"score"`
+}
+
+// Search returns the books matching every word of query, best first.
+// Each query word matches a term exactly or as a prefix; scores weigh
+// exact hits over prefix hits, titles over authors and rare terms over
+// common ones (inverse document frequency). Ties go to the lower ID.
+func (idx *SearchIndex) Search(query string) []SearchHit {
+	words := tokenize(query)
+	if len(words) == 0 {
+		return []SearchHit{}
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var scores map[int]float64
+	for _, word := range words {
+		wordScores := idx.match(word)
+		if scores == nil {
+			scores = wordScores
+			continue
+		}
+		// Every word must match: keep only books in both sets
+		for id, s := range scores {
+			if ws, ok := wordScores[id]; ok {
+				scores[id] = s + ws
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	hits := make([]SearchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, SearchHit{Book: idx.docs[id].book, Score: math.Round(score*1000) / 1000})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	return hits
+}
+
+// match scores every book containing a term equal to or starting with
+// word, keeping each book's best term. Callers must hold the read lock.
+func (idx *SearchIndex) match(word string) map[int]float64 {
+	scores := make(map[int]float64)
+	n := float64(len(idx.docs))
+	for i := sort.SearchStrings(idx.terms, word); i < len(idx.terms) && strings.HasPrefix(idx.terms[i], word); i++ {
+		term := idx.terms[i]
+		postings := idx.postings[term]
+		idf := math.Log(1 + n/float64(len(postings)))
+		boost := 1.0
+		if term != word {
+			boost = prefixWeight
+		}
+		for id, w := range postings {
+			if s := w * idf * boost; s > scores[id] {
+				scores[id] = s
+			}
+		}
+	}
+	return scores
+}
+
+// indexedRepository keeps a SearchIndex in step with every write made
+// through the wrapped repository, whichever handler or service made it
+type indexedRepository struct {
+	BookRepository
+	index *SearchIndex
+}
+
+func (r *indexedRepository) Create(book Book) (Book, error) {
+	created, err := r.BookRepository.Create(book)
+	if err == nil {
+		r.index.Put(created)
+	}
+	return created, err
+}
+
+func (r *indexedRepository) CreateMany(books []Book) ([]Book, error) {
+	created, err := r.BookRepository.CreateMany(books)
+	for _, b := range created {
+		r.index.Put(b)
+	}
+	return created, err
+}
+
+func (r *indexedRepository) Update(id int, book Book, version int) (Book, error) {
+	updated, err := r.BookRepository.Update(id, book, version)
+	if err == nil {
+		r.index.Put(updated)
+	}
+	return updated, err
+}
+
+func (r *indexedRepository) Delete(id int, version int) error {
+	if err := r.BookRepository.Delete(id, version); err != nil {
+		return err
+	}
+	// Delete does not return the tombstone; fetch it so the index sees
+	// the new version
+	if deleted, err := r.BookRepository.Get(id); err == nil {
+		r.index.Put(deleted)
+	}
+	return nil
+}
+
+func (r *indexedRepository) Restore(id int, version int) (Book, error) {
+	restored, err := r.BookRepository.Restore(id, version)
+	if err == nil {
+		r.index.Put(restored)
+	}
+	return restored, err
+}
+
+func (r *indexedRepository) As(actor string) BookRepository {
+	return &indexedRepository{BookRepository: r.BookRepository.As(actor), index: r.index}
+}
+
+// searchBooks serves GET /books/search?q=
+func (h *bookHandler) searchBooks(c *gin.Context) {
+	q := c.Query("q")
+	var errs []Violation
+	if len(tokenize(q)) == 0 {
+		errs = append(errs, Violation{"q", "required", "q must contain at least one word"})
+	}
+	limit := defaultSearchLimit
+	if raw, ok := c.GetQuery("limit"); ok {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			errs = append(errs, Violation{"limit", "range", "limit must be between 1 and 100"})
+		}
+		limit = n
+	}
+	if len(errs) > 0 {
+		respondProblem(c, http.StatusBadRequest, "invalid_query", "Invalid query parameters", errs...)
+		return
+	}
+	fields, ok := parseFields(c, append(bookMembers(h.codec), "score"))
+	if !ok {
+		return
+	}
+
+	hits := h.search.Search(q)
+	c.Header("X-Total-Count", strconv.Itoa(len(hits)))
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	body := make([]bookView, len(hits))
+	for i, hit := range hits {
+		score, _ := json.Marshal(hit.Score)
+		body[i] = h.view(hit.Book, false, fields)
+		body[i].extra = []member{{"score", score}}
+	}
+	c.JSON(http.StatusOK, body)
+}
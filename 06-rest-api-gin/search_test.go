@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"Gödel, Escher, Bach", []string{"godel", "escher", "bach"}},
+		{"  CRÈME brûlée ", []string{"creme", "brulee"}},
+		{"C++ & Go: 2nd ed.", []string{"c", "go", "2nd", "ed"}},
+		{"!!!", []string{}},
+	}
+	for _, tt := range tests {
+		got := tokenize(tt.in)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func hitIDs(hits []SearchHit) []int {
+	ids := make([]int, len(hits))
+	for i, h := range hits {
+		ids[i] = h.ID
+	}
+	return ids
+}
+
+func TestSearchIndexRanking(t *testing.T) {
+	idx := NewSearchIndex(
+		Book{ID: 1, Title: "The Go Programming Language", Author: "Donovan & Kernighan", Version: 1},
+		Book{ID: 2, Title: "Programming Pearls", Author: "Jon Bentley", Version: 1},
+		Book{ID: 3, Title: "Pearls of Functional Algorithm Design", Author: "Richard Bird", Version: 1},
+		Book{ID: 4, Title: "Go in Action", Author: "William Kennedy", Version: 1},
+		Book{ID: 5, Title: "On Programmers", Author: "Grace Go", Version: 1},
+		Book{ID: 6, Title: "Gophers", Author: "Renee French", Version: 1},
+	)
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"pearls", []int{2, 3}},
+		{"programming pearls", []int{2}}, // every word must match
+		{"prog", []int{5, 1, 2}},         // prefix matches; the rarer term ranks first
+		{"go", []int{1, 4, 6, 5}},        // exact title, prefix title, then author
+		{"KERNIGHAN", []int{1}},          // case-folded
+		{"Kernighan Donovan", []int{1}},  // word order does not matter
+		{"rust", []int{}},                // no match
+		{"programmers", []int{5}},        // exact word only matches itself
+		{"go programming", []int{1}},     // "programming" is not a prefix of "programmers"
+	}
+	for _, tt := range tests {
+		got := hitIDs(idx.Search(tt.query))
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSearchIndexIgnoresStaleVersions(t *testing.T) {
+	idx := NewSearchIndex(Book{ID: 1, Title: "Old Title", Version: 1})
+
+	idx.Put(Book{ID: 1, Title: "New Title", Version: 3})
+	idx.Put(Book{ID: 1, Title: "Stale Title", Version: 2}) // arrived late
+
+	if hits := idx.Search("stale"); len(hits) != 0 {
+		t.Errorf("Expected the stale version to be ignored, got %v", hitIDs(hits))
+	}
+	if hits := idx.Search("new"); len(hits) != 1 {
+		t.Errorf("Expected the newest version to stay indexed, got %v", hitIDs(hits))
+	}
+	if hits := idx.Search("old"); len(hits) != 0 {
+		t.Errorf("Expected old terms to be removed, got %v", hitIDs(hits))
+	}
+}
+
+func searchRequest(t *testing.T, router *gin.Engine, q string) []SearchHit {
+	t.Helper()
+	w := doJSON(router, "GET", "/v1/books/search?q="+url.QueryEscape(q), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var hits []SearchHit
+	json.Unmarshal(w.Body.Bytes(), &hits)
+	return hits
+}
+
+func TestSearchEndpointStaysInSync(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	// Seeded books are indexed at startup
+	if hits := searchRequest(t, router, "clean"); len(hits) != 1 || hits[0].ID != 2 || hits[0].Score <= 0 {
+		t.Fatalf("Expected Clean Code with a score, got %+v", hits)
+	}
+
+	var book Book
+	json.Unmarshal(doJSON(router, "POST", "/v1/books", Book{Title: "Gödel, Escher, Bach", Author: "Douglas Hofstadter", Year: 1979}).Body.Bytes(), &book)
+	path := "/v1/books/" + strconv.Itoa(book.ID)
+	if hits := searchRequest(t, router, "godel"); len(hits) != 1 || hits[0].ID != book.ID {
+		t.Fatalf("Expected new book to be found without accents, got %+v", hits)
+	}
+
+	doJSON(router, "PUT", path, Book{Title: "I Am a Strange Loop", Author: "Douglas Hofstadter", Year: 2007})
+	if hits := searchRequest(t, router, "godel"); len(hits) != 0 {
+		t.Errorf("Expected old title to be gone after update, got %+v", hits)
+	}
+	if hits := searchRequest(t, router, "strange loop"); len(hits) != 1 {
+		t.Errorf("Expected new title to be found after update, got %+v", hits)
+	}
+
+	doJSON(router, "DELETE", path, nil)
+	if hits := searchRequest(t, router, "hofstadter"); len(hits) != 0 {
+		t.Errorf("Expected deleted book to be unsearchable, got %+v", hits)
+	}
+
+	doJSON(router, "POST", path+"/restore", nil)
+	if hits := searchRequest(t, router, "hofstadter"); len(hits) != 1 {
+		t.Errorf("Expected restored book to be searchable, got %+v", hits)
+	}
+}
+
+func TestSearchEndpointValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	for _, query := range []string{"", "?q=", "?q=%21%21", "?q=go&limit=0", "?q=go&limit=abc"} {
+		decodeProblem(t, doJSON(router, "GET", "/v1/books/search"+query, nil), http.StatusBadRequest, "invalid_query")
+	}
+
+	w := doJSON(router, "GET", "/v1/books/search?q=c&limit=1", nil)
+	var hits []SearchHit
+	json.Unmarshal(w.Body.Bytes(), &hits)
+	if len(hits) != 1 || w.Header().Get("X-Total-Count") != "1" {
+		t.Errorf("Expected one hit, got %d (total %s)", len(hits), w.Header().Get("X-Total-Count"))
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// v1 was deprecated when /v2 shipped and is switched off at its sunset,
+// which -v1-sunset can push back
+var (
+	v1DeprecatedAt  = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	defaultV1Sunset = time.Date(2027, 4, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// bookCodec converts between stored books and the JSON shape of one API
+// version. Every version is served from the same repository; only the
+// representation differs.
+type bookCodec interface {
+	// encode returns the representation of a stored book
+	encode(b Book) interface{}
+	// expand is encode for ?include=authors
+	expand(b Book) interface{}
+	// decode parses a request body into a book. Version-specific rules
+	// are checked here; the rules every Book must pass are left to the
+	// caller, as are normalize and author resolution.
+	decode(data []byte) (Book, error)
+	// dateMember is the member GET /books filters and sorts dates by
+	dateMember() string
+	// keep fills in what a PUT body left out from the stored book, so a
+	// replacement through one version doesn't erase what another set
+	keep(data []byte, current Book, b *Book)
+}
+
+// v1Codec serves Book as it is stored
+type v1Codec struct {
+	authors *AuthorService
+}
+
+func (v1Codec) encode(b Book) interface{} { return b }
+
+func (c v1Codec) expand(b Book) interface{} {
+	return bookWithAuthors{Book: b, Authors: c.authors.Expand(b)}
+}
+
+func (v1Codec) dateMember() string { return "year" }
+
+func (v1Codec) decode(data []byte) (Book, error) {
+	var b Book
+	err := json.Unmarshal(data, &b)
+	return b, err
+}
+
+// keep holds on to the date and credits a v1 client may never have seen:
+// a body without published keeps the stored date while the year is
+// unchanged, and one without author_ids keeps the credits while the
+// byline is unchanged
+func (v1Codec) keep(data []byte, current Book, b *Book) {
+	var members map[string]json.RawMessage
+	if json.Unmarshal(data, &members) != nil {
+		return
+	}
+	if _, ok := members["published"]; !ok && b.Year == current.Year {
+		b.Published = current.Published
+	}
+	if _, ok := members["author_ids"]; !ok && b.Author == current.Author {
+		b.AuthorIDs = current.AuthorIDs
+	}
+}
+
+// BookV2 is the /v2 representation of a book: authors are nested
+// objects and a publication date takes the place of the bare year
+type BookV2 struct {
+	ID        int         `json:"id"`
+	Title     string      `json:"title" binding:"required"`
+	Authors   []AuthorRef `json:"authors" binding:"required,min=1,dive"`
+	Published string      `json:"published" binding:"required"` // YYYY, YYYY-MM or YYYY-MM-DD
+	ISBN      string      `json:"isbn,omitempty"`
+	Version   int         `json:"version"`
+	DeletedAt *time.Time  `json:"deleted_at,omitempty"`
+}
+
+// AuthorRef credits one author on a v2 book. Catalogued authors are
+// referenced by ID and their name is filled in; anyone else is credited
+// by name alone.
+type AuthorRef struct {
+	ID   int    `json:"id,omitempty"`
+	Name string `json:"name,omitempty" binding:"required_without=ID"`
+}
+
+// bylineSeparator joins the names in a free-text byline, the same way
+// AuthorService.resolve joins catalogued names
+const bylineSeparator = " & "
+
+// v2Codec serves BookV2
+type v2Codec struct {
+	authors *AuthorService
+}
+
+func (c v2Codec) encode(b Book) interface{} {
+	v := BookV2{
+		ID:        b.ID,
+		Title:     b.Title,
+		Published: b.Published,
+		ISBN:      b.ISBN,
+		Version:   b.Version,
+		DeletedAt: b.DeletedAt,
+	}
+	if v.Published == "" {
+		v.Published = strconv.Itoa(b.Year)
+	}
+
+	if len(b.AuthorIDs) > 0 {
+		for _, a := range c.authors.Expand(b) {
+			v.Authors = append(v.Authors, AuthorRef{ID: a.ID, Name: a.Name})
+		}
+	} else {
+		for _, name := range strings.Split(b.Author, bylineSeparator) {
+			v.Authors = append(v.Authors, AuthorRef{Name: name})
+		}
+	}
+	return v
+}
+
+func (v2Codec) dateMember() string { return "published" }
+
+// keep has nothing to do: a v2 body always carries published and authors
+func (v2Codec) keep([]byte, Book, *Book) {}
+
+// expand is encode: v2 always nests the authors
+func (c v2Codec) expand(b Book) interface{} { return c.encode(b) }
+
+func (v2Codec) decode(data []byte) (Book, error) {
+	var v BookV2
+	if err := json.Unmarshal(data, &v); err != nil {
+		return Book{}, err
+	}
+	if err := binding.Validator.ValidateStruct(&v); err != nil {
+		return Book{}, err
+	}
+
+	year, err := parsePublished(v.Published)
+	if err != nil {
+		return Book{}, err
+	}
+	b := Book{
+		ID:        v.ID,
+		Title:     v.Title,
+		Year:      year,
+		Published: v.Published,
+		ISBN:      v.ISBN,
+		Version:   v.Version,
+	}
+
+	// Either every author is catalogued or the byline is free text:
+	// Book has no way to store a mix of the two
+	var names []string
+	for _, a := range v.Authors {
+		if a.ID != 0 {
+			b.AuthorIDs = append(b.AuthorIDs, a.ID)
+		} else {
+			names = append(names, a.Name)
+		}
+	}
+	if len(b.AuthorIDs) > 0 && len(names) > 0 {
+		return Book{}, &FieldError{Violation: Violation{
+			Field:   "authors",
+			Rule:    "consistent",
+			Message: "authors must either all have an id or all be given by name",
+		}}
+	}
+	b.Author = strings.Join(names, bylineSeparator)
+	return b, nil
+}
+
+// publishedLayouts are the precisions a publication date may have
+var publishedLayouts = []string{"2006-01-02", "2006-01", "2006"}
+
+// parsePublished checks a publication date and returns its year
+func parsePublished(s string) (int, error) {
+	for _, layout := range publishedLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			if y := t.Year(); y < 1000 || y > 2100 {
+				return 0, &FieldError{Violation: Violation{
+					Field:   "published",
+					Rule:    "range",
+					Message: "published must fall between the years 1000 and 2100",
+				}}
+			}
+			return t.Year(), nil
+		}
+	}
+	return 0, &FieldError{Violation: Violation{
+		Field:   "published",
+		Rule:    "date",
+		Message: fmt.Sprintf("published %q must be YYYY, YYYY-MM or YYYY-MM-DD", s),
+	}}
+}
+
+// readBook reads a request body and decodes it with the handler's codec,
+// then applies the rules every book must pass. The raw body comes back
+// too, for codec.keep.
+func (h *bookHandler) readBook(c *gin.Context) (Book, []byte, error) {
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return Book{}, nil, err
+	}
+	b, err := h.checkBook(h.codec.decode(data))
+	return b, data, err
+}
+
+// checkBook validates a decoded book and normalises it
+func (h *bookHandler) checkBook(b Book, err error) (Book, error) {
+	if err != nil {
+		return Book{}, err
+	}
+	if err := binding.Validator.ValidateStruct(&b); err != nil {
+		return Book{}, err
+	}
+	if err := b.normalize(); err != nil {
+		return Book{}, err
+	}
+	return b, nil
+}
+
+// changeView is a history entry with its snapshots in a version's shape
+type changeView struct {
+	Action  string      `json:"action"`
+	Version int         `json:"version"`
+	At      time.Time   `json:"at"`
+	Actor   string      `json:"actor,omitempty"`
+	Before  interface{} `json:"before"`
+	After   interface{} `json:"after"`
+}
+
+func (h *bookHandler) encodeChange(ch Change) changeView {
+	v := changeView{Action: ch.Action, Version: ch.Version, At: ch.At, Actor: ch.Actor}
+	if ch.Before != nil {
+		v.Before = h.codec.encode(*ch.Before)
+	}
+	if ch.After != nil {
+		v.After = h.codec.encode(*ch.After)
+	}
+	return v
+}
+
+// deprecated marks every response of a version as deprecated (RFC 9745)
+// and announces when it will be switched off (RFC 8594)
+func deprecated(since, sunset time.Time) gin.HandlerFunc {
+	deprecation := "@" + strconv.FormatInt(since.Unix(), 10)
+	sunsetAt := sunset.UTC().Format(http.TimeFormat)
+	return func(c *gin.Context) {
+		c.Header("Deprecation", deprecation)
+		c.Header("Sunset", sunsetAt)
+		c.Next()
+	}
+}
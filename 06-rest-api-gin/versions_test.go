@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestV1IsDeprecated(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	sunset := time.Date(2027, 1, 31, 0, 0, 0, 0, time.UTC)
+	router := setupRouter(NewMemoryBookRepository(defaultBooks()...), WithAuthSecret(testSecret), WithV1Sunset(sunset))
+
+	w := doJSON(router, "GET", "/v1/books", nil)
+	if got, want := w.Header().Get("Deprecation"), "@"+strconv.FormatInt(v1DeprecatedAt.Unix(), 10); got != want {
+		t.Errorf("Expected Deprecation %s, got %q", want, got)
+	}
+	if got := w.Header().Get("Sunset"); got != "Sun, 31 Jan 2027 00:00:00 GMT" {
+		t.Errorf("Expected Sunset on 31 Jan 2027, got %q", got)
+	}
+
+	// Errors from a deprecated version carry the headers too
+	if w := doJSON(router, "GET", "/v1/books/999", nil); w.Header().Get("Sunset") == "" {
+		t.Error("Expected Sunset on a v1 error response")
+	}
+
+	w = doJSON(router, "GET", "/v2/books", nil)
+	if w.Header().Get("Deprecation") != "" || w.Header().Get("Sunset") != "" {
+		t.Errorf("Expected no deprecation headers on v2, got %v", w.Header())
+	}
+}
+
+func TestUnversionedRoutesAreGone(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	p := decodeProblem(t, doJSON(router, "GET", "/books", nil), http.StatusNotFound, "route_not_found")
+	if p.Detail != "No route matches GET /books; the API is served under /v1 and /v2" {
+		t.Errorf("Expected a pointer to the versioned routes, got %q", p.Detail)
+	}
+}
+
+func TestV2CreateIsVisibleInV1(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w := doJSON(router, "POST", "/v2/books", map[string]interface{}{
+		"title":     "Design Patterns",
+		"authors":   []map[string]string{{"name": "Gamma"}, {"name": "Helm"}},
+		"published": "1994-10-31",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created BookV2
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if len(created.Authors) != 2 || created.Authors[1].Name != "Helm" || created.Published != "1994-10-31" {
+		t.Errorf("Expected the v2 shape back, got %+v", created)
+	}
+
+	var v1 Book
+	json.Unmarshal(doJSON(router, "GET", "/v1/books/"+strconv.Itoa(created.ID), nil).Body.Bytes(), &v1)
+	if v1.Author != "Gamma & Helm" || v1.Year != 1994 || v1.Published != "1994-10-31" {
+		t.Errorf("Expected byline, year and date in v1, got %+v", v1)
+	}
+}
+
+func TestV1BookInV2Shape(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	a := createAuthor(t, router, "Alan Donovan")
+	var book Book
+	json.Unmarshal(doJSON(router, "POST", "/v1/books", map[string]interface{}{
+		"title": "The Go Programming Language", "year": 2015, "author_ids": []int{a.ID},
+	}).Body.Bytes(), &book)
+
+	w := doJSON(router, "GET", "/v2/books/"+strconv.Itoa(book.ID), nil)
+	var v2 BookV2
+	json.Unmarshal(w.Body.Bytes(), &v2)
+	if v2.Published != "2015" {
+		t.Errorf("Expected the year as the published date, got %q", v2.Published)
+	}
+	if len(v2.Authors) != 1 || v2.Authors[0] != (AuthorRef{ID: a.ID, Name: "Alan Donovan"}) {
+		t.Errorf("Expected the catalogued author nested, got %+v", v2.Authors)
+	}
+
+	// Both versions share the version counter, so ETags line up
+	if w.Header().Get("ETag") != bookETag(book, false) {
+		t.Errorf("Expected ETag %s, got %s", bookETag(book, false), w.Header().Get("ETag"))
+	}
+
+	var raw map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &raw)
+	for _, field := range []string{"year", "author", "author_ids"} {
+		if _, ok := raw[field]; ok {
+			t.Errorf("Expected no %q in the v2 shape", field)
+		}
+	}
+}
+
+func TestV2Validation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+	a := createAuthor(t, router, "Martin Fowler")
+
+	tests := []struct {
+		name      string
+		body      map[string]interface{}
+		status    int
+		wantField string
+	}{
+		{"missing authors", map[string]interface{}{"title": "T", "published": "2000"}, http.StatusBadRequest, "authors"},
+		{"empty author", map[string]interface{}{"title": "T", "published": "2000", "authors": []map[string]string{{}}},
+			http.StatusBadRequest, "authors[0].name"},
+		{"bad date", map[string]interface{}{"title": "T", "published": "31/12/2000", "authors": []map[string]string{{"name": "A"}}},
+			http.StatusBadRequest, "published"},
+		{"year out of range", map[string]interface{}{"title": "T", "published": "0999", "authors": []map[string]string{{"name": "A"}}},
+			http.StatusBadRequest, "published"},
+		{"mixed authors", map[string]interface{}{"title": "T", "published": "2000",
+			"authors": []map[string]interface{}{{"id": a.ID}, {"name": "B"}}}, http.StatusBadRequest, "authors"},
+		{"unknown author", map[string]interface{}{"title": "T", "published": "2000",
+			"authors": []map[string]interface{}{{"id": 999}}}, http.StatusUnprocessableEntity, "author_ids"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := decodeProblem(t, doJSON(router, "POST", "/v2/books", tt.body), tt.status, "validation_failed")
+			if len(p.Violations) == 0 || p.Violations[0].Field != tt.wantField {
+				t.Errorf("Expected a violation on %s, got %+v", tt.wantField, p.Violations)
+			}
+		})
+	}
+}
+
+func TestV2PatchPublished(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/v2/books/1", bytes.NewBufferString(`{"published":"2016-03"}`))
+	authorize(req, RoleAdmin)
+	req.Header.Set("Content-Type", mergePatchType)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var v1 Book
+	json.Unmarshal(doJSON(router, "GET", "/v1/books/1", nil).Body.Bytes(), &v1)
+	if v1.Year != 2016 || v1.Published != "2016-03" {
+		t.Errorf("Expected year 2016 from the patched date, got %+v", v1)
+	}
+
+	// A v1 write to another year drops the date it contradicts
+	doJSON(router, "PUT", "/v1/books/1", Book{Title: v1.Title, Author: v1.Author, Year: 2017, Published: v1.Published})
+	var v2 BookV2
+	json.Unmarshal(doJSON(router, "GET", "/v2/books/1", nil).Body.Bytes(), &v2)
+	if v2.Published != "2017" {
+		t.Errorf("Expected published to follow the v1 year, got %q", v2.Published)
+	}
+}
+
+func TestV1PutKeepsV2Data(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter()
+
+	a := createAuthor(t, router, "Alan Donovan")
+	w := doJSON(router, "PUT", "/v2/books/1", map[string]interface{}{
+		"title": "The Go Programming Language", "published": "2015-10-26",
+		"authors": []map[string]int{{"id": a.ID}},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A v1 client that knows nothing of the date or the credits leaves
+	// both out; a replacement with the same year and byline keeps them
+	w = doJSON(router, "PUT", "/v1/books/1", map[string]interface{}{
+		"title": "The Go Programming Language, 1st ed.", "author": "Alan Donovan", "year": 2015,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var v1 Book
+	json.Unmarshal(w.Body.Bytes(), &v1)
+	if v1.Published != "2015-10-26" {
+		t.Errorf("Expected the v2 date to survive, got %q", v1.Published)
+	}
+	if len(v1.AuthorIDs) != 1 || v1.AuthorIDs[0] != a.ID {
+		t.Errorf("Expected the v2 credits to survive, got %v", v1.AuthorIDs)
+	}
+
+	// A new byline replaces the credits
+	w = doJSON(router, "PUT", "/v1/books/1", map[string]interface{}{
+		"title": "The Go Programming Language", "author": "Donovan & Kernighan", "year": 2015,
+	})
+	v1 = Book{}
+	json.Unmarshal(w.Body.Bytes(), &v1)
+	if len(v1.AuthorIDs) != 0 || v1.Author != "Donovan & Kernighan" {
+		t.Errorf("Expected a free-text byline, got %+v", v1)
+	}
+}